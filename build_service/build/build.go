@@ -0,0 +1,483 @@
+// Package build turns stored repository archives into builds, stored as
+// manifests of content-addressed files.
+package build
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/apierr"
+	"zenith/shared/archive"
+	"zenith/shared/auth"
+	"zenith/shared/config"
+	"zenith/shared/health"
+	"zenith/shared/lifecycle"
+	"zenith/shared/logging"
+	"zenith/shared/manifest"
+	"zenith/shared/metrics"
+	"zenith/shared/redact"
+	"zenith/shared/retry"
+	"zenith/shared/storage"
+	"zenith/shared/tracing"
+)
+
+var buildMutex sync.Mutex
+
+var (
+	buildsQueued = metrics.NewGauge("zenith_build_queue_depth", "Builds waiting for the running build to finish.")
+	buildsActive = metrics.NewGauge("zenith_active_builds", "Builds running.")
+	buildsTotal  = metrics.NewCounter("zenith_builds_total", "Finished builds by outcome.", "outcome")
+)
+var ErrRepoNotFound = errors.New("repository not found")
+
+// ErrInvalidRepoName is returned for repository names that are not a single
+// path element.
+var ErrInvalidRepoName = errors.New("invalid repository name")
+
+// ErrInvalidSource is returned for sources that are not a source key of the
+// repository being built.
+var ErrInvalidSource = errors.New("invalid source")
+
+type BuildRequest struct {
+	RepoName string `json:"repo" binding:"required"`
+	// Source is the key upload stored the repository under. Without one,
+	// the project is created from the template when that is allowed.
+	Source      string `json:"source"`
+	UseTemplate bool   `json:"use_template"`
+	Template    string `json:"template"`
+}
+
+// Result is the outcome of a successful build.
+type Result struct {
+	Message     string `json:"message"`
+	Status      string `json:"status"`
+	CreatedFrom string `json:"created_from"`
+	// Manifest is the key of the manifest of the build output.
+	Manifest string          `json:"manifest,omitempty"`
+	Stored   *manifest.Stats `json:"stored,omitempty"`
+}
+
+var (
+	cfg     *config.Config
+	store   storage.Store
+	logger  = slog.Default()
+	checker *health.Checker
+	scratch *lifecycle.Scratch
+	// minFreeDisk is the least free space in the tmp directory for the
+	// service to be ready.
+	minFreeDisk int64
+)
+
+// Setup configures the package for Build and the HTTP handlers.
+func Setup(c *config.Config, s storage.Store) error {
+	cfg = c
+	logger = logging.New("build_service", c.Build.LogLevel)
+	store = s
+	redact.Install(c.Secrets()...)
+	if err := retry.Setup(c.Retry); err != nil {
+		return err
+	}
+	var err error
+	if scratch, err = lifecycle.OpenScratch(cfg.Build.TmpDir); err != nil {
+		return err
+	}
+	if minFreeDisk, err = health.MinFreeDisk(c.Health); err != nil {
+		return err
+	}
+	checker = health.New("build_service", health.Check{Name: "storage", Run: func(ctx context.Context) error {
+		return store.Check(ctx)
+	}})
+	checker.Add(HealthChecks()...)
+	return nil
+}
+
+// HealthChecks checks the node toolchain and the space left in the tmp
+// directory. Setup must be called first.
+func HealthChecks() []health.Check {
+	return append(health.Binaries("node", "npm", "npx"), health.DiskSpace("tmp", cfg.Build.TmpDir, minFreeDisk))
+}
+
+// Routes registers the public health checks on r. /health is kept for
+// probes configured before /healthz. Builds are only served on the internal
+// listener: which projects a caller may deploy is known to request_handler
+// alone, so it is the only caller.
+func Routes(r gin.IRoutes) {
+	r.GET("/health", checker.Healthz)
+	checker.Routes(r)
+}
+
+// InternalRoutes registers the build API on r for request_handler, which
+// signs its calls with the internal secret, the metrics for Prometheus and
+// the health checks.
+func InternalRoutes(r gin.IRoutes, v *auth.Verifier) {
+	r.POST("/build", auth.RequireSigned(v), logging.TrustDeploymentID, handleBuildRequest)
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+	checker.Routes(r)
+}
+
+// Run serves the health checks on cfg.Build.Addr and the build API for
+// request_handler on cfg.Build.InternalAddr as a standalone service until
+// SIGINT or SIGTERM. Builds still running after the shutdown timeout are
+// cancelled, which kills their npm processes.
+func Run(c *config.Config) error {
+	s, err := storage.New(c.Storage)
+	if err != nil {
+		return err
+	}
+	if err := Setup(c, s); err != nil {
+		return err
+	}
+	shutdown, err := tracing.Setup(context.Background(), c.Tracing, "build_service")
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.Background())
+	slog.SetDefault(logger)
+	timeout, err := lifecycle.Timeout(c.Shutdown)
+	if err != nil {
+		return err
+	}
+
+	router := gin.New()
+	router.Use(gin.Recovery(), logging.Middleware(logger), tracing.Middleware())
+	Routes(router)
+	internal := gin.New()
+	internal.Use(gin.Recovery(), logging.Middleware(logger), tracing.Middleware())
+	InternalRoutes(internal, auth.NewVerifier(cfg.Auth.InternalSecret))
+
+	ctx, stop := lifecycle.SignalContext()
+	defer stop()
+	logger.Info("server starting", "addr", cfg.Build.Addr, "internal_addr", cfg.Build.InternalAddr)
+	err = lifecycle.Serve(ctx, timeout,
+		&http.Server{Addr: cfg.Build.Addr, Handler: router},
+		&http.Server{Addr: cfg.Build.InternalAddr, Handler: internal})
+	logger.Info("server stopped")
+	return err
+}
+
+func handleBuildRequest(c *gin.Context) {
+	var req BuildRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierr.Respond(c, apierr.New(apierr.CodeInvalidRequest, "", err.Error()))
+		return
+	}
+
+	result, err := Build(c.Request.Context(), req)
+	if err != nil {
+		apierr.Respond(c, err)
+		return
+	}
+
+	c.JSON(200, result)
+}
+
+// Build builds the archive req.Source of req.RepoName and stores the
+// output as a manifest named after the deployment in ctx. Builds run one at
+// a time. Errors are *apierr.Error values naming the step that failed.
+func Build(ctx context.Context, req BuildRequest) (*Result, error) {
+	if req.RepoName == "" || strings.Contains(req.RepoName, "/") || strings.Contains(req.RepoName, "..") {
+		return nil, apierr.Wrap(ErrInvalidRepoName, apierr.CodeInvalidRequest, "")
+	}
+	if !logging.ValidID(logging.DeploymentID(ctx)) {
+		ctx = logging.WithDeploymentID(ctx, logging.NewID())
+	}
+	// A project created from the template is stored as the deployment's
+	// source.
+	if req.Source == "" {
+		req.Source = manifest.SourceKey(req.RepoName, logging.DeploymentID(ctx))
+	} else if id, ok := manifest.SourceID(req.RepoName, req.Source); !ok || !logging.ValidID(id) {
+		return nil, apierr.Wrap(fmt.Errorf("%w: %q", ErrInvalidSource, req.Source), apierr.CodeInvalidRequest, "")
+	}
+
+	if req.Template == "" {
+		req.Template = cfg.Build.DefaultTemplate
+	}
+
+	buildsQueued.Inc()
+	buildMutex.Lock()
+	defer buildMutex.Unlock()
+	buildsQueued.Dec()
+	buildsActive.Inc()
+	defer buildsActive.Dec()
+
+	var createdNew bool
+
+	result, err := HandleBuild(ctx, req.RepoName, req.Source)
+
+	if errors.Is(err, ErrRepoNotFound) && (req.UseTemplate || cfg.Build.AutoCreateFromTemplate) {
+		logger.InfoContext(ctx, "repository not found, creating from template", "repo", req.RepoName, "template", req.Template)
+		result, err = CreateFromTemplate(ctx, req.RepoName, req.Source, req.Template)
+		if err == nil {
+			createdNew = true
+		}
+	}
+	if errors.Is(err, ErrRepoNotFound) {
+		err = apierr.Wrap(fmt.Errorf("%w; add 'use_template': true to create it from a template", err), apierr.CodeNotFound, "download")
+	}
+	buildsTotal.Inc(metrics.Outcome(err))
+	if err != nil {
+		logger.ErrorContext(ctx, "build failed", "repo", req.RepoName, "error", err)
+		return nil, err
+	}
+	logger.InfoContext(ctx, "build finished", "repo", req.RepoName, "created_from_template", createdNew,
+		"manifest", result.Manifest, "files", result.Stored.Files, "new_files", result.Stored.NewFiles)
+
+	result.Message = "Build completed and uploaded successfully"
+	if createdNew {
+		result.Message = "Created new project from template and built successfully"
+	}
+	result.Status = "success"
+	result.CreatedFrom = ternary(createdNew, req.Template, "")
+	return result, nil
+}
+
+func ternary(condition bool, trueVal, falseVal string) string {
+	if condition {
+		return trueVal
+	}
+	return falseVal
+}
+
+// HandleBuild builds the archive zipFile of repoName. It fails with
+// ErrRepoNotFound when storage has no such archive.
+func HandleBuild(ctx context.Context, repoName, zipFile string) (*Result, error) {
+
+	exists, err := store.Exists(ctx, zipFile)
+	if err != nil {
+		return nil, apierr.Wrap(fmt.Errorf("failed to check if file exists: %w", err), apierr.CodeStorage, "download")
+	}
+	if !exists {
+		return nil, fmt.Errorf("%w: %s not found in %s", ErrRepoNotFound, zipFile, store.Describe())
+	}
+
+	workDir, err := scratch.Mkdir(ctx, repoName)
+	if err != nil {
+		return nil, apierr.Wrap(fmt.Errorf("failed to create build directory: %w", err), apierr.CodeInternal, "download")
+	}
+	defer scratch.Remove(workDir)
+	unzipPath := filepath.Join(workDir, repoName)
+
+	// The archive is read from storage as it is extracted.
+	extractCtx, done := tracing.Stage(ctx, "build", "extract")
+	err = Extract(extractCtx, zipFile, unzipPath)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildProject(ctx, repoName, unzipPath, filepath.Join(unzipPath, "build"))
+}
+
+// CreateFromTemplate creates repoName from the template templateName,
+// stores its source as zipFile and builds it.
+func CreateFromTemplate(ctx context.Context, repoName, zipFile, templateName string) (*Result, error) {
+	workDir, err := scratch.Mkdir(ctx, repoName)
+	if err != nil {
+		return nil, apierr.Wrap(fmt.Errorf("failed to create build directory: %w", err), apierr.CodeInternal, "template")
+	}
+	defer scratch.Remove(workDir)
+	// The templates name the project after its directory.
+	unzipPath := filepath.Join(workDir, repoName)
+	buildOutput := filepath.Join(unzipPath, "build")
+
+	var cmd *exec.Cmd
+	switch templateName {
+	case "create-react-app":
+		cmd = lifecycle.Command(ctx, "npx", "create-react-app", unzipPath)
+	case "next":
+		cmd = lifecycle.Command(ctx, "npx", "create-next-app@latest", unzipPath, "--use-npm")
+	case "vite":
+		os.MkdirAll(unzipPath, os.ModePerm)
+		cmd = lifecycle.Command(ctx, "npm", "init", "vite@latest", ".", "--", "--template", "react")
+		cmd.Dir = unzipPath
+	default:
+		return nil, apierr.New(apierr.CodeInvalidRequest, "template", "unsupported template: "+templateName)
+	}
+
+	templateCtx, done := tracing.Stage(ctx, "build", "template")
+	err = runCommand(templateCtx, cmd)
+	done(err)
+	if err != nil {
+		return nil, apierr.Wrap(fmt.Errorf("failed to create project from template: %w", err), apierr.CodeBuildFailed, "template")
+	}
+
+	if _, err := UploadFolder(ctx, unzipPath, zipFile); err != nil {
+		return nil, apierr.Wrap(fmt.Errorf("failed to upload templated project: %w", err), apierr.CodeStorage, "template")
+	}
+
+	return buildProject(ctx, repoName, unzipPath, buildOutput)
+}
+
+// buildProject builds the project in unzipPath and stores its output,
+// buildOutput or the first of the other usual output directories found.
+func buildProject(ctx context.Context, repoName, unzipPath, buildOutput string) (*Result, error) {
+	if _, err := os.Stat(filepath.Join(unzipPath, "package.json")); os.IsNotExist(err) {
+		return nil, apierr.New(apierr.CodeBuildFailed, "npm_install", "package.json not found in repository")
+	}
+
+	install := lifecycle.Command(ctx, "npm", "install")
+	install.Dir = unzipPath
+	installCtx, done := tracing.Stage(ctx, "build", "npm_install")
+	err := runCommand(installCtx, install)
+	done(err)
+	if err != nil {
+		return nil, apierr.Wrap(fmt.Errorf("npm install failed: %w", err), apierr.CodeBuildFailed, "npm_install")
+	}
+
+	build := lifecycle.Command(ctx, "npm", "run", "build")
+	build.Dir = unzipPath
+	buildCtx, done := tracing.Stage(ctx, "build", "npm_build")
+	err = runCommand(buildCtx, build)
+	done(err)
+	if err != nil {
+		return nil, apierr.Wrap(fmt.Errorf("npm build failed: %w", err), apierr.CodeBuildFailed, "npm_build")
+	}
+
+	if _, err := os.Stat(buildOutput); os.IsNotExist(err) {
+		alternatives := []string{
+			filepath.Join(unzipPath, "dist"),
+			filepath.Join(unzipPath, "out"),
+			filepath.Join(unzipPath, ".next"),
+		}
+		buildFound := false
+		for _, alt := range alternatives {
+			if _, err := os.Stat(alt); !os.IsNotExist(err) {
+				buildOutput = alt
+				buildFound = true
+				break
+			}
+		}
+		if !buildFound {
+			return nil, apierr.New(apierr.CodeBuildFailed, "npm_build", "build folder not found")
+		}
+	}
+
+	if err := PrecompressAssets(buildOutput); err != nil {
+		logger.WarnContext(ctx, "precompressing assets failed", "error", err)
+	}
+
+	// Files are hashed and stored in the same pass, so the stage covers
+	// both. Only the files storage does not hold yet are uploaded. The
+	// manifest is named after the deployment, when request_handler sent a
+	// well-formed ID.
+	id := logging.DeploymentID(ctx)
+	if !logging.ValidID(id) {
+		id = logging.NewID()
+	}
+	storeCtx, done := tracing.Stage(ctx, "build", "store")
+	m, stats, err := StoreOutput(storeCtx, buildOutput, repoName, id)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	metrics.ArtifactBytes.Observe(float64(stats.NewSize), "build")
+	return &Result{Manifest: manifest.Key(m.Repo, m.ID), Stored: &stats}, nil
+}
+
+// StoreOutput stores the files below dir as the manifest id of repoName.
+func StoreOutput(ctx context.Context, dir, repoName, id string) (*manifest.Manifest, manifest.Stats, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	m, stats, err := manifest.Build(ctx, store, dir, repoName, id)
+	if err != nil {
+		return nil, stats, apierr.Wrap(fmt.Errorf("storing build output failed: %w", err), apierr.CodeStorage, "store")
+	}
+	return m, stats, nil
+}
+
+// runCommand runs cmd in a span and logs its output line by line.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	out := logging.Writer(ctx, logger, "command output", "command", filepath.Base(cmd.Path))
+	defer out.Close()
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return tracing.Run(ctx, cmd)
+}
+
+// Extract extracts the stored archive objectName into dest, reading it from
+// storage as it goes, with the shared archive limits.
+func Extract(ctx context.Context, objectName, dest string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	obj, err := store.Open(ctx, objectName)
+	if err != nil {
+		return apierr.Wrap(fmt.Errorf("download failed: %w", err), apierr.CodeStorage, "download")
+	}
+	defer obj.Close()
+	if err := archive.ExtractAt(obj, obj.Size(), dest, archive.DefaultLimits); err != nil {
+		return apierr.Wrap(fmt.Errorf("unzip failed: %w", err), apierr.CodeBuildFailed, "extract")
+	}
+	return nil
+}
+
+// UploadFolder zips source and streams the archive to storage as
+// objectName, returning the size of the archive. Zipping errors are
+// *storage.WriteError values.
+func UploadFolder(ctx context.Context, source, objectName string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	var size int64
+	err := storage.Stream(ctx, store, objectName, "application/zip", func(w io.Writer) (err error) {
+		size, err = ZipFolder(source, w)
+		return err
+	})
+	return size, err
+}
+
+// ZipFolder writes the files below source as a zip archive to w and returns
+// the number of bytes written.
+func ZipFolder(source string, w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	archive := zip.NewWriter(counter)
+
+	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		relPath = strings.ReplaceAll(relPath, string(filepath.Separator), "/")
+		writer, err := archive.Create(relPath)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(writer, f)
+		return err
+	})
+	if err != nil {
+		return counter.n, err
+	}
+	err = archive.Close()
+	return counter.n, err
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,86 @@
+package build
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Files smaller than this are not worth compressing ahead of time.
+const minPrecompressSize = 1024
+
+var compressibleExtensions = map[string]bool{
+	".html": true, ".htm": true, ".css": true, ".js": true, ".mjs": true,
+	".json": true, ".map": true, ".svg": true, ".txt": true, ".xml": true,
+	".wasm": true, ".ico": true, ".webmanifest": true,
+}
+
+// PrecompressAssets writes .gz and .br siblings next to every compressible
+// file in dir so the static server can serve them without compressing on
+// each request. A variant is only kept if it is smaller than the original.
+func PrecompressAssets(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if info.Size() < minPrecompressSize || !compressibleExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		if err := compressFile(path, path+".gz", info.Size(), func(w io.Writer) io.WriteCloser {
+			zw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+			return zw
+		}); err != nil {
+			return fmt.Errorf("gzip %s: %w", path, err)
+		}
+
+		if err := compressFile(path, path+".br", info.Size(), func(w io.Writer) io.WriteCloser {
+			return brotli.NewWriterLevel(w, brotli.BestCompression)
+		}); err != nil {
+			return fmt.Errorf("brotli %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+func compressFile(src, dst string, srcSize int64, newWriter func(io.Writer) io.WriteCloser) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	zw := newWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		zw.Close()
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+
+	info, err := out.Stat()
+	out.Close()
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	if info.Size() >= srcSize {
+		os.Remove(dst)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package build
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestPrecompressAssets(t *testing.T) {
+	dir := t.TempDir()
+	random := make([]byte, 4096)
+	rand.Read(random)
+	files := map[string][]byte{
+		"index.html":         []byte(strings.Repeat("<p>hello</p>\n", 200)),
+		"assets/app.JS":      []byte(strings.Repeat("console.log(1);\n", 200)),
+		"assets/small.css":   []byte("body{}"),
+		"assets/photo.png":   bytes.Repeat([]byte{0}, 4096),
+		"assets/random.json": random,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := PrecompressAssets(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		".gz": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		".br": func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	}
+	for name, content := range files {
+		// Only compressible files large enough, whose variants come out
+		// smaller, get them.
+		want := name == "index.html" || name == "assets/app.JS"
+		for ext, decode := range decoders {
+			f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)+ext))
+			if !want {
+				if err == nil {
+					f.Close()
+					t.Errorf("%s%s was written", name, ext)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s%s: %v", name, ext, err)
+				continue
+			}
+			r, err := decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			f.Close()
+			if err != nil || !bytes.Equal(got, content) {
+				t.Errorf("%s%s does not decompress to the original: %v", name, ext, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Command zenith runs Zenith's services. "zenith server" runs all of them in
+// one process; the other subcommands run a single service, like the
+// binaries built from each service directory.
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/joho/godotenv"
+	"zenith/build_service/build"
+	"zenith/request_handler/deploy"
+	"zenith/shared/config"
+	"zenith/upload_service/upload"
+)
+
+const usage = `usage: zenith <command> [flags]
+
+commands:
+  server           run every service in one process
+  request-handler  run the deploy API
+  upload           run upload_service
+  build            run build_service
+  edge             serve deployed sites from storage
+
+Run "zenith <command> --help" for the flags of a command.
+`
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		slog.Warn("error loading .env file", "error", err)
+	}
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command, args := os.Args[1], os.Args[2:]
+
+	var err error
+	switch command {
+	case "server":
+		err = runServer(config.MustLoadArgs(config.Server, args))
+	case "request-handler":
+		err = deploy.Run(config.MustLoadArgs(config.RequestHandler, args))
+	case "upload":
+		err = upload.Run(config.MustLoadArgs(config.Upload, args))
+	case "build":
+		err = build.Run(config.MustLoadArgs(config.Build, args))
+	case "edge":
+		err = deploy.RunEdge(config.MustLoadArgs(config.Edge, args))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
+}
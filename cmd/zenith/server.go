@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"zenith/build_service/build"
+	"zenith/request_handler/deploy"
+	"zenith/shared/config"
+	"zenith/shared/health"
+	"zenith/shared/lifecycle"
+	"zenith/shared/logging"
+	"zenith/shared/storage"
+	"zenith/shared/tracing"
+	"zenith/upload_service/upload"
+)
+
+// runServer runs upload, build and the deploy API in one process. The deploy
+// API calls the other two directly instead of over HTTP, so shutting it down
+// cancels their work too.
+func runServer(cfg *config.Config) error {
+	store, err := storage.New(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	if err := upload.Setup(cfg, store); err != nil {
+		return err
+	}
+	if err := build.Setup(cfg, store); err != nil {
+		return err
+	}
+	if err := deploy.Setup(cfg, store, localUploader{}, localBuilder{}); err != nil {
+		return err
+	}
+	shutdown, err := tracing.Setup(context.Background(), cfg.Tracing, "zenith")
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.Background())
+
+	logger := logging.New("zenith", cfg.RequestHandler.LogLevel)
+	slog.SetDefault(logger)
+	logger.Info("server starting", "addr", cfg.RequestHandler.Addr, "store", store.Describe())
+	ctx, stop := lifecycle.SignalContext()
+	defer stop()
+	return deploy.Serve(ctx)
+}
+
+// localUploader calls the upload package in process.
+type localUploader struct{}
+
+func (localUploader) Upload(ctx context.Context, repoURL, token string) (*deploy.DeployResponse, error) {
+	res, err := upload.Upload(ctx, repoURL, token)
+	if err != nil {
+		return nil, err
+	}
+	packaging := &deploy.Packaging{
+		Files:        res.Packaging.Files,
+		Size:         res.Packaging.Size,
+		ArchiveSize:  res.Packaging.ArchiveSize,
+		Skipped:      []deploy.SkippedPath{},
+		SkippedFiles: res.Packaging.SkippedFiles,
+		SkippedSize:  res.Packaging.SkippedSize,
+	}
+	for _, s := range res.Packaging.Skipped {
+		packaging.Skipped = append(packaging.Skipped, deploy.SkippedPath(s))
+	}
+	var secrets []deploy.SecretFinding
+	for _, f := range res.Secrets {
+		secrets = append(secrets, deploy.SecretFinding(f))
+	}
+	return &deploy.DeployResponse{
+		Repo:      res.Repo,
+		Message:   res.Message,
+		Bucket:    res.Bucket,
+		File:      res.File,
+		Timestamp: res.Timestamp,
+		Packaging: packaging,
+		Secrets:   secrets,
+	}, nil
+}
+
+// HealthChecks returns the checks of the upload package, which
+// request_handler's /readyz covers in a single process.
+func (localUploader) HealthChecks() []health.Check { return upload.HealthChecks() }
+
+// localBuilder calls the build package in process.
+type localBuilder struct{}
+
+// HealthChecks returns the checks of the build package.
+func (localBuilder) HealthChecks() []health.Check { return build.HealthChecks() }
+
+func (localBuilder) Build(ctx context.Context, req deploy.BuildRequest) (*deploy.BuildResult, error) {
+	res, err := build.Build(ctx, build.BuildRequest{
+		RepoName:    req.Repo,
+		Source:      req.Source,
+		UseTemplate: req.UseTemplate,
+		Template:    req.Template,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &deploy.BuildResult{
+		Message:     res.Message,
+		Status:      res.Status,
+		CreatedFrom: res.CreatedFrom,
+		Manifest:    res.Manifest,
+		Stored:      res.Stored,
+	}, nil
+}
@@ -1,9 +1,10 @@
 'use client';
 
 import { cn } from "@/lib/utils";
-import React, { useState } from "react";
+import React, { useEffect, useState } from "react";
+import { useRouter } from "next/navigation";
 import Navbar from "@/components/Navbar";
-import axios from "axios";
+import { api, getToken } from "@/lib/api";
 
 interface DeploymentResponse {
   repo: string;
@@ -12,11 +13,18 @@ interface DeploymentResponse {
 }
 
 export default function Home() {
+  const router = useRouter();
   const [repoUrl, setRepoUrl] = useState<string>("");
   const [isLoading, setIsLoading] = useState<boolean>(false);
   const [deploymentResult, setDeploymentResult] = useState<DeploymentResponse | null>(null);
   const [error, setError] = useState<string | null>(null);
 
+  useEffect(() => {
+    if (!getToken()) {
+      router.replace("/login");
+    }
+  }, [router]);
+
   const handleDeploy = async (): Promise<void> => {
     if (!repoUrl) {
       setError("Please enter a GitHub repository URL");
@@ -28,7 +36,7 @@ export default function Home() {
     setDeploymentResult(null);
 
     try {
-      const response = await axios.post("http://localhost:8080/deploy", {
+      const response = await api.post("/deploy", {
         url: repoUrl,
       });
 
@@ -1,8 +1,21 @@
 "use client";
 
-import { Linkedin, Github, Instagram, Twitter } from "lucide-react";
+import { useEffect, useState } from "react";
+import { Linkedin, Github, Instagram, Twitter, LogOut } from "lucide-react";
+import { clearToken, getToken } from "@/lib/api";
 
 export default function Navbar() {
+  const [signedIn, setSignedIn] = useState<boolean>(false);
+
+  useEffect(() => {
+    setSignedIn(getToken() !== null);
+  }, []);
+
+  const signOut = (): void => {
+    clearToken();
+    window.location.href = "/login";
+  };
+
   return (
     <div>
       <header className="fixed top-0 left-0 right-0 z-50 flex items-center justify-between bg-black rounded-xl p-2 m-3 px-6 py-4 border-b border-b-white h-16 shadow-lg">
@@ -29,6 +42,11 @@ export default function Navbar() {
           <a href="https://x.com/DeltaPandey2603" target="_blank" rel="noopener noreferrer" className="text-white hover:text-blue-300 transition-colors">
             <Twitter className="h-5 w-5" />
           </a>
+          {signedIn && (
+            <button onClick={signOut} title="Sign out" className="text-white hover:text-red-400 transition-colors">
+              <LogOut className="h-5 w-5" />
+            </button>
+          )}
         </div>
       </header>
 
@@ -0,0 +1,45 @@
+import axios from "axios";
+
+export const API_URL = process.env.NEXT_PUBLIC_API_URL || "http://localhost:8080";
+
+const TOKEN_KEY = "zenith_token";
+
+export function getToken(): string | null {
+  if (typeof window === "undefined") return null;
+  return window.localStorage.getItem(TOKEN_KEY);
+}
+
+export function setToken(token: string): void {
+  window.localStorage.setItem(TOKEN_KEY, token);
+}
+
+export function clearToken(): void {
+  window.localStorage.removeItem(TOKEN_KEY);
+}
+
+export const api = axios.create({ baseURL: API_URL });
+
+api.interceptors.request.use((config) => {
+  const token = getToken();
+  if (token) {
+    config.headers.Authorization = `Bearer ${token}`;
+  }
+  return config;
+});
+
+// An expired or revoked key sends the user back to the login page.
+api.interceptors.response.use(
+  (response) => response,
+  (error) => {
+    if (error.response?.status === 401 && typeof window !== "undefined") {
+      clearToken();
+      window.location.href = "/login";
+    }
+    return Promise.reject(error);
+  }
+);
+
+export async function login(email: string, password: string): Promise<void> {
+  const response = await axios.post(`${API_URL}/auth/login`, { email, password });
+  setToken(response.data.token);
+}
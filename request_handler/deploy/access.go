@@ -0,0 +1,97 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/auth"
+)
+
+// Project access is decided by the caller's role in the team that owns the
+// project. Keys with the admin scope act as owners of every team.
+
+// callerRole returns the caller's effective role on project repo.
+func callerRole(p *auth.Principal, repo string) (Role, bool) {
+	if p.Can(auth.ScopeAdmin) {
+		return RoleOwner, true
+	}
+	return teams.projectRole(repo, p.UserID)
+}
+
+// canView reports whether the caller may see project repo.
+func canView(p *auth.Principal, repo string) bool {
+	role, ok := callerRole(p, repo)
+	return ok && role.Includes(RoleViewer)
+}
+
+// requireProjectRole responds with an error and returns false unless the
+// caller holds at least role on project repo.
+func requireProjectRole(c *gin.Context, repo string, role Role) bool {
+	p := auth.Current(c)
+	if p.Can(auth.ScopeAdmin) {
+		return true
+	}
+	if _, ok := teams.project(repo); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrProjectNotFound.Error()})
+		return false
+	}
+	if have, ok := teams.projectRole(repo, p.UserID); !ok || !have.Includes(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("requires the %s role on project %s", role, repo)})
+		return false
+	}
+	return true
+}
+
+// requireTeamRole responds with an error and returns false unless the caller
+// holds at least role in team slug.
+func requireTeamRole(c *gin.Context, slug string, role Role) bool {
+	if _, ok := teams.get(slug); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrTeamNotFound.Error()})
+		return false
+	}
+	p := auth.Current(c)
+	if p.Can(auth.ScopeAdmin) {
+		return true
+	}
+	if have, ok := teams.role(slug, p.UserID); !ok || !have.Includes(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("requires the %s role in team %s", role, slug)})
+		return false
+	}
+	return true
+}
+
+// claimProject checks that the caller may deploy repo. A repository deployed
+// for the first time becomes a project of team, which may be left empty when
+// the caller can deploy in exactly one team.
+func claimProject(c *gin.Context, repo, team string) bool {
+	if _, ok := teams.project(repo); ok {
+		return requireProjectRole(c, repo, RoleDeployer)
+	}
+
+	p := auth.Current(c)
+	if team == "" {
+		var candidates []string
+		for _, t := range teams.list(p.UserID) {
+			if role, _ := teams.role(t.Slug, p.UserID); role.Includes(RoleDeployer) {
+				candidates = append(candidates, t.Slug)
+			}
+		}
+		if len(candidates) != 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "'team' is required to create project " + repo})
+			return false
+		}
+		team = candidates[0]
+	}
+	if !requireTeamRole(c, team, RoleDeployer) {
+		return false
+	}
+
+	if _, err := teams.addProject(repo, team); err != nil && !errors.Is(err, ErrProjectExists) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	// Another request may have claimed the project first.
+	return requireProjectRole(c, repo, RoleDeployer)
+}
@@ -0,0 +1,203 @@
+package deploy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/auth"
+)
+
+// users holds the accounts and API keys that authenticate API requests.
+var users *auth.Store
+
+// openUsers loads the account store and creates the bootstrap admin when
+// no account exists yet.
+func openUsers() error {
+	var err error
+	users, err = auth.Open(cfg.Auth.File)
+	if err != nil {
+		return err
+	}
+	if users.HasUsers() {
+		return nil
+	}
+
+	if cfg.Auth.AdminEmail == "" || cfg.Auth.AdminPassword == "" {
+		logger.Warn("no user accounts exist; set ADMIN_EMAIL and ADMIN_PASSWORD to create an admin")
+		return nil
+	}
+	admin, err := users.CreateUser(cfg.Auth.AdminEmail, cfg.Auth.AdminPassword, []string{auth.ScopeAdmin})
+	if err != nil {
+		return err
+	}
+	logger.Info("created admin account", "email", admin.Email)
+	return nil
+}
+
+type userResponse struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type keyResponse struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newUserResponse(u auth.User) userResponse {
+	return userResponse{ID: u.ID, Email: u.Email, Scopes: u.Scopes, CreatedAt: u.CreatedAt}
+}
+
+func newKeyResponse(k auth.APIKey) keyResponse {
+	return keyResponse{ID: k.ID, UserID: k.UserID, Name: k.Name, Scopes: k.Scopes, CreatedAt: k.CreatedAt, ExpiresAt: k.ExpiresAt}
+}
+
+func handleLogin(c *gin.Context) {
+	var req struct {
+		Email    string `json:"email" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ttl, _ := time.ParseDuration(cfg.Auth.SessionTTL)
+	token, key, err := users.Login(req.Email, req.Password, ttl)
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditEntry{Action: "auth.login", Target: key.ID, ActorID: key.UserID, Actor: strings.ToLower(req.Email)}, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"token": token, "key": newKeyResponse(*key)})
+}
+
+func handleMe(c *gin.Context) {
+	p := auth.Current(c)
+	c.JSON(http.StatusOK, gin.H{
+		"user_id": p.UserID,
+		"email":   p.Email,
+		"key_id":  p.KeyID,
+		"scopes":  p.Scopes,
+	})
+}
+
+func handleListKeys(c *gin.Context) {
+	p := auth.Current(c)
+	owner := p.UserID
+	if c.Query("all") == "true" && p.Can(auth.ScopeAdmin) {
+		owner = ""
+	}
+	keys := []keyResponse{}
+	for _, k := range users.Keys(owner) {
+		keys = append(keys, newKeyResponse(k))
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+func handleCreateKey(c *gin.Context) {
+	var req struct {
+		Name      string   `json:"name" binding:"required"`
+		Scopes    []string `json:"scopes" binding:"required"`
+		ExpiresIn string   `json:"expires_in"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var ttl time.Duration
+	if req.ExpiresIn != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must be a positive duration such as 720h"})
+			return
+		}
+	}
+
+	// A key can only hand out scopes it holds itself.
+	p := auth.Current(c)
+	for _, scope := range req.Scopes {
+		if !p.Can(scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "cannot grant the " + scope + " scope"})
+			return
+		}
+	}
+
+	token, key, err := users.CreateKey(p.UserID, req.Name, req.Scopes, ttl)
+	if errors.Is(err, auth.ErrInvalidScope) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.InfoContext(c.Request.Context(), "created API key", "key_id", key.ID, "name", key.Name, "user", p.Email)
+	recordAudit(c, AuditEntry{Action: "key.create", Target: key.ID}, nil, gin.H{"name": key.Name, "scopes": key.Scopes, "expires_at": key.ExpiresAt})
+	c.JSON(http.StatusCreated, gin.H{"token": token, "key": newKeyResponse(*key)})
+}
+
+func handleRevokeKey(c *gin.Context) {
+	p := auth.Current(c)
+	owner := p.UserID
+	if p.Can(auth.ScopeAdmin) {
+		owner = ""
+	}
+	if err := users.RevokeKey(owner, c.Param("id")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, auth.ErrKeyNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditEntry{Action: "key.revoke", Target: c.Param("id")}, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+func handleListUsers(c *gin.Context) {
+	list := []userResponse{}
+	for _, u := range users.Users() {
+		list = append(list, newUserResponse(u))
+	}
+	c.JSON(http.StatusOK, gin.H{"users": list})
+}
+
+func handleCreateUser(c *gin.Context) {
+	var req struct {
+		Email    string   `json:"email" binding:"required"`
+		Password string   `json:"password" binding:"required"`
+		Scopes   []string `json:"scopes" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := users.CreateUser(req.Email, req.Password, req.Scopes)
+	if errors.Is(err, auth.ErrUserExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logger.InfoContext(c.Request.Context(), "created user", "email", user.Email, "scopes", user.Scopes)
+	recordAudit(c, AuditEntry{Action: "user.create", Target: user.Email}, nil, gin.H{"scopes": user.Scopes})
+	c.JSON(http.StatusCreated, gin.H{"user": newUserResponse(*user)})
+}
@@ -0,0 +1,194 @@
+package deploy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	htmlCacheControl      = "no-cache"
+	defaultCacheControl   = "public, max-age=0, must-revalidate"
+)
+
+// precompressedVariants lists the encodings build_service writes next to
+// assets, in order of preference.
+var precompressedVariants = []struct {
+	encoding  string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// assetIndex holds strong ETags for every file of a deployment, computed
+// from the file contents once when the site is loaded.
+type assetIndex struct {
+	etags map[string]string
+}
+
+func buildAssetIndex(root string) *assetIndex {
+	index := &assetIndex{etags: map[string]string{}}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if sum, err := hashFile(path); err == nil {
+			index.etags[path] = `"` + sum + `"`
+		}
+		return nil
+	})
+	return index
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32], nil
+}
+
+// serveAsset serves the file at path, picking a precompressed variant the
+// client accepts and setting caching headers. Headers already set by _headers
+// rules take precedence.
+func (a *assetIndex) serveAsset(w http.ResponseWriter, r *http.Request, path string) {
+	servedPath := path
+	hasVariants := false
+	for _, variant := range precompressedVariants {
+		if _, ok := a.etags[path+variant.extension]; !ok {
+			continue
+		}
+		hasVariants = true
+		if servedPath == path && acceptsEncoding(r.Header.Get("Accept-Encoding"), variant.encoding) {
+			servedPath = path + variant.extension
+			w.Header().Set("Content-Encoding", variant.encoding)
+		}
+	}
+
+	f, err := os.Open(servedPath)
+	if err != nil {
+		w.Header().Del("Content-Encoding")
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		w.Header().Del("Content-Encoding")
+		http.NotFound(w, r)
+		return
+	}
+
+	header := w.Header()
+	if hasVariants {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if header.Get("Cache-Control") == "" {
+		header.Set("Cache-Control", cacheControlFor(path))
+	}
+	if etag, ok := a.etags[servedPath]; ok && header.Get("ETag") == "" {
+		header.Set("ETag", etag)
+	}
+
+	// The original name is passed so the content type is derived from the
+	// uncompressed file's extension.
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows encoding.
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.TrimSpace(name)
+		if !strings.EqualFold(name, encoding) && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// cacheControlFor picks a cache policy: HTML must always be revalidated,
+// fingerprinted assets never change and everything else is revalidated.
+func cacheControlFor(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".html" || ext == ".htm" {
+		return htmlCacheControl
+	}
+	if isFingerprinted(path) {
+		return immutableCacheControl
+	}
+	return defaultCacheControl
+}
+
+// isFingerprinted reports whether a file name carries a content hash, such
+// as main.3f2a1b9c.js (webpack) or index-BxK3a9Qz.js (Vite), or lives in
+// Next.js's immutable static directory. A hash is a segment after a "." or
+// "-" that is hexadecimal, or eight base64url characters, mixing digits and
+// letters the way a hash does. Names such as v2update.js or jquery1234.js
+// are not fingerprinted: marking a file immutable that is not would keep
+// browsers from ever seeing a new version of it.
+func isFingerprinted(path string) bool {
+	if strings.Contains("/"+filepath.ToSlash(path), "/_next/static/") {
+		return true
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for i, segment := range strings.Split(name, ".") {
+		if i > 0 && isHash(segment) {
+			return true
+		}
+		for j := range len(segment) {
+			if segment[j] == '-' && isHash(segment[j+1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isHash reports whether s looks like a content hash: 8 to 64 lowercase hex
+// digits with at least one digit and one letter, or 8 base64url characters
+// with a digit, an uppercase and a lowercase letter.
+func isHash(s string) bool {
+	var digits, lower, upper, other int
+	hex := true
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r >= 'a' && r <= 'z':
+			lower++
+			hex = hex && r <= 'f'
+		case r >= 'A' && r <= 'Z':
+			upper++
+		case r == '-' || r == '_':
+			other++
+		default:
+			return false
+		}
+	}
+	if hex && upper == 0 && other == 0 && len(s) >= 8 && len(s) <= 64 {
+		return digits > 0 && lower > 0
+	}
+	return len(s) == 8 && digits > 0 && lower > 0 && upper > 0
+}
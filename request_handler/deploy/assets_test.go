@@ -0,0 +1,106 @@
+package deploy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeAssetNegotiation(t *testing.T) {
+	dir := writeSite(t, map[string]string{
+		"index.html":                    "index",
+		"static/js/main.3f2a1b9c.js":    "plain",
+		"static/js/main.3f2a1b9c.js.gz": "gzipped",
+		"static/js/main.3f2a1b9c.js.br": "brotli",
+		"robots.txt":                    "robots",
+	})
+	handler := newStaticHandler(context.Background(), dir)
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantBody       string
+		wantEncoding   string
+		wantCache      string
+	}{
+		{"brotli preferred", "/static/js/main.3f2a1b9c.js", "gzip, br", "brotli", "br", immutableCacheControl},
+		{"gzip only", "/static/js/main.3f2a1b9c.js", "gzip", "gzipped", "gzip", immutableCacheControl},
+		{"brotli refused", "/static/js/main.3f2a1b9c.js", "br;q=0, gzip", "gzipped", "gzip", immutableCacheControl},
+		{"identity", "/static/js/main.3f2a1b9c.js", "", "plain", "", immutableCacheControl},
+		{"html", "/", "br", "index", "", htmlCacheControl},
+		{"unhashed asset", "/robots.txt", "", "robots", "", defaultCacheControl},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tt.wantCache {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.wantCache)
+			}
+			if rec.Header().Get("ETag") == "" {
+				t.Error("missing ETag")
+			}
+		})
+	}
+}
+
+func TestServeAssetETagRevalidation(t *testing.T) {
+	dir := writeSite(t, map[string]string{"index.html": "index", "app.css": "body{}"})
+	handler := newStaticHandler(context.Background(), dir)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/app.css", nil))
+	etag := rec.Header().Get("ETag")
+
+	req := httptest.NewRequest(http.MethodGet, "/app.css", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("status = %d, want 304", rec.Code)
+	}
+}
+
+func TestIsFingerprinted(t *testing.T) {
+	tests := map[string]bool{
+		"static/js/main.3f2a1b9c.js":          true,
+		"static/js/main.3f2a1b9c.chunk.js":    true,
+		"assets/index-BxK3a9Qz.js":            true,
+		"assets/index-B-x3a9Qz.css":           true,
+		"assets/vendor_Ab3_x9Kz.js":           false,
+		"chunk-5e8d0c2a4f1b3d6e7a9c.js":       true,
+		"_next/static/chunks/pages/index.js":  true,
+		"app.js":                              false,
+		"v2update.js":                         false,
+		"jquery1234.js":                       false,
+		"my-v2update.js":                      false,
+		"release-20240101.js":                 false,
+		"jquery-3.7.1.min.js":                 false,
+		"report-UIWidget.js":                  false,
+		"index.html":                          false,
+		"docs/deadbeef.js":                    false,
+		"fonts/inter.abcdefghijklmnopq.woff2": false,
+	}
+	for path, want := range tests {
+		if got := isFingerprinted(path); got != want {
+			t.Errorf("isFingerprinted(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
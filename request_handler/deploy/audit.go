@@ -0,0 +1,268 @@
+package deploy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/auth"
+	"zenith/shared/logging"
+)
+
+// AuditEntry records one action that changed deployments, projects, teams
+// or credentials.
+type AuditEntry struct {
+	ID        string          `json:"id"`
+	Time      time.Time       `json:"time"`
+	ActorID   string          `json:"actor_id,omitempty"`
+	Actor     string          `json:"actor"`
+	KeyID     string          `json:"key_id,omitempty"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Project   string          `json:"project,omitempty"`
+	Team      string          `json:"team,omitempty"`
+	SourceIP  string          `json:"source_ip,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+}
+
+// auditLog appends entries as JSON lines to ./data/audit.log. Entries are
+// never rewritten or removed.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+var audit *auditLog
+
+func openAuditLog(path string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &auditLog{path: path, file: f}, nil
+}
+
+func (a *auditLog) append(e AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// auditFilter selects entries. Empty fields match everything.
+type auditFilter struct {
+	Actor   string
+	Action  string
+	Target  string
+	Project string
+	Team    string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (f auditFilter) match(e AuditEntry) bool {
+	switch {
+	case f.Actor != "" && f.Actor != e.Actor && f.Actor != e.ActorID:
+		return false
+	case f.Action != "" && f.Action != e.Action && !strings.HasPrefix(e.Action, f.Action+"."):
+		return false
+	case f.Target != "" && f.Target != e.Target:
+		return false
+	case f.Project != "" && f.Project != e.Project:
+		return false
+	case f.Team != "" && f.Team != e.Team:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// query returns matching entries oldest first, reading the whole log. It
+// reads through its own handle up to the size the log had when it started,
+// which always ends with a whole entry, so appends need not wait for it.
+func (a *auditLog) query(f auditFilter, visible func(AuditEntry) bool) ([]AuditEntry, error) {
+	a.mu.Lock()
+	info, err := a.file.Stat()
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var result []AuditEntry
+	scanner := bufio.NewScanner(io.LimitReader(file, info.Size()))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if f.match(e) && visible(e) {
+			result = append(result, e)
+		}
+	}
+	return result, scanner.Err()
+}
+
+// auditSummary marshals v for the before or after field of an entry.
+func auditSummary(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// projectAudit starts an entry about project repo and the team owning it.
+func projectAudit(action, target, repo string) AuditEntry {
+	project, _ := teams.project(repo)
+	return AuditEntry{Action: action, Target: target, Project: repo, Team: project.Team}
+}
+
+// recordAudit appends an entry for the request in c. Failing to write the
+// audit log is logged rather than failing the request, which has already
+// taken effect.
+func recordAudit(c *gin.Context, e AuditEntry, before, after any) {
+	if p := auth.Current(c); p != nil {
+		e.ActorID = p.UserID
+		e.Actor = p.Email
+		e.KeyID = p.KeyID
+	}
+	e.SourceIP = c.ClientIP()
+	appendAudit(c.Request.Context(), e, before, after)
+}
+
+// appendAudit appends e for work done outside a request, such as a deploy
+// resumed after a restart. The actor fields are left as the caller set them.
+func appendAudit(ctx context.Context, e AuditEntry, before, after any) {
+	if audit == nil {
+		return
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	e.ID = hex.EncodeToString(b)
+	e.Time = time.Now().UTC()
+	e.RequestID = logging.RequestID(ctx)
+	e.Before = auditSummary(before)
+	e.After = auditSummary(after)
+
+	if err := audit.append(e); err != nil {
+		logger.WarnContext(ctx, "failed to write audit entry", "action", e.Action, "target", e.Target, "error", err)
+	}
+}
+
+// canSeeAudit reports whether the caller may read entry e. Admins see
+// everything; members see entries of their teams and projects.
+func canSeeAudit(p *auth.Principal, e AuditEntry) bool {
+	if p.Can(auth.ScopeAdmin) {
+		return true
+	}
+	if e.Project != "" {
+		return canView(p, e.Project)
+	}
+	if e.Team != "" {
+		_, ok := teams.role(e.Team, p.UserID)
+		return ok
+	}
+	return false
+}
+
+func handleListAudit(c *gin.Context) {
+	f := auditFilter{
+		Actor:   c.Query("actor"),
+		Action:  c.Query("action"),
+		Target:  c.Query("target"),
+		Project: c.Query("project"),
+		Team:    c.Query("team"),
+	}
+	for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := c.Query(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be an RFC 3339 time"})
+				return
+			}
+			*t = parsed
+		}
+	}
+	limit := 0
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+		limit = n
+	}
+
+	p := auth.Current(c)
+	entries, err := audit.query(f, func(e AuditEntry) bool { return canSeeAudit(p, e) })
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The JSON lines export keeps the log's order and is unlimited unless
+	// asked otherwise; the JSON listing shows the newest 100 first.
+	if c.Query("format") == "jsonl" || strings.Contains(c.GetHeader("Accept"), "application/x-ndjson") {
+		if limit > 0 && len(entries) > limit {
+			entries = entries[len(entries)-limit:]
+		}
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		c.Status(http.StatusOK)
+		enc := json.NewEncoder(c.Writer)
+		for _, e := range entries {
+			enc.Encode(e)
+		}
+		return
+	}
+
+	if limit == 0 {
+		limit = 100
+	}
+	slices.Reverse(entries)
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
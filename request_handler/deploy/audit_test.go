@@ -0,0 +1,198 @@
+package deploy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/auth"
+	"zenith/shared/config"
+	"zenith/shared/logging"
+)
+
+func TestAuditFilter(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	e := AuditEntry{Time: at, Actor: "dev@example.com", ActorID: "u2", Action: "domain.add", Target: "www.example.com", Project: "site", Team: "web"}
+
+	tests := []struct {
+		name string
+		f    auditFilter
+		want bool
+	}{
+		{"empty", auditFilter{}, true},
+		{"actor email", auditFilter{Actor: "dev@example.com"}, true},
+		{"actor id", auditFilter{Actor: "u2"}, true},
+		{"action prefix", auditFilter{Action: "domain"}, true},
+		{"partial action word", auditFilter{Action: "dom"}, false},
+		{"other project", auditFilter{Project: "blog"}, false},
+		{"since is inclusive", auditFilter{Since: at}, true},
+		{"until is exclusive", auditFilter{Until: at}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.f.match(e); got != tt.want {
+			t.Errorf("%s: match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuditLogQueries(t *testing.T) {
+	keys := setupRBAC(t)
+	var err error
+	audit, err = openAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.file.Close(); audit = nil })
+
+	r := gin.New()
+	r.Use(logging.Middleware(logger))
+	canRead := auth.Require(users, auth.ScopeRead)
+	canDeploy := auth.Require(users, auth.ScopeDeploy)
+	r.GET("/audit", canRead, handleListAudit)
+	r.DELETE("/domains/:domain", canDeploy, handleRemoveDomain)
+	r.POST("/teams", canDeploy, handleCreateTeam)
+
+	do := func(who, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+keys[who])
+		req.Header.Set("X-Request-ID", "req-"+who)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("maintainer", "DELETE", "/domains/www.example.com", ""); rec.Code != http.StatusOK {
+		t.Fatalf("remove domain: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("outsider", "POST", "/teams", `{"slug":"solo"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("create team: %d %s", rec.Code, rec.Body)
+	}
+
+	list := func(who, query string) []AuditEntry {
+		rec := do(who, "GET", "/audit"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /audit%s: %d %s", query, rec.Code, rec.Body)
+		}
+		var body struct {
+			Entries []AuditEntry `json:"entries"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return body.Entries
+	}
+
+	entries := list("viewer", "")
+	if len(entries) != 1 {
+		t.Fatalf("viewer sees %d entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.Action != "domain.remove" || e.Actor != "maintainer@example.com" || e.Project != "site" || e.Team != "web" || e.RequestID != "req-maintainer" {
+		t.Errorf("entry = %+v", e)
+	}
+	if string(e.Before) != `{"method":"dns","verified":false}` || e.After != nil {
+		t.Errorf("before = %s, after = %s", e.Before, e.After)
+	}
+
+	if n := len(list("outsider", "")); n != 1 {
+		t.Errorf("outsider sees %d entries, want only their team's", n)
+	}
+	if n := len(list("viewer", "?action=team")); n != 0 {
+		t.Errorf("action filter returned %d entries", n)
+	}
+
+	rec := do("outsider", "GET", "/audit?format=jsonl", "")
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var lines int
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		lines++
+	}
+	if lines != 1 {
+		t.Errorf("export has %d lines, want 1", lines)
+	}
+
+	if rec := do("viewer", "GET", "/audit?since=yesterday", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad since: status = %d", rec.Code)
+	}
+}
+
+func TestAuditQueryDoesNotBlockAppends(t *testing.T) {
+	log, err := openAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.file.Close()
+	for _, action := range []string{"a", "b"} {
+		if err := log.append(AuditEntry{Action: action}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Entries appended while a query runs are left to the next one.
+	entries, err := log.query(auditFilter{}, func(e AuditEntry) bool {
+		if err := log.append(AuditEntry{Action: "during-" + e.Action}); err != nil {
+			t.Fatal(err)
+		}
+		return true
+	})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("query = %+v, %v", entries, err)
+	}
+	entries, err = log.query(auditFilter{}, func(AuditEntry) bool { return true })
+	if err != nil || len(entries) != 4 || entries[3].Action != "during-b" {
+		t.Errorf("second query = %+v, %v", entries, err)
+	}
+}
+
+func TestAuditSourceIPTrustsOnlyConfiguredProxies(t *testing.T) {
+	keys := setupRBAC(t)
+	var err error
+	audit, err = openAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.file.Close(); audit = nil })
+
+	cfg = config.Default()
+	for _, tt := range []struct {
+		proxies []string
+		want    string
+	}{
+		{nil, "192.0.2.1"},
+		{[]string{"192.0.2.0/24"}, "203.0.113.7"},
+	} {
+		cfg.RequestHandler.TrustedProxies = tt.proxies
+		r, err := newEngine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.POST("/teams", auth.Require(users, auth.ScopeDeploy), handleCreateTeam)
+
+		// httptest requests come from 192.0.2.1.
+		slug := fmt.Sprintf("team-%d", len(tt.proxies))
+		req := httptest.NewRequest("POST", "/teams", strings.NewReader(`{"slug":"`+slug+`"}`))
+		req.Header.Set("Authorization", "Bearer "+keys["outsider"])
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create team: %d %s", rec.Code, rec.Body)
+		}
+		entries, err := audit.query(auditFilter{Target: slug}, func(AuditEntry) bool { return true })
+		if err != nil || len(entries) != 1 || entries[0].SourceIP != tt.want {
+			t.Errorf("proxies %v: entries = %+v, %v; want source IP %s", tt.proxies, entries, err, tt.want)
+		}
+	}
+}
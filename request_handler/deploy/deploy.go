@@ -0,0 +1,517 @@
+// Package deploy serves the deploy API: it has repositories uploaded and
+// built, serves the result as a static site and exposes it through a tunnel
+// and custom domains.
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"zenith/shared/apierr"
+	"zenith/shared/auth"
+	"zenith/shared/config"
+	"zenith/shared/github"
+	"zenith/shared/lifecycle"
+	"zenith/shared/logging"
+	"zenith/shared/redact"
+	"zenith/shared/retry"
+	"zenith/shared/storage"
+	"zenith/shared/tracing"
+)
+
+// stagingDir is the directory below the deployed directory that sites are
+// extracted and built in before they replace the deployed ones.
+const stagingDir = ".zenith-staging"
+
+var (
+	cfg   *config.Config
+	store storage.Store
+	// scratch tracks the staging directories of deploys in progress.
+	scratch  *lifecycle.Scratch
+	uploader Uploader
+	builder  Builder
+	logger   = slog.Default()
+)
+
+// Setup prepares the deploy API. Source repositories are uploaded and built
+// through up and b, and build archives are read from s.
+func Setup(c *config.Config, s storage.Store, up Uploader, b Builder) error {
+	cfg = c
+	logger = logging.New("request_handler", c.RequestHandler.LogLevel)
+	store = s
+	uploader = up
+	builder = b
+	redact.Install(c.Secrets()...)
+	if err := retry.Setup(c.Retry); err != nil {
+		return err
+	}
+
+	// Create required directories
+	os.MkdirAll(cfg.RequestHandler.DeployedDir, os.ModePerm)
+	os.MkdirAll(cfg.RequestHandler.DataDir, 0700)
+
+	var err error
+	if scratch, err = lifecycle.OpenScratch(filepath.Join(cfg.RequestHandler.DeployedDir, stagingDir)); err != nil {
+		return fmt.Errorf("error creating staging directory: %w", err)
+	}
+	domains, err = loadDomainStore(filepath.Join(cfg.RequestHandler.DataDir, "domains.json"))
+	if err != nil {
+		return err
+	}
+
+	teams, err = loadTeamStore(filepath.Join(cfg.RequestHandler.DataDir, "teams.json"))
+	if err != nil {
+		return err
+	}
+
+	audit, err = openAuditLog(filepath.Join(cfg.RequestHandler.DataDir, "audit.log"))
+	if err != nil {
+		return err
+	}
+
+	runs, err = loadRunStore(filepath.Join(cfg.RequestHandler.DataDir, "runs.json"))
+	if err != nil {
+		return err
+	}
+
+	githubLinks, err = loadGitHubStore(filepath.Join(cfg.RequestHandler.DataDir, "github.json"))
+	if err != nil {
+		return err
+	}
+	if cfg.GitHub.AppID != "" {
+		if githubApp, err = github.NewApp(cfg.GitHub); err != nil {
+			return err
+		}
+	}
+
+	tunnelProvider, err = newTunnelProvider(cfg.RequestHandler.Tunnel)
+	if err != nil {
+		return err
+	}
+	if err := setupHealth(up, b); err != nil {
+		return err
+	}
+
+	return openUsers()
+}
+
+// Run serves the deploy API as a standalone service that reaches
+// upload_service and build_service over HTTP, until SIGINT or SIGTERM.
+func Run(c *config.Config) error {
+	s, err := storage.New(c.Storage)
+	if err != nil {
+		return err
+	}
+	up := NewHTTPUploader(c.Services.UploadURL, c.Auth.InternalSecret)
+	b := NewHTTPBuilder(c.Services.BuildURL, c.Auth.InternalSecret)
+	if err := Setup(c, s, up, b); err != nil {
+		return err
+	}
+	shutdown, err := tracing.Setup(context.Background(), c.Tracing, "request_handler")
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.Background())
+	slog.SetDefault(logger)
+	ctx, stop := lifecycle.SignalContext()
+	defer stop()
+	return Serve(ctx)
+}
+
+// newEngine returns the engine the deploy API is served by, with its
+// middleware. Client IPs, which are logged and recorded in the audit log,
+// only come from X-Forwarded-For when the request arrives through one of the
+// configured trusted proxies.
+func newEngine() (*gin.Engine, error) {
+	r := gin.New()
+	if err := r.SetTrustedProxies(cfg.RequestHandler.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("request_handler.trusted_proxies: %w", err)
+	}
+	r.Use(gin.Recovery(), logging.Middleware(logger), tracing.Middleware())
+
+	// Browsers may only call the API from the configured frontend origins.
+	if origins := cfg.RequestHandler.CORSOrigins; len(origins) > 0 {
+		r.Use(cors.New(cors.Config{
+			AllowOrigins:     origins,
+			AllowMethods:     []string{"GET", "POST", "PUT", "DELETE"},
+			AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", logging.HeaderRequestID},
+			ExposeHeaders:    []string{"Content-Length", logging.HeaderRequestID, logging.HeaderDeploymentID},
+			AllowCredentials: true,
+			MaxAge:           12 * time.Hour,
+		}))
+	}
+	return r, nil
+}
+
+// Serve serves the deploy API on cfg.RequestHandler.Addr, with the metrics
+// and edge servers when enabled, until ctx is done. Setup must be called
+// first.
+//
+// Deploys interrupted by the previous shutdown are resumed first. Once ctx
+// is done no new deploys are accepted; running ones get the shutdown
+// timeout to finish and are then cancelled, leaving them to be resumed on
+// the next start. Deployments are torn down last.
+func Serve(ctx context.Context) error {
+	timeout, err := lifecycle.Timeout(cfg.Shutdown)
+	if err != nil {
+		return err
+	}
+
+	r, err := newEngine()
+	if err != nil {
+		return err
+	}
+
+	signedIn := auth.Require(users, "")
+	canRead := auth.Require(users, auth.ScopeRead)
+	canDeploy := auth.Require(users, auth.ScopeDeploy)
+	isAdmin := auth.Require(users, auth.ScopeAdmin)
+
+	checker.Routes(r)
+
+	r.POST("/auth/login", handleLogin)
+	r.GET("/auth/me", signedIn, handleMe)
+
+	r.GET("/keys", signedIn, handleListKeys)
+	r.POST("/keys", signedIn, handleCreateKey)
+	r.DELETE("/keys/:id", signedIn, handleRevokeKey)
+
+	r.GET("/users", isAdmin, handleListUsers)
+	r.POST("/users", isAdmin, handleCreateUser)
+
+	r.GET("/audit", canRead, handleListAudit)
+
+	r.GET("/github/connect", signedIn, handleGitHubConnect)
+	r.GET("/github/callback", handleGitHubCallback)
+	r.GET("/github/installations", signedIn, handleListGitHubInstallations)
+	r.DELETE("/github/installations/:id", signedIn, handleDisconnectGitHubInstallation)
+
+	r.GET("/teams", signedIn, handleListTeams)
+	r.POST("/teams", signedIn, handleCreateTeam)
+	r.GET("/teams/:team", canRead, handleGetTeam)
+	r.DELETE("/teams/:team", canDeploy, handleDeleteTeam)
+	r.GET("/teams/:team/history", canRead, handleTeamHistory)
+	r.POST("/teams/:team/members", canDeploy, handleAddMember)
+	r.PUT("/teams/:team/members/:user", canDeploy, handleSetMemberRole)
+	r.DELETE("/teams/:team/members/:user", canDeploy, handleRemoveMember)
+
+	r.GET("/projects", canRead, handleListProjects)
+	r.POST("/projects", canDeploy, handleCreateProject)
+	r.PUT("/projects/:name/secret-policy", canDeploy, handleSetSecretPolicy)
+	r.GET("/projects/:name/usage", canRead, handleProjectUsage)
+	r.POST("/projects/:name/rollback", canDeploy, handleRollback)
+
+	r.GET("/deploy", canDeploy, HandleDeployRequest)
+	r.POST("/deploy", canDeploy, HandleDeployRequest)
+
+	r.GET("/deployments", canRead, handleListDeployments)
+	r.DELETE("/deployments/:id", canDeploy, handleDeleteDeployment)
+	r.GET("/deployments/:id", canRead, handleGetDeployment)
+	r.POST("/deployments/:id/retry", canDeploy, handleRetryDeployment)
+
+	r.GET("/domains", canRead, handleListDomains)
+	r.POST("/domains", canDeploy, handleAddDomain)
+	r.POST("/domains/:domain/verify", canDeploy, handleVerifyDomain)
+	r.DELETE("/domains/:domain", canDeploy, handleRemoveDomain)
+
+	servers := []*http.Server{{Addr: cfg.RequestHandler.Addr, Handler: r}}
+	if addr := cfg.RequestHandler.MetricsAddr; addr != "" {
+		servers = append(servers, metricsServer(addr))
+	}
+	if cfg.RequestHandler.Edge.Enabled {
+		edge, err := edgeServers(cfg.RequestHandler.Edge)
+		if err != nil {
+			return fmt.Errorf("failed to start edge server: %w", err)
+		}
+		servers = append(servers, edge...)
+	}
+
+	// Resumed runs are cancelled with the requests still running when the
+	// shutdown timeout is over. A server failing shuts the others down too.
+	ctx, stopServing := context.WithCancel(ctx)
+	defer stopServing()
+	serveCtx = ctx
+	background, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stopBackground := context.AfterFunc(ctx, func() { time.AfterFunc(timeout, cancel) })
+	defer stopBackground()
+	publishHosts(ctx)
+	recoverRuns(background)
+
+	logger.Info("serving deploy API", "addr", cfg.RequestHandler.Addr)
+	err = lifecycle.Serve(ctx, timeout, servers...)
+	stopServing()
+	if !lifecycle.Wait(&resuming, timeout+lifecycle.Grace) {
+		logger.Warn("resumed deploys still running at exit")
+	}
+	deployments.closeAll()
+	if c, ok := tunnelProvider.(io.Closer); ok {
+		c.Close()
+	}
+	logger.Info("server stopped")
+	return err
+}
+
+// HandleDeployRequest processes deployment requests. The deploy is
+// recorded as a run, so that one interrupted by a restart can be resumed.
+func HandleDeployRequest(c *gin.Context) {
+	var urlFromQuery, team string
+
+	// Handle both GET and POST requests
+	if c.Request.Method == "GET" {
+		urlFromQuery = c.Query("url")
+		team = c.Query("team")
+	} else {
+		var requestBody struct {
+			URL  string `json:"url"`
+			Team string `json:"team"`
+		}
+		if err := c.BindJSON(&requestBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body"})
+			return
+		}
+		urlFromQuery = requestBody.URL
+		team = requestBody.Team
+	}
+
+	deploysInProgress.Inc()
+	defer deploysInProgress.Dec()
+	// stage names the step running, which is the one that failed if the
+	// handler responds with an error.
+	stage := "validate"
+	defer func() { recordDeployOutcome(c.Writer.Status(), stage) }()
+
+	// Every log line of the deploy, here and in the services it calls,
+	// carries the ID the deployment will be published under.
+	deploymentID := newDeploymentID()
+	ctx := logging.WithDeploymentID(c.Request.Context(), deploymentID)
+	c.Request = c.Request.WithContext(ctx)
+	c.Header(logging.HeaderDeploymentID, deploymentID)
+
+	if urlFromQuery == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing 'url' parameter"})
+		return
+	}
+
+	// Check the caller may deploy this project before running any of its code
+	repo := repoNameFromURL(urlFromQuery)
+	if repo == "" || repo == "." || strings.Contains(repo, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not determine the repository name from the URL"})
+		return
+	}
+	if !claimProject(c, repo, team) {
+		return
+	}
+
+	token, ok := githubToken(c, urlFromQuery)
+	if !ok {
+		return
+	}
+
+	run := DeployRun{ID: deploymentID, Repo: repo, Source: urlFromQuery}
+	if p := auth.Current(c); p != nil {
+		run.ActorID, run.Actor, run.KeyID = p.UserID, p.Email, p.KeyID
+	}
+	if err := runs.start(run); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to record deploy: %v", err)})
+		return
+	}
+
+	p, err := runPipeline(ctx, run, token)
+	stage = p.run.Stage
+	respondDeploy(c, p, err)
+}
+
+// respondDeploy audits the outcome of p and responds with it. Failures are
+// answered as apierr errors carrying the deployment ID, for GET and POST
+// /deployments/:id/retry; blocked deploys also list the secrets found.
+func respondDeploy(c *gin.Context, p *pipeline, err error) {
+	if e, before, after, ok := p.audit(err); ok {
+		recordAudit(c, e, before, after)
+	}
+	if err != nil {
+		e := apierr.From(err)
+		if shuttingDown(c.Request.Context()) {
+			e = apierr.New(apierr.CodeInterrupted, e.Stage, "Deploy interrupted by shutdown; it resumes when the API is back")
+		}
+		body := e.Body()
+		body["deployment_id"] = p.run.ID
+		if errors.Is(err, errDeployBlocked) {
+			body["secrets"] = p.run.Upload.Secrets
+		}
+		c.JSON(e.Status, body)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "App deployed successfully",
+		"repo":          p.run.Repo,
+		"deployment_id": p.deployment.ID,
+		"public_url":    p.deployment.PublicURL,
+		"domains":       domains.list(p.run.Repo),
+		"packaging":     p.run.Upload.Packaging,
+		"secrets":       p.run.Upload.Secrets,
+		"stripped":      p.stripped,
+		"buildResult":   p.run.Build,
+	})
+}
+
+// repoNameFromURL returns the repository name of a clone URL, the same way
+// the upload service names its archive.
+func repoNameFromURL(url string) string {
+	return strings.TrimSuffix(path.Base(strings.TrimSuffix(url, "/")), ".git")
+}
+
+// runCommand runs cmd in a span and logs its output line by line.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	out := logging.Writer(ctx, logger, "command output", "command", filepath.Base(cmd.Path))
+	defer out.Close()
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return tracing.Run(ctx, cmd)
+}
+
+// newStaticHandler builds the handler for a deployed site. The site's
+// redirect and header rules are compiled once here rather than per request.
+func newStaticHandler(ctx context.Context, folder string) http.Handler {
+	// Create a new HTTP mux
+	mux := http.NewServeMux()
+
+	// Create the directory if it doesn't exist
+	os.MkdirAll(folder, 0755)
+
+	// Look for index.html in the folder or any subdirectories, preferring
+	// the top-level one
+	var indexPath string
+	if _, err := os.Stat(filepath.Join(folder, "index.html")); err == nil {
+		indexPath = filepath.Join(folder, "index.html")
+	} else {
+		err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && filepath.Base(path) == "index.html" {
+				indexPath = path
+				return filepath.SkipAll // Stop walking once we find index.html
+			}
+			return nil
+		})
+
+		if err != nil {
+			logger.WarnContext(ctx, "error walking site directory", "dir", folder, "error", err)
+		}
+	}
+
+	buildDir := folder
+	if indexPath != "" {
+		// If we found index.html, use its directory as the build directory
+		buildDir = filepath.Dir(indexPath)
+		logger.DebugContext(ctx, "found index.html", "path", indexPath, "dir", buildDir)
+	} else {
+		logger.DebugContext(ctx, "no index.html found, serving entire folder", "dir", folder)
+	}
+
+	rules, err := loadSiteRules(buildDir)
+	if err != nil {
+		logger.WarnContext(ctx, "ignoring invalid site rules", "dir", buildDir, "error", err)
+	}
+	logger.DebugContext(ctx, "loaded site rules", "redirects", len(rules.redirects), "headers", len(rules.headers))
+
+	assets := buildAssetIndex(buildDir)
+
+	// Create a file server handler
+	fs := http.FileServer(http.Dir(buildDir))
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		rules.applyHeaders(w.Header(), r.URL.Path)
+
+		// Check if the requested path exists
+		path := filepath.Join(buildDir, r.URL.Path)
+		info, err := os.Stat(path)
+		exists := err == nil && !info.IsDir()
+		if r.URL.Path == "/" && indexPath != "" {
+			exists = true
+		}
+
+		if m := rules.match(r.URL.Path, r.URL.Query(), exists); m != nil {
+			if m.status != http.StatusOK && m.status != http.StatusNotFound {
+				http.Redirect(w, r, m.target, m.status)
+				return
+			}
+			// Rewrites never leave the site, whatever the placeholders hold.
+			target := filepath.Join(buildDir, filepath.FromSlash(cleanSitePath(m.target)))
+			if !strings.HasPrefix(target, filepath.Clean(buildDir)+string(filepath.Separator)) {
+				http.NotFound(w, r)
+				return
+			}
+			if m.status == http.StatusOK {
+				assets.serveAsset(w, r, target)
+				return
+			}
+			serveFileWithStatus(w, r, target, m.status)
+			return
+		}
+
+		if indexPath == "" {
+			if exists {
+				assets.serveAsset(w, r, path)
+				return
+			}
+			fs.ServeHTTP(w, r)
+			return
+		}
+
+		// If the path doesn't exist or is a directory, serve index.html
+		if os.IsNotExist(err) || r.URL.Path == "/" || strings.HasSuffix(r.URL.Path, "/") {
+			logger.Debug("serving index.html", "path", r.URL.Path)
+			assets.serveAsset(w, r, indexPath)
+			return
+		}
+
+		// Otherwise, serve the requested file
+		logger.Debug("serving file", "path", r.URL.Path)
+		if exists {
+			assets.serveAsset(w, r, path)
+			return
+		}
+		fs.ServeHTTP(w, r)
+	})
+
+	return mux
+}
+
+// serveFileWithStatus writes the file at path as the response body using a
+// non-200 status code, e.g. for custom 404 pages.
+func serveFileWithStatus(w http.ResponseWriter, r *http.Request, path string, status int) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if ctype := mime.TypeByExtension(filepath.Ext(path)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.WriteHeader(status)
+	io.Copy(w, f)
+}
@@ -0,0 +1,346 @@
+package deploy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/auth"
+	"zenith/shared/logging"
+	"zenith/shared/manifest"
+)
+
+var ErrDeploymentNotFound = errors.New("deployment not found")
+
+// Deployment is a running deployment: a static server on its own local port
+// and the tunnel exposing it.
+type Deployment struct {
+	ID        string    `json:"id"`
+	Repo      string    `json:"repo"`
+	LocalAddr string    `json:"local_addr"`
+	PublicURL string    `json:"public_url"`
+	Tunnel    string    `json:"tunnel"`
+	CreatedAt time.Time `json:"created_at"`
+	// Secrets are the possible credentials found in the deployed source.
+	Secrets []SecretFinding `json:"secrets,omitempty"`
+
+	server *http.Server
+	tunnel Tunnel
+}
+
+// deploymentRegistry tracks running deployments. Only the latest deployment
+// of a repository is kept; older ones are torn down when it replaces them.
+type deploymentRegistry struct {
+	mu     sync.Mutex
+	byID   map[string]*Deployment
+	byRepo map[string]string
+}
+
+var (
+	deployments    = &deploymentRegistry{byID: map[string]*Deployment{}, byRepo: map[string]string{}}
+	tunnelProvider TunnelProvider
+)
+
+func newDeploymentID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startDeployment serves site on a free loopback port, reachable only
+// through its tunnel, and opens the tunnel to it.
+// On success it replaces and tears down the repository's previous deployment.
+// secrets are recorded on the deployment.
+func startDeployment(ctx context.Context, id, repo string, site http.Handler, secrets []SecretFinding) (*Deployment, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for static site: %w", err)
+	}
+
+	d := &Deployment{
+		ID:        id,
+		Repo:      repo,
+		LocalAddr: listener.Addr().String(),
+		Tunnel:    tunnelProvider.Name(),
+		CreatedAt: time.Now(),
+		Secrets:   secrets,
+		server:    &http.Server{Handler: site, ReadHeaderTimeout: 10 * time.Second},
+	}
+
+	go func() {
+		logger.InfoContext(ctx, "serving deployment", "repo", repo, "addr", d.LocalAddr)
+		if err := d.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("static server error", "deployment_id", d.ID, "error", err)
+		}
+	}()
+
+	tunnel, err := tunnelProvider.Open(ctx, "zenith-"+d.ID, d.LocalAddr)
+	if err != nil {
+		d.server.Close()
+		return nil, fmt.Errorf("%s tunnel failed: %w", tunnelProvider.Name(), err)
+	}
+	d.tunnel = tunnel
+	d.PublicURL = tunnel.PublicURL()
+
+	deployments.mu.Lock()
+	previous := deployments.byID[deployments.byRepo[repo]]
+	deployments.byID[d.ID] = d
+	deployments.byRepo[repo] = d.ID
+	if previous != nil {
+		delete(deployments.byID, previous.ID)
+	}
+	deployments.mu.Unlock()
+
+	if previous != nil {
+		previous.teardown()
+	}
+	return d, nil
+}
+
+// teardown closes the deployment's tunnel and stops its server.
+func (d *Deployment) teardown() {
+	if d.tunnel != nil {
+		if err := d.tunnel.Close(); err != nil {
+			logger.Warn("failed to close tunnel", "deployment_id", d.ID, "error", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.server.Shutdown(ctx); err != nil {
+		logger.Warn("failed to stop server", "deployment_id", d.ID, "error", err)
+	}
+	logger.Info("tore down deployment", "deployment_id", d.ID, "repo", d.Repo)
+}
+
+func (r *deploymentRegistry) list() []Deployment {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]Deployment, 0, len(r.byID))
+	for _, d := range r.byID {
+		result = append(result, *d)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.After(result[j].CreatedAt) })
+	return result
+}
+
+func (r *deploymentRegistry) remove(id string) error {
+	r.mu.Lock()
+	d, ok := r.byID[id]
+	if ok {
+		delete(r.byID, id)
+		if r.byRepo[d.Repo] == id {
+			delete(r.byRepo, d.Repo)
+		}
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return ErrDeploymentNotFound
+	}
+	d.teardown()
+	return nil
+}
+
+// closeAll tears down every deployment as the API exits. The sites stay in
+// the deployed directory, from which the edge serves them after a restart.
+func (r *deploymentRegistry) closeAll() {
+	r.mu.Lock()
+	all := r.byID
+	r.byID = map[string]*Deployment{}
+	r.byRepo = map[string]string{}
+	r.mu.Unlock()
+
+	for _, d := range all {
+		d.teardown()
+	}
+}
+
+func (r *deploymentRegistry) get(id string) (Deployment, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.byID[id]
+	if !ok {
+		return Deployment{}, false
+	}
+	return *d, true
+}
+
+// forRepo returns the current deployment of repo.
+func (r *deploymentRegistry) forRepo(repo string) (Deployment, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.byID[r.byRepo[repo]]
+	if !ok {
+		return Deployment{}, false
+	}
+	return *d, true
+}
+
+func handleListDeployments(c *gin.Context) {
+	p := auth.Current(c)
+	visible := []Deployment{}
+	for _, d := range deployments.list() {
+		if canView(p, d.Repo) {
+			visible = append(visible, d)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"deployments": visible})
+}
+
+func handleDeleteDeployment(c *gin.Context) {
+	d, ok := deployments.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrDeploymentNotFound.Error()})
+		return
+	}
+	if !requireProjectRole(c, d.Repo, RoleDeployer) {
+		return
+	}
+	if err := deployments.remove(d.ID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err := manifest.Unpublish(c.Request.Context(), store, d.Repo); err != nil {
+		logger.WarnContext(c.Request.Context(), "failed to unpublish release", "repo", d.Repo, "error", err)
+	}
+	recordAudit(c, projectAudit("deployment.delete", d.ID, d.Repo), gin.H{"public_url": d.PublicURL}, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Deployment torn down"})
+}
+
+// handleGetDeployment returns the record of deploy run id: how far it got
+// and, when it failed, why.
+func handleGetDeployment(c *gin.Context) {
+	run, ok := runs.get(c.Param("id"))
+	if !ok || !canView(auth.Current(c), run.Repo) {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrDeploymentNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, run)
+}
+
+// handleRetryDeployment runs a failed deploy again from the stage that
+// failed, reusing the source and build archives of the stages that
+// completed. The caller's GitHub token is only needed when the upload
+// failed.
+func handleRetryDeployment(c *gin.Context) {
+	run, ok := runs.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrDeploymentNotFound.Error()})
+		return
+	}
+	if !requireProjectRole(c, run.Repo, RoleDeployer) {
+		return
+	}
+	if run.Status != RunFailed {
+		c.JSON(http.StatusConflict, gin.H{"error": ErrRunNotFailed.Error(), "status": run.Status})
+		return
+	}
+	var token string
+	if !run.done("upload") {
+		if token, ok = githubToken(c, run.Source); !ok {
+			return
+		}
+	}
+
+	deploysInProgress.Inc()
+	defer deploysInProgress.Dec()
+	stage := run.Stage
+	defer func() { recordDeployOutcome(c.Writer.Status(), stage) }()
+
+	ctx := logging.WithDeploymentID(c.Request.Context(), run.ID)
+	c.Request = c.Request.WithContext(ctx)
+	c.Header(logging.HeaderDeploymentID, run.ID)
+
+	run, err := runs.retry(run.ID, auth.Current(c))
+	if errors.Is(err, ErrRunNotFailed) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to record deploy: %v", err)})
+		return
+	}
+	logger.InfoContext(ctx, "retrying deploy", "repo", run.Repo, "stage", stage, "completed", run.Completed)
+
+	p, err := runPipeline(ctx, run, token)
+	stage = p.run.Stage
+	respondDeploy(c, p, err)
+}
+
+// handleRollback serves the build of an earlier deployment of a project
+// again. Builds are stored as manifests of content-addressed files, so
+// nothing is rebuilt or uploaded: the rollback is a new deployment from
+// the old manifest, run through the download, extract and publish stages.
+func handleRollback(c *gin.Context) {
+	name := c.Param("name")
+	var body struct {
+		DeploymentID string `json:"deployment_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !requireProjectRole(c, name, RoleDeployer) {
+		return
+	}
+	target := body.DeploymentID
+	if strings.ContainsAny(target, `/\`) || strings.Contains(target, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid deployment_id"})
+		return
+	}
+	key := manifest.Key(name, target)
+	exists, err := store.Exists(c.Request.Context(), key)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Failed to look up the build: %v", err)})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no stored build for deployment " + target + " of " + name})
+		return
+	}
+
+	deploysInProgress.Inc()
+	defer deploysInProgress.Dec()
+	stage := "download"
+	defer func() { recordDeployOutcome(c.Writer.Status(), stage) }()
+
+	deploymentID := newDeploymentID()
+	ctx := logging.WithDeploymentID(c.Request.Context(), deploymentID)
+	c.Request = c.Request.WithContext(ctx)
+	c.Header(logging.HeaderDeploymentID, deploymentID)
+
+	// The rollback keeps the source and secret findings of the deployment
+	// it goes back to, when its run is still recorded.
+	run := DeployRun{
+		ID:         deploymentID,
+		Repo:       name,
+		RollbackOf: target,
+		Completed:  []string{"upload", "secrets", "build"},
+		Upload:     &DeployResponse{Repo: name},
+		Build:      &BuildResult{Status: "success", Message: "Rolled back to deployment " + target, Manifest: key},
+	}
+	if old, ok := runs.get(target); ok && old.Repo == name && old.Upload != nil {
+		run.Source, run.Upload = old.Source, old.Upload
+	}
+	if p := auth.Current(c); p != nil {
+		run.ActorID, run.Actor, run.KeyID = p.UserID, p.Email, p.KeyID
+	}
+	if err := runs.start(run); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to record deploy: %v", err)})
+		return
+	}
+	logger.InfoContext(ctx, "rolling back", "repo", name, "to", target)
+
+	p, err := runPipeline(ctx, run, "")
+	stage = p.run.Stage
+	respondDeploy(c, p, err)
+}
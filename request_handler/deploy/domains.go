@@ -0,0 +1,389 @@
+package deploy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/idna"
+	"zenith/shared/auth"
+	"zenith/shared/manifest"
+)
+
+const (
+	verifyDNS  = "dns"
+	verifyHTTP = "http"
+
+	dnsChallengePrefix  = "_zenith-challenge."
+	dnsChallengeValue   = "zenith-verification="
+	httpChallengePrefix = "/.well-known/zenith-challenge/"
+)
+
+var (
+	ErrDomainNotFound = errors.New("domain not found")
+	ErrDomainExists   = errors.New("domain is already registered")
+)
+
+// Domain is a custom domain attached to a project.
+type Domain struct {
+	Name       string     `json:"name"`
+	Repo       string     `json:"repo"`
+	Method     string     `json:"method"`
+	Token      string     `json:"token"`
+	Verified   bool       `json:"verified"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// domainStore keeps custom domains in ./data/domains.json.
+type domainStore struct {
+	mu      sync.RWMutex
+	path    string
+	domains map[string]*Domain
+}
+
+var domains *domainStore
+
+// lookupTXT and challengeClient are what checkDomainOwnership looks for the
+// token with. The domain is only checked where it points: redirects, which
+// could send request_handler to internal addresses, are not followed.
+var (
+	lookupTXT       = net.DefaultResolver.LookupTXT
+	challengeClient = &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+)
+
+func loadDomainStore(path string) (*domainStore, error) {
+	s := &domainStore{path: path, domains: map[string]*Domain{}}
+	var list []*Domain
+	if err := loadJSON(path, &list); err != nil {
+		return nil, fmt.Errorf("failed to load domains: %w", err)
+	}
+	for _, d := range list {
+		s.domains[d.Name] = d
+	}
+	return s, nil
+}
+
+func (s *domainStore) saveLocked() error {
+	list := make([]*Domain, 0, len(s.domains))
+	for _, d := range s.domains {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return saveJSON(s.path, list)
+}
+
+func (s *domainStore) add(d *Domain) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.domains[d.Name]; ok {
+		return ErrDomainExists
+	}
+	s.domains[d.Name] = d
+	return s.saveLocked()
+}
+
+func (s *domainStore) get(name string) (Domain, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.domains[name]
+	if !ok {
+		return Domain{}, false
+	}
+	return *d, true
+}
+
+func (s *domainStore) list(repo string) []Domain {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := []Domain{}
+	for _, d := range s.domains {
+		if repo == "" || d.Repo == repo {
+			result = append(result, *d)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (s *domainStore) markVerified(name string) (Domain, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.domains[name]
+	if !ok {
+		return Domain{}, ErrDomainNotFound
+	}
+	now := time.Now()
+	d.Verified = true
+	d.VerifiedAt = &now
+	return *d, s.saveLocked()
+}
+
+func (s *domainStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.domains[name]; !ok {
+		return ErrDomainNotFound
+	}
+	delete(s.domains, name)
+	return s.saveLocked()
+}
+
+// verifiedRepo returns the project a verified domain points at.
+func (s *domainStore) verifiedRepo(host string) (string, bool) {
+	d, ok := s.get(host)
+	if !ok || !d.Verified {
+		return "", false
+	}
+	return d.Repo, true
+}
+
+// hosts returns the verified domains and the projects they point at.
+func (s *domainStore) hosts() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hosts := map[string]string{}
+	for _, d := range s.domains {
+		if d.Verified {
+			hosts[d.Name] = d.Repo
+		}
+	}
+	return hosts
+}
+
+// publishHosts stores the verified domains for edge servers. Failing to is
+// logged: the domain change is saved here, and the next one or a restart
+// stores the table again.
+func publishHosts(ctx context.Context) {
+	if err := manifest.SaveHosts(ctx, store, domains.hosts()); err != nil {
+		logger.WarnContext(ctx, "failed to publish custom domains", "error", err)
+	}
+}
+
+// normalizeDomain lowercases and validates a hostname. IP addresses,
+// wildcards and single-label names are rejected.
+func normalizeDomain(name string) (string, error) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if name == "" {
+		return "", fmt.Errorf("domain is required")
+	}
+	if net.ParseIP(name) != nil {
+		return "", fmt.Errorf("IP addresses cannot be used as custom domains")
+	}
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain %q: %v", name, err)
+	}
+	if !strings.Contains(ascii, ".") {
+		return "", fmt.Errorf("invalid domain %q", name)
+	}
+	return ascii, nil
+}
+
+func newVerificationToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// verificationInstructions tells the user how to prove ownership of d.
+func verificationInstructions(d Domain) gin.H {
+	if d.Method == verifyHTTP {
+		return gin.H{
+			"type":    "http",
+			"url":     "http://" + d.Name + httpChallengePrefix + d.Token,
+			"content": d.Token,
+		}
+	}
+	return gin.H{
+		"type":  "TXT",
+		"name":  dnsChallengePrefix + d.Name,
+		"value": dnsChallengeValue + d.Token,
+	}
+}
+
+// checkDomainOwnership looks for the verification token in DNS or over HTTP.
+func checkDomainOwnership(ctx context.Context, d Domain) error {
+	switch d.Method {
+	case verifyDNS:
+		records, err := lookupTXT(ctx, dnsChallengePrefix+d.Name)
+		if err != nil {
+			return fmt.Errorf("TXT lookup failed: %w", err)
+		}
+		for _, record := range records {
+			if strings.TrimSpace(record) == dnsChallengeValue+d.Token {
+				return nil
+			}
+		}
+		return fmt.Errorf("TXT record %s%s does not contain the verification token", dnsChallengePrefix, d.Name)
+
+	case verifyHTTP:
+		url := "http://" + d.Name + httpChallengePrefix + d.Token
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := challengeClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %w", url, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", url, err)
+		}
+		if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != d.Token {
+			return fmt.Errorf("%s did not return the verification token", url)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown verification method %q", d.Method)
+}
+
+func handleListDomains(c *gin.Context) {
+	p := auth.Current(c)
+	visible := []Domain{}
+	for _, d := range domains.list(c.Query("repo")) {
+		if canView(p, d.Repo) {
+			visible = append(visible, d)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"domains": visible})
+}
+
+func handleAddDomain(c *gin.Context) {
+	var req struct {
+		Domain string `json:"domain" binding:"required"`
+		Repo   string `json:"repo" binding:"required"`
+		Method string `json:"method"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, err := normalizeDomain(req.Domain)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Method == "" {
+		req.Method = verifyDNS
+	}
+	if req.Method != verifyDNS && req.Method != verifyHTTP {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "method must be 'dns' or 'http'"})
+		return
+	}
+	if strings.Contains(req.Repo, "/") || strings.Contains(req.Repo, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid repository name"})
+		return
+	}
+	if !requireProjectRole(c, req.Repo, RoleMaintainer) {
+		return
+	}
+
+	token, err := newVerificationToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	d := &Domain{
+		Name:      name,
+		Repo:      req.Repo,
+		Method:    req.Method,
+		Token:     token,
+		CreatedAt: time.Now(),
+	}
+	if err := domains.add(d); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrDomainExists) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	logger.InfoContext(c.Request.Context(), "registered domain", "domain", name, "repo", req.Repo)
+	recordAudit(c, projectAudit("domain.add", name, req.Repo), nil, gin.H{"method": req.Method, "verified": false})
+	c.JSON(http.StatusCreated, gin.H{
+		"domain":       d,
+		"verification": verificationInstructions(*d),
+	})
+}
+
+func handleVerifyDomain(c *gin.Context) {
+	d, ok := domains.get(strings.ToLower(c.Param("domain")))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrDomainNotFound.Error()})
+		return
+	}
+	if !requireProjectRole(c, d.Repo, RoleMaintainer) {
+		return
+	}
+	if d.Verified {
+		c.JSON(http.StatusOK, gin.H{"domain": d})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+	defer cancel()
+	if err := checkDomainOwnership(ctx, d); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":        err.Error(),
+			"verification": verificationInstructions(d),
+		})
+		return
+	}
+
+	d, err := domains.markVerified(d.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.InfoContext(c.Request.Context(), "verified domain", "domain", d.Name, "repo", d.Repo)
+	publishHosts(c.Request.Context())
+	recordAudit(c, projectAudit("domain.verify", d.Name, d.Repo), gin.H{"verified": false}, gin.H{"verified": true})
+	c.JSON(http.StatusOK, gin.H{"domain": d})
+}
+
+func handleRemoveDomain(c *gin.Context) {
+	d, ok := domains.get(strings.ToLower(c.Param("domain")))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrDomainNotFound.Error()})
+		return
+	}
+	if !requireProjectRole(c, d.Repo, RoleMaintainer) {
+		return
+	}
+	if err := domains.remove(d.Name); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrDomainNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if d.Verified {
+		publishHosts(c.Request.Context())
+	}
+	recordAudit(c, projectAudit("domain.remove", d.Name, d.Repo), gin.H{"method": d.Method, "verified": d.Verified}, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Domain removed"})
+}
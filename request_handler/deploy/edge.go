@@ -0,0 +1,311 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"zenith/shared/config"
+	"zenith/shared/health"
+	"zenith/shared/lifecycle"
+	"zenith/shared/logging"
+	"zenith/shared/metrics"
+	"zenith/shared/redact"
+	"zenith/shared/retry"
+	"zenith/shared/storage"
+	"zenith/shared/tracing"
+)
+
+// newCertManager returns an autocert manager that only requests
+// certificates for the hosts policy allows, keeping them in cache.
+// Certificates are renewed automatically before they expire.
+func newCertManager(cfg config.EdgeConfig, cache autocert.Cache, policy autocert.HostPolicy) (*autocert.Manager, error) {
+	httpClient := http.DefaultClient
+	if cfg.ACMECACert != "" {
+		pem, err := os.ReadFile(cfg.ACMECACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME CA certificate: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.ACMECACert)
+		}
+		httpClient = &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      cache,
+		Email:      cfg.ACMEEmail,
+		HostPolicy: policy,
+		Client: &acme.Client{
+			DirectoryURL: cfg.ACMEDirectoryURL,
+			HTTPClient:   httpClient,
+		},
+	}, nil
+}
+
+// verifiedDomainPolicy only allows certificates for verified domains.
+func verifiedDomainPolicy(_ context.Context, host string) error {
+	if _, ok := domains.verifiedRepo(host); !ok {
+		return fmt.Errorf("host %q is not a verified custom domain", host)
+	}
+	return nil
+}
+
+// edgeHandler routes requests to the deployment attached to the Host header.
+// The HTTP verification path of a domain registered with the http method is
+// routed to its project before the domain is verified, so the token can be
+// served from a deployment of it.
+func edgeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		repo, ok := domains.verifiedRepo(host)
+		if d, pending := domains.get(host); !ok && pending && d.Method == verifyHTTP && strings.HasPrefix(r.URL.Path, httpChallengePrefix) {
+			repo, ok = d.Repo, true
+		}
+		if !ok {
+			http.Error(w, "Unknown domain", http.StatusNotFound)
+			return
+		}
+		site, ok := sites.get(repo)
+		if !ok {
+			http.Error(w, "No deployment for this domain", http.StatusServiceUnavailable)
+			return
+		}
+		site.ServeHTTP(w, r)
+	})
+}
+
+// edgeServers returns the servers of the edge: verified custom domains are
+// served over HTTPS, using SNI to pick each domain's certificate, and the
+// plain HTTP listener answers ACME http-01 challenges, serves /.well-known/
+// and redirects everything else to HTTPS.
+func edgeServers(cfg config.EdgeConfig) ([]*http.Server, error) {
+	manager, err := newCertManager(cfg, autocert.DirCache(cfg.ACMECacheDir), verifiedDomainPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	httpServer := &http.Server{
+		Addr:              cfg.HTTPAddr,
+		Handler:           manager.HTTPHandler(redirectToHTTPS(edgeHandler())),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	httpsServer := &http.Server{
+		Addr:              cfg.HTTPSAddr,
+		Handler:           edgeHandler(),
+		TLSConfig:         manager.TLSConfig(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logger.Info("starting edge servers", "http_addr", cfg.HTTPAddr, "https_addr", cfg.HTTPSAddr, "acme_directory", cfg.ACMEDirectoryURL)
+	return []*http.Server{httpServer, httpsServer}, nil
+}
+
+// RunEdge runs an edge server until SIGINT or SIGTERM. Edge servers serve
+// the released deployment of every project straight from storage, on
+// verified custom domains and on <repo>.<base domain>, without the deploy
+// API. They keep nothing but a cache of files on their own disk, so any
+// number of them can run behind a load balancer.
+func RunEdge(c *config.Config) error {
+	cfg = c
+	logger = logging.New("edge", c.RequestHandler.LogLevel)
+	redact.Install(c.Secrets()...)
+	if err := retry.Setup(c.Retry); err != nil {
+		return err
+	}
+	timeout, err := lifecycle.Timeout(c.Shutdown)
+	if err != nil {
+		return err
+	}
+	edge := c.RequestHandler.Edge
+	refresh, err := time.ParseDuration(edge.RefreshInterval)
+	if err != nil {
+		return fmt.Errorf("invalid edge refresh interval: %w", err)
+	}
+	diskSize, err := config.ParseSize(edge.CacheSize)
+	if err != nil {
+		return fmt.Errorf("invalid edge cache size: %w", err)
+	}
+	memorySize, err := config.ParseSize(edge.MemoryCacheSize)
+	if err != nil {
+		return fmt.Errorf("invalid edge memory cache size: %w", err)
+	}
+	minFree, err := health.MinFreeDisk(c.Health)
+	if err != nil {
+		return err
+	}
+
+	if store, err = storage.New(c.Storage); err != nil {
+		return err
+	}
+	cache, err := newBlobCache(store, edge.CacheDir, diskSize, memorySize)
+	if err != nil {
+		return fmt.Errorf("error opening edge cache: %w", err)
+	}
+	checker = health.New("edge",
+		health.Check{Name: "storage", Run: func(ctx context.Context) error { return store.Check(ctx) }},
+		health.DiskSpace("edge-cache", edge.CacheDir, minFree),
+	)
+
+	shutdown, err := tracing.Setup(context.Background(), c.Tracing, "edge")
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.Background())
+	slog.SetDefault(logger)
+
+	router := newEdgeRouter(store, cache, edge.BaseDomain, refresh)
+	servers, err := edgeSiteServers(edge, router)
+	if err != nil {
+		return err
+	}
+	if addr := c.RequestHandler.MetricsAddr; addr != "" {
+		admin := gin.New()
+		admin.Use(gin.Recovery())
+		admin.GET("/metrics", gin.WrapH(metrics.Handler()))
+		checker.Routes(admin)
+		servers = append(servers, &http.Server{Addr: addr, Handler: admin, ReadHeaderTimeout: 10 * time.Second})
+	}
+
+	ctx, stop := lifecycle.SignalContext()
+	defer stop()
+	logger.Info("serving sites from storage", "http_addr", edge.HTTPAddr, "https_addr", edge.HTTPSAddr, "metrics_addr", c.RequestHandler.MetricsAddr)
+	err = lifecycle.Serve(ctx, timeout, servers...)
+	logger.Info("server stopped")
+	return err
+}
+
+// edgeSiteServers returns the servers of an edge server's sites. Over
+// HTTPS, certificates are kept in storage so that every edge server can
+// use them and answer the ACME challenges of orders another one placed.
+// With no HTTPS address, sites are served over plain HTTP to a load
+// balancer that terminates TLS.
+func edgeSiteServers(cfg config.EdgeConfig, router *edgeRouter) ([]*http.Server, error) {
+	if cfg.HTTPSAddr == "" {
+		return []*http.Server{{Addr: cfg.HTTPAddr, Handler: router, ReadHeaderTimeout: 10 * time.Second}}, nil
+	}
+	cache, err := newStorageCertCache(router.store, cfg.CertKey)
+	if err != nil {
+		return nil, err
+	}
+	manager, err := newCertManager(cfg, cache, router.hostPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return []*http.Server{
+		{Addr: cfg.HTTPAddr, Handler: manager.HTTPHandler(redirectToHTTPS(router)), ReadHeaderTimeout: 10 * time.Second},
+		{Addr: cfg.HTTPSAddr, Handler: router, TLSConfig: manager.TLSConfig(), ReadHeaderTimeout: 10 * time.Second},
+	}, nil
+}
+
+// redirectToHTTPS redirects GET and HEAD requests to HTTPS like autocert's
+// default fallback, except below /.well-known/, which site serves over plain
+// HTTP: domain verification and other clients fetch it without following a
+// redirect to a host that may not have a certificate yet.
+func redirectToHTTPS(site http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/.well-known/") {
+			site.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Use HTTPS", http.StatusBadRequest)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusFound)
+	})
+}
+
+// storageCertCache is an autocert.Cache keeping certificates, the ACME
+// account key and pending http-01 tokens below certs/ in storage. Every
+// service reads and writes that storage, so entries are encrypted with a
+// key derived from EdgeConfig.CertKey, bound to their name. Entries that do
+// not decrypt, such as ones written under another key, are cache misses and
+// are issued again.
+type storageCertCache struct {
+	store storage.Store
+	aead  cipher.AEAD
+}
+
+func newStorageCertCache(store storage.Store, secret string) (storageCertCache, error) {
+	if secret == "" {
+		return storageCertCache{}, errors.New("request_handler.edge.cert_key (EDGE_CERT_KEY) is required to keep certificates in storage")
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return storageCertCache{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return storageCertCache{}, err
+	}
+	return storageCertCache{store: store, aead: aead}, nil
+}
+
+func (c storageCertCache) Get(ctx context.Context, name string) ([]byte, error) {
+	obj, err := c.store.Open(ctx, "certs/"+name)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	sealed, err := io.ReadAll(io.NewSectionReader(obj, 0, obj.Size()))
+	if err != nil {
+		return nil, err
+	}
+	if n := c.aead.NonceSize(); len(sealed) >= n {
+		if data, err := c.aead.Open(nil, sealed[:n], sealed[n:], []byte(name)); err == nil {
+			return data, nil
+		}
+	}
+	logger.WarnContext(ctx, "certificate cache entry does not decrypt with EDGE_CERT_KEY", "name", name)
+	return nil, autocert.ErrCacheMiss
+}
+
+func (c storageCertCache) Put(ctx context.Context, name string, data []byte) error {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := c.aead.Seal(nonce, nonce, data, []byte(name))
+	return c.store.Put(ctx, "certs/"+name, bytes.NewReader(sealed), int64(len(sealed)), "application/octet-stream")
+}
+
+func (c storageCertCache) Delete(ctx context.Context, name string) error {
+	return c.store.Delete(ctx, "certs/"+name)
+}
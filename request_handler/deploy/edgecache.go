@@ -0,0 +1,303 @@
+package deploy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"zenith/shared/manifest"
+	"zenith/shared/metrics"
+	"zenith/shared/storage"
+)
+
+// fetchTimeout bounds the download of one blob into the cache. It does not
+// depend on the request that asked for it, since others may be waiting.
+const fetchTimeout = 5 * time.Minute
+
+// maxMemoryBlob is the largest blob kept in memory; larger ones are only
+// cached on disk.
+const maxMemoryBlob = 1 << 20
+
+// blobCache keeps the blobs an edge server serves in a directory on disk,
+// and the small ones in memory too, each dropping its least recently used
+// blobs when full. Blobs never change, so a cached copy is never stale and
+// replicas need not agree on what they cache. Blobs larger than the disk
+// cache are read from storage for each request.
+type blobCache struct {
+	store storage.Store
+	dir   string
+
+	mu       sync.Mutex
+	disk     *lru[struct{}]
+	memory   *lru[[]byte]
+	fetching map[string]*blobFetch
+}
+
+// blobFetch is a blob being downloaded, which later requests for it wait
+// for.
+type blobFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// newBlobCache opens the cache in dir, keeping the blobs a previous run
+// left there, oldest first out.
+func newBlobCache(s storage.Store, dir string, diskSize, memorySize int64) (*blobCache, error) {
+	c := &blobCache{
+		store:    s,
+		dir:      dir,
+		memory:   newLRU[[]byte](memorySize, nil),
+		fetching: map[string]*blobFetch{},
+	}
+	c.disk = newLRU(diskSize, func(sum string, _ struct{}) { os.Remove(c.path(sum)) })
+
+	if err := os.RemoveAll(filepath.Join(dir, "tmp")); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0755); err != nil {
+		return nil, err
+	}
+	type cached struct {
+		sum  string
+		size int64
+		mod  time.Time
+	}
+	var found []cached
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !manifest.ValidSum(d.Name()) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		found = append(found, cached{d.Name(), info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].mod.Before(found[j].mod) })
+	for _, f := range found {
+		c.disk.add(f.sum, struct{}{}, f.size)
+	}
+	return c, nil
+}
+
+// path returns where the blob with sum, which passed manifest.ValidSum, is
+// cached.
+func (c *blobCache) path(sum string) string {
+	return filepath.Join(c.dir, sum[:2], sum)
+}
+
+// open returns the content of e, from the cache if it is there and after
+// downloading it otherwise.
+func (c *blobCache) open(ctx context.Context, e manifest.Entry) (io.ReadSeekCloser, error) {
+	if !manifest.ValidSum(e.SHA256) {
+		return nil, manifest.ErrCorrupt
+	}
+	if r, ok := c.cached(e); ok {
+		return r, nil
+	}
+	if err := c.fetch(ctx, e); err != nil {
+		return nil, err
+	}
+	if r, ok := c.cached(e); ok {
+		return r, nil
+	}
+
+	// Too large for the cache, or dropped from it already.
+	obj, err := c.store.Open(ctx, manifest.BlobKey(e.SHA256))
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.ReadSeeker
+		io.Closer
+	}{io.NewSectionReader(obj, 0, obj.Size()), obj}, nil
+}
+
+// cached returns e from memory or disk. Small blobs found on disk are kept
+// in memory from then on.
+func (c *blobCache) cached(e manifest.Entry) (io.ReadSeekCloser, bool) {
+	c.mu.Lock()
+	data, ok := c.memory.get(e.SHA256)
+	_, onDisk := c.disk.get(e.SHA256)
+	c.mu.Unlock()
+	if ok {
+		metrics.CacheRequests.Inc("edge_memory", "hit")
+		return nopCloser{bytes.NewReader(data)}, true
+	}
+	metrics.CacheRequests.Inc("edge_memory", "miss")
+	if !onDisk {
+		metrics.CacheRequests.Inc("edge_disk", "miss")
+		return nil, false
+	}
+
+	f, err := os.Open(c.path(e.SHA256))
+	if err != nil {
+		c.mu.Lock()
+		c.disk.remove(e.SHA256)
+		c.mu.Unlock()
+		metrics.CacheRequests.Inc("edge_disk", "miss")
+		return nil, false
+	}
+	metrics.CacheRequests.Inc("edge_disk", "hit")
+	if e.Size > maxMemoryBlob {
+		return f, true
+	}
+	defer f.Close()
+	data, err = io.ReadAll(f)
+	if err != nil || int64(len(data)) != e.Size {
+		return nil, false
+	}
+	c.mu.Lock()
+	c.memory.add(e.SHA256, data, e.Size)
+	c.mu.Unlock()
+	return nopCloser{bytes.NewReader(data)}, true
+}
+
+// fetch downloads e to the disk cache, or waits for the download already
+// running.
+func (c *blobCache) fetch(ctx context.Context, e manifest.Entry) error {
+	c.mu.Lock()
+	f, ok := c.fetching[e.SHA256]
+	if !ok {
+		f = &blobFetch{done: make(chan struct{})}
+		c.fetching[e.SHA256] = f
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), fetchTimeout)
+		f.err = c.download(fetchCtx, e)
+		cancel()
+		c.mu.Lock()
+		delete(c.fetching, e.SHA256)
+		c.mu.Unlock()
+		close(f.done)
+	}
+
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// download copies blob e from storage to the disk cache, checking it
+// against its checksum. Blobs larger than the cache are left in storage.
+func (c *blobCache) download(ctx context.Context, e manifest.Entry) error {
+	if e.Size > c.disk.max {
+		return nil
+	}
+	obj, err := c.store.Open(ctx, manifest.BlobKey(e.SHA256))
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	tmp, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), e.SHA256+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.NewSectionReader(obj, 0, obj.Size()))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n != e.Size || hex.EncodeToString(h.Sum(nil)) != e.SHA256 {
+		return manifest.ErrCorrupt
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path(e.SHA256)), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path(e.SHA256)); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.disk.add(e.SHA256, struct{}{}, e.Size)
+	c.mu.Unlock()
+	return nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// lru holds values up to a total size, dropping the least recently used
+// first. It is not safe for concurrent use.
+type lru[V any] struct {
+	max, size int64
+	order     *list.List
+	items     map[string]*list.Element
+	// evicted is called with the values dropped to make room.
+	evicted func(key string, value V)
+}
+
+type lruItem[V any] struct {
+	key   string
+	value V
+	size  int64
+}
+
+func newLRU[V any](max int64, evicted func(string, V)) *lru[V] {
+	return &lru[V]{max: max, order: list.New(), items: map[string]*list.Element{}, evicted: evicted}
+}
+
+func (l *lru[V]) get(key string) (V, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruItem[V]).value, true
+}
+
+// add stores value, unless it is larger than the whole cache.
+func (l *lru[V]) add(key string, value V, size int64) {
+	if size > l.max {
+		return
+	}
+	if el, ok := l.items[key]; ok {
+		l.order.MoveToFront(el)
+		return
+	}
+	l.items[key] = l.order.PushFront(&lruItem[V]{key, value, size})
+	l.size += size
+	for l.size > l.max {
+		item := l.order.Back().Value.(*lruItem[V])
+		l.remove(item.key)
+		if l.evicted != nil {
+			l.evicted(item.key, item.value)
+		}
+	}
+}
+
+func (l *lru[V]) remove(key string) {
+	el, ok := l.items[key]
+	if !ok {
+		return
+	}
+	item := l.order.Remove(el).(*lruItem[V])
+	delete(l.items, key)
+	l.size -= item.size
+}
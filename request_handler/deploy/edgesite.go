@@ -0,0 +1,372 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zenith/shared/manifest"
+	"zenith/shared/storage"
+)
+
+// maxEdgeSites is how many deployments an edge server keeps loaded.
+const maxEdgeSites = 1000
+
+var errUnknownHost = errors.New("unknown host")
+
+// edgeRouter serves the sites of every project from storage. It resolves
+// the Host header to a project through the hosts table or the base domain,
+// and the project to the manifest of its release. Both are looked up again
+// once refresh has passed, so a deploy or a rollback published by
+// request_handler reaches every edge server within that time.
+type edgeRouter struct {
+	store      storage.Store
+	cache      *blobCache
+	baseDomain string
+	refresh    time.Duration
+
+	mu       sync.Mutex
+	hosts    map[string]string
+	hostsAt  time.Time
+	releases map[string]edgeRelease
+	sites    *lru[http.Handler]
+}
+
+// edgeRelease is a looked up release, or the error looking it up.
+type edgeRelease struct {
+	release *manifest.Release
+	err     error
+	at      time.Time
+}
+
+func newEdgeRouter(s storage.Store, cache *blobCache, baseDomain string, refresh time.Duration) *edgeRouter {
+	return &edgeRouter{
+		store:      s,
+		cache:      cache,
+		baseDomain: strings.ToLower(strings.TrimSuffix(baseDomain, ".")),
+		refresh:    refresh,
+		releases:   map[string]edgeRelease{},
+		sites:      newLRU[http.Handler](maxEdgeSites, nil),
+	}
+}
+
+func (e *edgeRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	repo, err := e.repoFor(r.Context(), host)
+	if errors.Is(err, errUnknownHost) {
+		http.Error(w, "Unknown domain", http.StatusNotFound)
+		return
+	}
+	var site http.Handler
+	if err == nil {
+		site, err = e.site(r.Context(), repo)
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "No deployment for this domain", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to load site", "host", host, "error", err)
+		http.Error(w, "Failed to load the deployment", http.StatusBadGateway)
+		return
+	}
+	site.ServeHTTP(w, r)
+}
+
+// hostPolicy only allows certificates for hosts with a release to serve.
+func (e *edgeRouter) hostPolicy(ctx context.Context, host string) error {
+	repo, err := e.repoFor(ctx, host)
+	if err != nil {
+		return err
+	}
+	_, err = e.release(ctx, repo)
+	return err
+}
+
+// repoFor returns the project served on host: the one a verified custom
+// domain is attached to, or repo for <repo>.<base domain>.
+func (e *edgeRouter) repoFor(ctx context.Context, host string) (string, error) {
+	e.mu.Lock()
+	hosts, fresh := e.hosts, time.Since(e.hostsAt) < e.refresh
+	e.mu.Unlock()
+	if !fresh {
+		loaded, err := manifest.LoadHosts(ctx, e.store)
+		if err != nil && hosts == nil {
+			return "", err
+		}
+		if err != nil {
+			// Serve the table already loaded rather than fail.
+			logger.WarnContext(ctx, "failed to refresh custom domains", "error", err)
+		} else {
+			hosts = loaded
+		}
+		e.mu.Lock()
+		e.hosts, e.hostsAt = hosts, time.Now()
+		e.mu.Unlock()
+	}
+
+	if repo, ok := hosts[host]; ok {
+		return repo, nil
+	}
+	if e.baseDomain != "" {
+		if repo, ok := strings.CutSuffix(host, "."+e.baseDomain); ok && repo != "" && !strings.Contains(repo, ".") {
+			return repo, nil
+		}
+	}
+	return "", errUnknownHost
+}
+
+// release returns the release of repo, which fails with
+// storage.ErrNotFound while repo has none.
+func (e *edgeRouter) release(ctx context.Context, repo string) (*manifest.Release, error) {
+	e.mu.Lock()
+	cached, ok := e.releases[repo]
+	e.mu.Unlock()
+	if ok && time.Since(cached.at) < e.refresh {
+		return cached.release, cached.err
+	}
+
+	r, err := manifest.LoadRelease(ctx, e.store, repo)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		if ok && cached.err == nil {
+			logger.WarnContext(ctx, "failed to refresh release", "repo", repo, "error", err)
+			return cached.release, nil
+		}
+		return nil, err
+	}
+	e.mu.Lock()
+	e.releases[repo] = edgeRelease{release: r, err: err, at: time.Now()}
+	e.mu.Unlock()
+	return r, err
+}
+
+// site returns the handler of the release of repo, loading its manifest
+// unless a handler for it is loaded already.
+func (e *edgeRouter) site(ctx context.Context, repo string) (http.Handler, error) {
+	r, err := e.release(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	key := r.Manifest + "|" + strconv.FormatBool(r.StripDotfiles)
+	e.mu.Lock()
+	site, ok := e.sites.get(key)
+	e.mu.Unlock()
+	if ok {
+		return site, nil
+	}
+
+	m, err := manifest.Load(ctx, e.store, r.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	site = instrumentSite(repo, newManifestSite(ctx, e.cache, m, r.StripDotfiles))
+	e.mu.Lock()
+	e.sites.add(key, site, 1)
+	e.mu.Unlock()
+	return site, nil
+}
+
+// manifestSite serves a deployment from its manifest the way
+// newStaticHandler serves one from disk, reading the files through the
+// edge cache.
+type manifestSite struct {
+	cache    *blobCache
+	modified time.Time
+	// files maps the paths below the directory of index.html, or every
+	// path when the site has none, to their blobs.
+	files    map[string]manifest.Entry
+	hasIndex bool
+	rules    *siteRules
+}
+
+// newManifestSite builds the handler for m. When stripDotfiles is set the
+// paths stripDotfiles would have removed from the publish directory are
+// left out.
+func newManifestSite(ctx context.Context, cache *blobCache, m *manifest.Manifest, stripDotfiles bool) *manifestSite {
+	names := make([]string, 0, len(m.Files))
+	for name := range m.Files {
+		if !stripDotfiles || !isDotfile(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// Look for index.html at the top or in any subdirectory, preferring the
+	// top-level one.
+	root := ""
+	if _, ok := m.Files["index.html"]; !ok {
+		for _, name := range names {
+			if strings.HasSuffix(name, "/index.html") {
+				root = path.Dir(name) + "/"
+				break
+			}
+		}
+	}
+
+	s := &manifestSite{cache: cache, modified: m.CreatedAt, files: map[string]manifest.Entry{}}
+	for _, name := range names {
+		if rel, ok := strings.CutPrefix(name, root); ok {
+			s.files[rel] = m.Files[name]
+		}
+	}
+	_, s.hasIndex = s.files["index.html"]
+
+	rules, err := parseSiteRules(func(name string) ([]byte, error) {
+		return s.read(ctx, name)
+	})
+	if err != nil {
+		logger.WarnContext(ctx, "ignoring invalid site rules", "repo", m.Repo, "deployment_id", m.ID, "error", err)
+	}
+	s.rules = rules
+	return s
+}
+
+// isDotfile reports whether stripDotfiles removes the file name: one of
+// its segments starts with a dot and is not the .well-known directory.
+func isDotfile(name string) bool {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ".") && (segment != ".well-known" || i == len(segments)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *manifestSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.rules.applyHeaders(w.Header(), r.URL.Path)
+
+	name := cleanSitePath(r.URL.Path)
+	_, exists := s.files[name]
+	if r.URL.Path == "/" && s.hasIndex {
+		exists = true
+	}
+
+	if m := s.rules.match(r.URL.Path, r.URL.Query(), exists); m != nil {
+		switch m.status {
+		case http.StatusOK:
+			s.serveAsset(w, r, cleanSitePath(m.target))
+			return
+		case http.StatusNotFound:
+			s.serveWithStatus(w, r, cleanSitePath(m.target), m.status)
+			return
+		}
+		http.Redirect(w, r, m.target, m.status)
+		return
+	}
+
+	// Single-page apps get index.html for every path that is not a file.
+	if s.hasIndex && (!exists || r.URL.Path == "/" || strings.HasSuffix(r.URL.Path, "/")) {
+		s.serveAsset(w, r, "index.html")
+		return
+	}
+	if !exists {
+		if _, ok := s.files[path.Join(name, "index.html")]; ok {
+			s.serveAsset(w, r, path.Join(name, "index.html"))
+			return
+		}
+	}
+	s.serveAsset(w, r, name)
+}
+
+// cleanSitePath returns the manifest path of a URL path.
+func cleanSitePath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// serveAsset serves the file name like assetIndex.serveAsset: through a
+// precompressed variant the client accepts, with caching headers and an
+// ETag taken from the blob's checksum.
+func (s *manifestSite) serveAsset(w http.ResponseWriter, r *http.Request, name string) {
+	entry, ok := s.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	hasVariants, compressed := false, false
+	for _, variant := range precompressedVariants {
+		variantEntry, ok := s.files[name+variant.extension]
+		if !ok {
+			continue
+		}
+		hasVariants = true
+		if !compressed && acceptsEncoding(r.Header.Get("Accept-Encoding"), variant.encoding) {
+			entry, compressed = variantEntry, true
+			w.Header().Set("Content-Encoding", variant.encoding)
+		}
+	}
+
+	f, err := s.cache.open(r.Context(), entry)
+	if err != nil {
+		w.Header().Del("Content-Encoding")
+		s.failed(w, r, name, err)
+		return
+	}
+	defer f.Close()
+
+	header := w.Header()
+	if hasVariants {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if header.Get("Cache-Control") == "" {
+		header.Set("Cache-Control", cacheControlFor(name))
+	}
+	if header.Get("ETag") == "" {
+		header.Set("ETag", `"`+entry.SHA256[:32]+`"`)
+	}
+	http.ServeContent(w, r, path.Base(name), s.modified, f)
+}
+
+// serveWithStatus writes the file name with a non-200 status code, e.g.
+// for custom 404 pages.
+func (s *manifestSite) serveWithStatus(w http.ResponseWriter, r *http.Request, name string, status int) {
+	entry, ok := s.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := s.cache.open(r.Context(), entry)
+	if err != nil {
+		s.failed(w, r, name, err)
+		return
+	}
+	defer f.Close()
+
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.WriteHeader(status)
+	io.Copy(w, f)
+}
+
+// read returns the content of the file name.
+func (s *manifestSite) read(ctx context.Context, name string) ([]byte, error) {
+	entry, ok := s.files[name]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	f, err := s.cache.open(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (s *manifestSite) failed(w http.ResponseWriter, r *http.Request, name string, err error) {
+	logger.ErrorContext(r.Context(), "failed to read site file", "path", name, "error", err)
+	http.Error(w, "Failed to read the file from storage", http.StatusBadGateway)
+}
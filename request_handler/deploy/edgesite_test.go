@@ -0,0 +1,158 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"zenith/shared/config"
+	"zenith/shared/manifest"
+	"zenith/shared/storage"
+)
+
+func TestEdgeRouter(t *testing.T) {
+	ctx := context.Background()
+	s, err := storage.New(config.StorageConfig{Backend: "local", LocalDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(id string, files map[string]string, stripDotfiles bool) {
+		t.Helper()
+		if _, _, err := manifest.Build(ctx, s, writeSite(t, files), "site", id); err != nil {
+			t.Fatal(err)
+		}
+		release := manifest.Release{Repo: "site", DeploymentID: id, Manifest: manifest.Key("site", id), StripDotfiles: stripDotfiles}
+		if err := manifest.Publish(ctx, s, release); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish("v1", map[string]string{
+		"dist/index.html":  "<h1>v1</h1>",
+		"dist/app.js":      "app()",
+		"dist/.env":        "TOKEN=x",
+		"dist/_redirects":  "/old /app.js 301",
+		"dist/docs/a.html": "<p>a</p>",
+	}, true)
+	manifest.SaveHosts(ctx, s, map[string]string{"www.example.com": "site"})
+
+	cacheDir := t.TempDir()
+	cache, err := newBlobCache(s, cacheDir, 1<<20, 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newEdgeRouter(s, cache, "zenith.test", time.Hour)
+	get := func(host, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		host, path string
+		status     int
+		body       string
+	}{
+		{"site.zenith.test", "/", http.StatusOK, "<h1>v1</h1>"},
+		{"www.example.com:443", "/app.js", http.StatusOK, "app()"},
+		{"site.zenith.test", "/some/route", http.StatusOK, "<h1>v1</h1>"},
+		{"site.zenith.test", "/docs/a.html", http.StatusOK, "<p>a</p>"},
+		{"site.zenith.test", "/.env", http.StatusOK, "<h1>v1</h1>"},
+		{"site.zenith.test", "/old", http.StatusMovedPermanently, ""},
+		{"other.zenith.test", "/", http.StatusServiceUnavailable, ""},
+		{"a.site.zenith.test", "/", http.StatusNotFound, ""},
+		{"example.org", "/", http.StatusNotFound, ""},
+	} {
+		rec := get(tc.host, tc.path)
+		if rec.Code != tc.status || (tc.body != "" && rec.Body.String() != tc.body) {
+			t.Errorf("%s%s: status %d, body %q", tc.host, tc.path, rec.Code, rec.Body)
+		}
+	}
+
+	// Files read once are served from the cache, with their checksum as
+	// ETag.
+	m, _ := manifest.Load(ctx, s, manifest.Key("site", "v1"))
+	sum := m.Files["dist/app.js"].SHA256
+	if _, err := os.Stat(filepath.Join(cacheDir, sum[:2], sum)); err != nil {
+		t.Errorf("app.js is not cached on disk: %v", err)
+	}
+	if rec := get("site.zenith.test", "/app.js"); rec.Header().Get("ETag") != `"`+sum[:32]+`"` {
+		t.Errorf("ETag = %q", rec.Header().Get("ETag"))
+	}
+	if err := s.Delete(ctx, manifest.BlobKey(sum)); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("site.zenith.test", "/app.js"); rec.Body.String() != "app()" {
+		t.Errorf("cached app.js: status %d, body %q", rec.Code, rec.Body)
+	}
+
+	// A new release is served once the router looks it up again.
+	publish("v2", map[string]string{"index.html": "<h1>v2</h1>"}, false)
+	if rec := get("site.zenith.test", "/"); rec.Body.String() != "<h1>v1</h1>" {
+		t.Errorf("before refresh: body %q", rec.Body)
+	}
+	router.refresh = 0
+	if rec := get("site.zenith.test", "/"); rec.Body.String() != "<h1>v2</h1>" {
+		t.Errorf("after refresh: body %q", rec.Body)
+	}
+	if err := manifest.Unpublish(ctx, s, "site"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("www.example.com", "/"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("after unpublish: status %d", rec.Code)
+	}
+}
+
+func TestBlobCacheEvicts(t *testing.T) {
+	ctx := context.Background()
+	s, err := storage.New(config.StorageConfig{Backend: "local", LocalDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := manifest.Build(ctx, s, writeSite(t, map[string]string{"a": "aaaa", "b": "bbbb", "c": "cccc"}), "site", "d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	cache, err := newBlobCache(s, dir, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sum := range []string{"", "a", "../../" + strings.Repeat("a", 58)} {
+		if _, err := cache.open(ctx, manifest.Entry{SHA256: sum, Size: 1}); !errors.Is(err, manifest.ErrCorrupt) {
+			t.Errorf("open(%q): err = %v", sum, err)
+		}
+	}
+	for _, name := range []string{"a", "b", "a", "c"} {
+		f, err := cache.open(ctx, m.Files[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	cached := func(name string) bool {
+		sum := m.Files[name].SHA256
+		_, err := os.Stat(filepath.Join(dir, sum[:2], sum))
+		return err == nil
+	}
+	if !cached("a") || cached("b") || !cached("c") {
+		t.Errorf("cached a, b, c = %v, %v, %v; want the least recently used b evicted", cached("a"), cached("b"), cached("c"))
+	}
+
+	// A restarted server keeps what is on disk.
+	reopened, err := newBlobCache(s, dir, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.disk.size != 8 {
+		t.Errorf("reopened cache holds %d bytes, want 8", reopened.disk.size)
+	}
+}
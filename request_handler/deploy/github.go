@@ -0,0 +1,291 @@
+package deploy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/auth"
+	"zenith/shared/github"
+)
+
+// With a GitHub App configured, users connect the app installations they can
+// see on GitHub, and every deploy clones with a short-lived token of a
+// connected installation covering the repository, once GitHub confirms the
+// user can read it. Without one, upload clones with its own GITHUB_TOKEN.
+
+var ErrInstallationNotFound = errors.New("GitHub installation not connected")
+
+// githubStateTTL is how long a user has to finish connecting on GitHub.
+const githubStateTTL = 10 * time.Minute
+
+// githubLinkTTL is how long a connected installation is used before the
+// user has to connect again.
+const githubLinkTTL = 30 * 24 * time.Hour
+
+// GitHubInstallation is an installation of the GitHub App a user connected.
+type GitHubInstallation struct {
+	ID      int64  `json:"id"`
+	Account string `json:"account"`
+	// Login is the GitHub user who connected it.
+	Login       string    `json:"login"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// githubStore keeps each user's connected installations in
+// ./data/github.json, and the pending OAuth states in memory.
+type githubStore struct {
+	mu     sync.Mutex
+	path   string
+	links  map[string][]GitHubInstallation
+	states map[string]githubState
+}
+
+type githubState struct {
+	UserID  string
+	Email   string
+	Expires time.Time
+}
+
+var (
+	githubApp   *github.App
+	githubLinks *githubStore
+)
+
+func loadGitHubStore(path string) (*githubStore, error) {
+	s := &githubStore{path: path, links: map[string][]GitHubInstallation{}, states: map[string]githubState{}}
+	if err := loadJSON(path, &s.links); err != nil {
+		return nil, fmt.Errorf("failed to load GitHub installations: %w", err)
+	}
+	return s, nil
+}
+
+// newState returns a state for the user to pass through GitHub's redirect.
+func (s *githubStore) newState(userID, email string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	state := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, v := range s.states {
+		if now.After(v.Expires) {
+			delete(s.states, k)
+		}
+	}
+	s.states[state] = githubState{UserID: userID, Email: email, Expires: now.Add(githubStateTTL)}
+	return state
+}
+
+// takeState returns whom state was issued to. Each state works once.
+func (s *githubStore) takeState(state string) (githubState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.states[state]
+	delete(s.states, state)
+	if !ok || time.Now().After(v.Expires) {
+		return githubState{}, false
+	}
+	return v, true
+}
+
+// connect replaces the installations userID has connected with insts, which
+// are all the installations the GitHub user login can access.
+func (s *githubStore) connect(userID, login string, insts []github.Installation) ([]GitHubInstallation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []GitHubInstallation
+	for _, inst := range insts {
+		list = append(list, GitHubInstallation{ID: inst.ID, Account: inst.Account.Login, Login: login, ConnectedAt: time.Now().UTC()})
+	}
+	s.links[userID] = list
+	return list, saveJSON(s.path, s.links)
+}
+
+func (s *githubStore) list(userID string) []GitHubInstallation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.links[userID])
+}
+
+// link returns installation id as userID connected it, unless it was
+// connected more than githubLinkTTL ago.
+func (s *githubStore) link(userID string, id int64) (GitHubInstallation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := s.links[userID]
+	i := slices.IndexFunc(list, func(i GitHubInstallation) bool { return i.ID == id })
+	if i < 0 || list[i].Login == "" || time.Since(list[i].ConnectedAt) > githubLinkTTL {
+		return GitHubInstallation{}, false
+	}
+	return list[i], true
+}
+
+func (s *githubStore) disconnect(userID string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := s.links[userID]
+	i := slices.IndexFunc(list, func(i GitHubInstallation) bool { return i.ID == id })
+	if i < 0 {
+		return ErrInstallationNotFound
+	}
+	s.links[userID] = slices.Delete(list, i, i+1)
+	return saveJSON(s.path, s.links)
+}
+
+// githubToken returns the token to clone repoURL with for the caller: empty
+// without a GitHub App, otherwise a token of a connected installation that
+// can only read the repository, provided the caller's GitHub account can
+// read it too. It responds with an error and returns false
+// when the caller cannot clone the repository.
+func githubToken(c *gin.Context, repoURL string) (string, bool) {
+	if githubApp == nil {
+		return "", true
+	}
+	path := strings.TrimSuffix(strings.TrimPrefix(repoURL, "https://github.com/"), ".git")
+	owner, repo, _ := strings.Cut(path, "/")
+	repo, _, _ = strings.Cut(repo, "/")
+	if owner == "" || repo == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "URL must be a valid GitHub repository URL"})
+		return "", false
+	}
+
+	inst, err := githubApp.RepoInstallation(c.Request.Context(), owner, repo)
+	if errors.Is(err, github.ErrNotInstalled) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("install the GitHub App on %s/%s before deploying it", owner, repo)})
+		return "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return "", false
+	}
+
+	p := auth.Current(c)
+	link, ok := githubLinks.link(p.UserID, inst.ID)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("connect a GitHub account with access to %s/%s first (GET /github/connect)", owner, repo)})
+		return "", false
+	}
+
+	token, err := githubApp.InstallationToken(c.Request.Context(), inst.ID, repo)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return "", false
+	}
+	// The installation may cover repositories the user cannot see, and the
+	// user may have lost access since connecting.
+	perm, err := githubApp.RepoPermission(c.Request.Context(), token.Token, owner, repo, link.Login)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return "", false
+	}
+	if perm == "none" {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("GitHub user %s cannot access %s/%s", link.Login, owner, repo)})
+		return "", false
+	}
+	return token.Token, true
+}
+
+func handleGitHubConnect(c *gin.Context) {
+	if githubApp == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no GitHub App is configured"})
+		return
+	}
+	p := auth.Current(c)
+	state := githubLinks.newState(p.UserID, p.Email)
+	c.JSON(http.StatusOK, gin.H{
+		"install_url":   githubApp.InstallURL(state),
+		"authorize_url": githubApp.AuthorizeURL(state),
+		"expires_in":    int(githubStateTTL.Seconds()),
+	})
+}
+
+// handleGitHubCallback is where GitHub sends the browser back after an
+// installation or authorization. It is not behind an API key; the state
+// identifies the user who started connecting.
+func handleGitHubCallback(c *gin.Context) {
+	if githubApp == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no GitHub App is configured"})
+		return
+	}
+	user, ok := githubLinks.takeState(c.Query("state"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown or expired state; start again from /github/connect"})
+		return
+	}
+	if c.Query("code") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing 'code'; enable user authorization during installation for the GitHub App"})
+		return
+	}
+
+	userToken, err := githubApp.Exchange(c.Request.Context(), c.Query("code"))
+	if errors.Is(err, github.ErrBadCode) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	login, err := githubApp.UserLogin(c.Request.Context(), userToken)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	insts, err := githubApp.UserInstallations(c.Request.Context(), userToken)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	list, err := githubLinks.connect(user.UserID, login, insts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var accounts []string
+	for _, i := range list {
+		accounts = append(accounts, i.Account)
+	}
+	logger.InfoContext(c.Request.Context(), "connected GitHub installations", "user", user.Email, "login", login, "accounts", accounts)
+	recordAudit(c, AuditEntry{Action: "github.connect", Target: user.Email, ActorID: user.UserID, Actor: user.Email}, nil, gin.H{"accounts": accounts})
+	if list == nil {
+		list = []GitHubInstallation{}
+	}
+	c.JSON(http.StatusOK, gin.H{"installations": list})
+}
+
+func handleListGitHubInstallations(c *gin.Context) {
+	list := githubLinks.list(auth.Current(c).UserID)
+	if list == nil {
+		list = []GitHubInstallation{}
+	}
+	c.JSON(http.StatusOK, gin.H{"installations": list})
+}
+
+func handleDisconnectGitHubInstallation(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid installation id"})
+		return
+	}
+	if err := githubLinks.disconnect(auth.Current(c).UserID, id); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInstallationNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditEntry{Action: "github.disconnect", Target: c.Param("id")}, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "GitHub installation disconnected"})
+}
@@ -0,0 +1,170 @@
+package deploy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/auth"
+	"zenith/shared/config"
+	"zenith/shared/github"
+)
+
+// setupGitHubApp points githubApp at a stub of GitHub on which installation 7
+// of account acme covers acme/site and acme/secret, and the user octo behind
+// code "good-code" can access only acme/site.
+func setupGitHubApp(t *testing.T) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			fmt.Fprint(w, `{"error":"bad_verification_code"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"gho_user"}`)
+	})
+	mux.HandleFunc("GET /user/installations", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"installations":[{"id":7,"account":{"login":"acme"}}]}`)
+	})
+	mux.HandleFunc("GET /user", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"login":"octo"}`)
+	})
+	mux.HandleFunc("GET /repos/acme/{repo}/collaborators/octo/permission", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("repo") != "site" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"permission":"read"}`)
+	})
+	mux.HandleFunc("GET /repos/{owner}/{repo}/installation", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("owner") != "acme" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"id":7,"account":{"login":"acme"}}`)
+	})
+	mux.HandleFunc("POST /app/installations/7/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"token":"ghs_site","expires_at":"2099-01-01T00:00:00Z"}`)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyFile := filepath.Join(t.TempDir(), "app.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+
+	var err error
+	githubApp, err = github.NewApp(config.GitHubConfig{
+		APIURL: srv.URL, WebURL: srv.URL, AppID: "1", AppSlug: "zenith",
+		AppKeyFile: keyFile, ClientID: "client", ClientSecret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	githubLinks, err = loadGitHubStore(filepath.Join(t.TempDir(), "github.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { githubApp = nil })
+}
+
+func TestGitHubInstallationsLimitDeploys(t *testing.T) {
+	keys := setupRBAC(t)
+	setupGitHubApp(t)
+
+	r := gin.New()
+	signedIn := auth.Require(users, "")
+	r.GET("/github/connect", signedIn, handleGitHubConnect)
+	r.GET("/github/callback", handleGitHubCallback)
+	r.GET("/token", signedIn, func(c *gin.Context) {
+		if token, ok := githubToken(c, c.Query("url")); ok {
+			c.String(http.StatusOK, token)
+		}
+	})
+
+	get := func(who, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if who != "" {
+			req.Header.Set("Authorization", "Bearer "+keys[who])
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	connect := func(who string) string {
+		var body struct {
+			AuthorizeURL string `json:"authorize_url"`
+		}
+		json.Unmarshal(get(who, "/github/connect").Body.Bytes(), &body)
+		u, _ := url.Parse(body.AuthorizeURL)
+		return u.Query().Get("state")
+	}
+
+	if rec := get("deployer", "/token?url=https://github.com/acme/site"); rec.Code != http.StatusForbidden {
+		t.Errorf("before connecting: %d %s", rec.Code, rec.Body)
+	}
+
+	state := connect("deployer")
+	if rec := get("", "/github/callback?code=stolen&state="+state); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad code: %d %s", rec.Code, rec.Body)
+	}
+	if rec := get("", "/github/callback?code=good-code&state="+state); rec.Code != http.StatusBadRequest {
+		t.Errorf("reused state: %d %s", rec.Code, rec.Body)
+	}
+	if rec := get("", "/github/callback?code=good-code&state="+connect("deployer")); rec.Code != http.StatusOK {
+		t.Fatalf("callback: %d %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		who, repo string
+		want      int
+	}{
+		{"deployer", "https://github.com/acme/site", http.StatusOK},
+		{"deployer", "https://github.com/acme/site.git", http.StatusOK},
+		{"maintainer", "https://github.com/acme/site", http.StatusForbidden},
+		{"deployer", "https://github.com/other/site", http.StatusForbidden},
+		{"deployer", "https://github.com/acme/secret", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		rec := get(tt.who, "/token?url="+tt.repo)
+		if rec.Code != tt.want {
+			t.Errorf("%s cloning %s: %d %s", tt.who, tt.repo, rec.Code, rec.Body)
+		}
+		if tt.want == http.StatusOK && rec.Body.String() != "ghs_site" {
+			t.Errorf("token = %q", rec.Body)
+		}
+	}
+}
+
+func TestGitHubLinksExpire(t *testing.T) {
+	links, err := loadGitHubStore(filepath.Join(t.TempDir(), "github.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := links.connect("u1", "octo", []github.Installation{{ID: 7}}); err != nil {
+		t.Fatal(err)
+	}
+	if link, ok := links.link("u1", 7); !ok || link.Login != "octo" {
+		t.Errorf("link = %+v, %v", link, ok)
+	}
+	links.links["u1"][0].ConnectedAt = time.Now().Add(-githubLinkTTL - time.Minute)
+	if _, ok := links.link("u1", 7); ok {
+		t.Error("expired link is still used")
+	}
+	// Links saved before logins were recorded must be connected again.
+	links.links["u2"] = []GitHubInstallation{{ID: 7, ConnectedAt: time.Now()}}
+	if _, ok := links.link("u2", 7); ok {
+		t.Error("link without a login is used")
+	}
+}
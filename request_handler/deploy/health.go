@@ -0,0 +1,32 @@
+package deploy
+
+import (
+	"context"
+
+	"zenith/shared/health"
+)
+
+// checker backs /healthz and /readyz.
+var checker *health.Checker
+
+// setupHealth checks storage, the npm toolchain sites are built with, the
+// space left for deployed sites, the tunnel provider, and the uploader and
+// builder when they have checks of their own.
+func setupHealth(up Uploader, b Builder) error {
+	minFree, err := health.MinFreeDisk(cfg.Health)
+	if err != nil {
+		return err
+	}
+	checker = health.New("request_handler",
+		health.Check{Name: "storage", Run: func(ctx context.Context) error { return store.Check(ctx) }},
+		health.DiskSpace("deployed", cfg.RequestHandler.DeployedDir, minFree),
+		health.Check{Name: "tunnel:" + tunnelProvider.Name(), Run: tunnelProvider.Check},
+	)
+	checker.Add(health.Binaries("node", "npm")...)
+	for _, dep := range []any{up, b} {
+		if h, ok := dep.(HealthChecker); ok {
+			checker.Add(h.HealthChecks()...)
+		}
+	}
+	return nil
+}
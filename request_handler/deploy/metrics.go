@@ -0,0 +1,83 @@
+package deploy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"zenith/shared/metrics"
+)
+
+var (
+	deploysInProgress = metrics.NewGauge("zenith_deploys_in_progress", "Deploys being handled.")
+	deploysTotal      = metrics.NewCounter("zenith_deploys_total",
+		"Finished deploys by outcome (success, failure or blocked) and the stage that failed.", "outcome", "stage")
+
+	siteRequests = metrics.NewCounter("zenith_site_requests_total",
+		"Requests to deployed sites by site and status code.", "site", "code")
+	siteLatency = metrics.NewHistogram("zenith_site_request_duration_seconds",
+		"Time to serve requests to deployed sites.", metrics.DurationBuckets, "site")
+)
+
+// recordDeployOutcome counts a deploy that responded with status while
+// running stage.
+func recordDeployOutcome(status int, stage string) {
+	switch {
+	case status < 300:
+		deploysTotal.Inc("success", "none")
+	case status == http.StatusUnprocessableEntity && stage == "secrets":
+		deploysTotal.Inc("blocked", stage)
+	default:
+		deploysTotal.Inc("failure", stage)
+	}
+}
+
+// statusRecorder remembers the status code a handler responded with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// instrumentSite counts the requests site serves for repo, their latency and
+// status, and how often browsers revalidate their cached copy successfully.
+func instrumentSite(repo string, site http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		site.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		siteRequests.Inc(repo, strconv.Itoa(rec.status))
+		siteLatency.ObserveSince(start, repo)
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+			result := "miss"
+			if rec.status == http.StatusNotModified {
+				result = "hit"
+			}
+			metrics.CacheRequests.Inc("browser", result)
+		}
+	})
+}
+
+// metricsServer serves /metrics for Prometheus on addr.
+func metricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	logger.Info("serving metrics", "addr", addr)
+	return &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+}
@@ -0,0 +1,59 @@
+package deploy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"zenith/shared/metrics"
+)
+
+func TestInstrumentSite(t *testing.T) {
+	dir := writeSite(t, map[string]string{"index.html": "<h1>hi</h1>"})
+	site := instrumentSite("metrics-site", newStaticHandler(context.Background(), dir))
+
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		site.ServeHTTP(rec, req)
+		return rec
+	}
+	etag := get("/", "").Header().Get("ETag")
+	get("/", etag)
+	// Unknown paths fall back to index.html.
+	get("/about", "")
+
+	hits := metrics.CacheRequests.Value("browser", "hit")
+	if n := siteRequests.Value("metrics-site", "200"); n != 2 {
+		t.Errorf("%v requests with 200, want 2", n)
+	}
+	if n := siteRequests.Value("metrics-site", "304"); n != 1 {
+		t.Errorf("%v requests with 304, want 1", n)
+	}
+	if n := siteLatency.Count("metrics-site"); n != 3 {
+		t.Errorf("%d latencies observed, want 3", n)
+	}
+	if hits != 1 {
+		t.Errorf("%v browser cache hits, want 1", hits)
+	}
+}
+
+func TestRecordDeployOutcome(t *testing.T) {
+	before := deploysTotal.Value("failure", "build")
+	recordDeployOutcome(http.StatusInternalServerError, "build")
+	recordDeployOutcome(http.StatusUnprocessableEntity, "secrets")
+	recordDeployOutcome(http.StatusOK, "publish")
+	if n := deploysTotal.Value("failure", "build") - before; n != 1 {
+		t.Errorf("%v build failures counted, want 1", n)
+	}
+	if n := deploysTotal.Value("blocked", "secrets"); n != 1 {
+		t.Errorf("%v blocked deploys, want 1", n)
+	}
+	if n := deploysTotal.Value("success", "none"); n != 1 {
+		t.Errorf("%v successful deploys, want 1", n)
+	}
+}
@@ -0,0 +1,475 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/apierr"
+	"zenith/shared/archive"
+	"zenith/shared/lifecycle"
+	"zenith/shared/logging"
+	"zenith/shared/manifest"
+	"zenith/shared/redact"
+	"zenith/shared/storage"
+	"zenith/shared/tracing"
+)
+
+// pipelineStages are the stages of a deploy in order.
+var pipelineStages = []string{"upload", "secrets", "build", "download", "extract", "publish"}
+
+// checkpoints are the stages whose output is kept in storage: a run resumed
+// after a restart, or retried after failing, starts after the last of them
+// that completed. The other stages work on local files and are run again.
+var checkpoints = []string{"upload", "build"}
+
+// maxResumes bounds how often a run is resumed, so that a deploy which
+// brings the API down is not retried forever.
+const maxResumes = 3
+
+// stageCodes are the apierr codes of the stages, for errors that do not
+// carry one of their own.
+var stageCodes = map[string]string{
+	"upload":   apierr.CodeInternal,
+	"secrets":  apierr.CodeBlocked,
+	"build":    apierr.CodeInternal,
+	"download": apierr.CodeStorage,
+	"extract":  apierr.CodeBuildFailed,
+	"publish":  apierr.CodeInternal,
+}
+
+var errDeployBlocked = errors.New("Deploy blocked: the repository contains possible secrets; remove them or list the files in .zenithignore")
+
+var (
+	// serveCtx is done once the API starts shutting down.
+	serveCtx = context.Background()
+	// resuming counts the interrupted runs being resumed.
+	resuming sync.WaitGroup
+)
+
+// shuttingDown reports whether a stage run with ctx was cancelled because
+// the API is shutting down rather than because it failed.
+func shuttingDown(ctx context.Context) bool {
+	return ctx.Err() != nil && serveCtx.Err() != nil
+}
+
+// pipeline is one run of the deploy stages.
+type pipeline struct {
+	run DeployRun
+	// token clones the repository in the upload stage.
+	token string
+
+	// manifest lists the stored build output. Runs whose build predates
+	// manifests have buildArchive instead, the build archive open in
+	// storage from download until the pipeline ends.
+	manifest     *manifest.Manifest
+	buildArchive storage.Object
+	buildDir     string
+	stripped     []string
+	previous     Deployment
+	deployment   *Deployment
+}
+
+// runPipeline runs the stages of run that have not completed and records
+// its progress in runs. It stops at the first stage that fails, returning
+// its error as an *apierr.Error, and marks the run failed, unless the stage
+// was cancelled by shutdown: the run is then left running for the next
+// start to resume.
+func runPipeline(ctx context.Context, run DeployRun, token string) (*pipeline, error) {
+	p := &pipeline{run: run, token: token}
+	defer p.closeArchive()
+	for _, stage := range pipelineStages {
+		if p.run.done(stage) {
+			continue
+		}
+		p.run.Stage = stage
+		p.save()
+
+		stageCtx, done := tracing.Stage(ctx, "request_handler", stage)
+		err := p.runStage(stageCtx, stage)
+		done(err)
+		if err != nil {
+			err = apierr.Wrap(err, stageCodes[stage], stage)
+			if shuttingDown(ctx) {
+				logger.WarnContext(ctx, "deploy interrupted by shutdown", "repo", p.run.Repo, "stage", stage)
+				return p, err
+			}
+			e := err.(*apierr.Error)
+			p.run.Status = RunFailed
+			p.run.Error = redact.String(e.Message)
+			p.run.Code, p.run.Retryable = e.Code, e.Retryable
+			p.save()
+			return p, err
+		}
+		p.run.Completed = append(p.run.Completed, stage)
+		p.save()
+	}
+	p.run.Status = RunSucceeded
+	p.save()
+	return p, nil
+}
+
+// save records the progress of p. Failing to is logged: the deploy itself
+// can go on.
+func (p *pipeline) save() {
+	if _, err := runs.update(p.run.ID, func(r *DeployRun) { *r = p.run }); err != nil {
+		logger.Warn("failed to record deploy run", "deployment_id", p.run.ID, "error", err)
+	}
+}
+
+func (p *pipeline) runStage(ctx context.Context, stage string) error {
+	switch stage {
+	case "upload":
+		return p.upload(ctx)
+	case "secrets":
+		return p.checkSecrets(ctx)
+	case "build":
+		return p.build(ctx)
+	case "download":
+		return p.download(ctx)
+	case "extract":
+		return p.extract(ctx)
+	case "publish":
+		return p.publish(ctx)
+	}
+	return fmt.Errorf("unknown stage %q", stage)
+}
+
+// upload has the repository stored for the build.
+func (p *pipeline) upload(ctx context.Context) error {
+	logger.InfoContext(ctx, "uploading repository", "url", p.run.Source, "repo", p.run.Repo)
+	deployData, err := uploader.Upload(ctx, p.run.Source, p.token)
+	if err != nil {
+		return err
+	}
+	logger.InfoContext(ctx, "repository uploaded", "repo", deployData.Repo, "file", deployData.File, "secrets", len(deployData.Secrets))
+
+	// The project checked by the caller is the one that gets built and
+	// served
+	if deployData.Repo != p.run.Repo {
+		if deployData.Repo != "" {
+			logger.WarnContext(ctx, "upload returned another repo name", "returned", deployData.Repo, "url", p.run.Source, "repo", p.run.Repo)
+		}
+		deployData.Repo = p.run.Repo
+	}
+	p.run.Upload = deployData
+	return nil
+}
+
+// checkSecrets blocks the deploy when secrets were found and the project's
+// policy says so.
+func (p *pipeline) checkSecrets(ctx context.Context) error {
+	if len(p.run.Upload.Secrets) == 0 {
+		return nil
+	}
+	logger.WarnContext(ctx, "possible secrets found", "repo", p.run.Repo, "count", len(p.run.Upload.Secrets))
+	if project, _ := teams.project(p.run.Repo); project.SecretPolicy.Block {
+		return errDeployBlocked
+	}
+	return nil
+}
+
+func (p *pipeline) build(ctx context.Context) error {
+	buildResult, err := builder.Build(ctx, BuildRequest{
+		Repo:        p.run.Repo,
+		Source:      p.run.Upload.File,
+		UseTemplate: cfg.RequestHandler.UseTemplate,
+		Template:    cfg.RequestHandler.Template,
+	})
+	if err != nil {
+		return err
+	}
+	p.run.Build = buildResult
+	return nil
+}
+
+// download loads the manifest of the build, or opens the build archive in
+// storage for builds stored before manifests. extract reads the archive
+// from there as it goes, without a copy on disk.
+func (p *pipeline) download(ctx context.Context) error {
+	if p.run.Build != nil && p.run.Build.Manifest != "" {
+		logger.InfoContext(ctx, "loading build manifest", "manifest", p.run.Build.Manifest, "store", store.Describe())
+		m, err := manifest.Load(ctx, store, p.run.Build.Manifest)
+		if err != nil {
+			return fmt.Errorf("Loading build manifest failed: %w", err)
+		}
+		if len(m.Files) == 0 {
+			return errors.New("Build manifest lists no files")
+		}
+		p.manifest = m
+		return nil
+	}
+
+	fileName := p.run.Repo + "-build.zip" // Default file name
+	if p.run.Upload.File != "" {
+		fileName = p.run.Upload.File
+	}
+
+	logger.InfoContext(ctx, "opening build archive", "object", fileName, "store", store.Describe())
+	obj, err := store.Open(ctx, fileName)
+	if err != nil {
+		return fmt.Errorf("Download failed: %w", err)
+	}
+	if obj.Size() == 0 {
+		obj.Close()
+		return errors.New("Build archive is empty")
+	}
+	p.buildArchive = obj
+	return nil
+}
+
+func (p *pipeline) closeArchive() {
+	if p.buildArchive != nil {
+		p.buildArchive.Close()
+		p.buildArchive = nil
+	}
+}
+
+// extract writes the files of the build manifest, or unzips the build
+// archive and builds it again when it holds a package.json, into a staging
+// directory of the run's own, and then moves it to the deployed directory
+// in place of the previous deploy.
+func (p *pipeline) extract(ctx context.Context) error {
+	staging, err := scratch.Mkdir(ctx, p.run.Repo)
+	if err != nil {
+		return fmt.Errorf("Failed to create staging directory: %w", err)
+	}
+	defer scratch.Remove(staging)
+
+	var output string
+	if p.manifest != nil {
+		logger.InfoContext(ctx, "writing build files", "files", len(p.manifest.Files), "dest", staging)
+		if err := manifest.Materialize(ctx, store, p.manifest, staging); err != nil {
+			return apierr.Wrap(fmt.Errorf("Fetching build files failed: %w", err), apierr.CodeStorage, "extract")
+		}
+	} else {
+		logger.InfoContext(ctx, "extracting build archive", "bytes", p.buildArchive.Size(), "dest", staging)
+		if err := archive.ExtractAt(p.buildArchive, p.buildArchive.Size(), staging, archive.DefaultLimits); err != nil {
+			return fmt.Errorf("Unzip failed: %w", err)
+		}
+		p.closeArchive()
+
+		if output, err = p.buildSite(ctx, staging); err != nil {
+			return err
+		}
+	}
+
+	unzipPath, err := installSite(staging, p.run.Repo)
+	if err != nil {
+		return fmt.Errorf("Failed to install site: %w", err)
+	}
+	p.buildDir = filepath.Join(unzipPath, output)
+	return nil
+}
+
+// buildSite builds the site extracted to dir if it holds a package.json,
+// and returns the directory below dir to serve.
+func (p *pipeline) buildSite(ctx context.Context, dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, "package.json")); err != nil {
+		return "", nil
+	}
+	logger.InfoContext(ctx, "found package.json, building the project")
+
+	// Install dependencies
+	installCmd := lifecycle.Command(ctx, "npm", "install")
+	installCmd.Dir = dir
+	stageCtx, done := tracing.Stage(ctx, "request_handler", "npm_install")
+	err := runCommand(stageCtx, installCmd)
+	done(err)
+	if err != nil {
+		logger.WarnContext(ctx, "npm install failed", "error", err)
+		return "", ctx.Err()
+	}
+
+	// Build the project
+	buildCmd := lifecycle.Command(ctx, "npm", "run", "build")
+	buildCmd.Dir = dir
+	stageCtx, done = tracing.Stage(ctx, "request_handler", "npm_build")
+	err = runCommand(stageCtx, buildCmd)
+	done(err)
+	if err != nil {
+		logger.WarnContext(ctx, "npm build failed", "error", err)
+		return "", ctx.Err()
+	}
+
+	// Check for common build output directories
+	for _, output := range []string{"dist", "build", "out"} {
+		if _, err := os.Stat(filepath.Join(dir, output)); err == nil {
+			logger.InfoContext(ctx, "using build directory", "dir", output)
+			return output, nil
+		}
+	}
+	return "", nil
+}
+
+// installSite moves the site built in staging to the deployed directory of
+// repo, replacing the one there, and returns its new path.
+func installSite(staging, repo string) (string, error) {
+	target := filepath.Join(cfg.RequestHandler.DeployedDir, repo)
+	previous := staging + ".previous"
+	scratch.Add(previous)
+	defer scratch.Remove(previous)
+	if err := os.Rename(target, previous); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := os.Rename(staging, target); err != nil {
+		os.Rename(previous, target)
+		return "", err
+	}
+	return target, nil
+}
+
+// publish serves the site on its own port, opens a tunnel to it and routes
+// the project's custom domains to it. Builds stored as manifests are also
+// released to edge servers.
+func (p *pipeline) publish(ctx context.Context) error {
+	project, _ := teams.project(p.run.Repo)
+	if project.SecretPolicy.StripDotfiles {
+		var err error
+		if p.stripped, err = stripDotfiles(p.buildDir); err != nil {
+			return fmt.Errorf("Stripping dotfiles failed: %w", err)
+		}
+		if len(p.stripped) > 0 {
+			logger.InfoContext(ctx, "stripped dotfiles", "repo", p.run.Repo, "count", len(p.stripped))
+		}
+	}
+
+	if p.manifest != nil {
+		release := manifest.Release{
+			Repo:          p.run.Repo,
+			DeploymentID:  p.run.ID,
+			Manifest:      p.run.Build.Manifest,
+			StripDotfiles: project.SecretPolicy.StripDotfiles,
+		}
+		if err := manifest.Publish(ctx, store, release); err != nil {
+			return apierr.Wrap(fmt.Errorf("Releasing the deploy failed: %w", err), apierr.CodeStorage, "publish")
+		}
+	}
+
+	p.previous, _ = deployments.forRepo(p.run.Repo)
+	site := instrumentSite(p.run.Repo, newStaticHandler(ctx, p.buildDir))
+	deployment, err := startDeployment(ctx, p.run.ID, p.run.Repo, site, p.run.Upload.Secrets)
+	if err != nil {
+		return err
+	}
+	p.deployment = deployment
+	sites.set(p.run.Repo, site)
+	return nil
+}
+
+// audit returns the audit entry for the outcome of p, attributed to the
+// caller who started the run, with its before and after summaries. ok is
+// false for outcomes that are not audited.
+func (p *pipeline) audit(err error) (e AuditEntry, before, after any, ok bool) {
+	switch {
+	case err == nil:
+		e = projectAudit("deploy", p.deployment.ID, p.run.Repo)
+		if p.previous.ID != "" {
+			before = gin.H{"deployment_id": p.previous.ID, "public_url": p.previous.PublicURL}
+		}
+		summary := gin.H{
+			"deployment_id": p.deployment.ID,
+			"public_url":    p.deployment.PublicURL,
+			"source":        p.run.Source,
+			"secrets":       len(p.run.Upload.Secrets),
+		}
+		if p.run.RollbackOf != "" {
+			e.Action = "deploy.rollback"
+			summary["rollback_of"] = p.run.RollbackOf
+		}
+		after = summary
+	case errors.Is(err, errDeployBlocked):
+		e = projectAudit("deploy.blocked", p.run.Repo, p.run.Repo)
+		after = gin.H{"source": p.run.Source, "secrets": len(p.run.Upload.Secrets)}
+	default:
+		return AuditEntry{}, nil, nil, false
+	}
+	e.ActorID, e.Actor, e.KeyID = p.run.ActorID, p.run.Actor, p.run.KeyID
+	return e, before, after, true
+}
+
+// recordOutcome counts the outcome of a run that is not answering a
+// request.
+func (p *pipeline) recordOutcome(err error) {
+	switch {
+	case err == nil:
+		deploysTotal.Inc("success", "none")
+	case errors.Is(err, errDeployBlocked):
+		deploysTotal.Inc("blocked", p.run.Stage)
+	default:
+		deploysTotal.Inc("failure", p.run.Stage)
+	}
+}
+
+// recoverRuns deals with the runs a previous process left running. Runs
+// whose source was uploaded are resumed one after another in the
+// background from their last checkpoint, until ctx is cancelled; the
+// others would need the caller's GitHub token again and are marked failed.
+func recoverRuns(ctx context.Context) {
+	var resume []DeployRun
+	for _, run := range runs.interrupted() {
+		if !run.done("upload") || run.Resumed >= maxResumes {
+			reason := "interrupted by a restart before the source was uploaded; deploy again"
+			if run.Resumed >= maxResumes {
+				reason = fmt.Sprintf("interrupted by %d restarts; deploy again", run.Resumed+1)
+			}
+			runs.update(run.ID, func(r *DeployRun) {
+				r.Status = RunFailed
+				r.Error = reason
+				r.Code, r.Retryable = apierr.CodeInterrupted, true
+			})
+			deploysTotal.Inc("failure", run.Stage)
+			logger.Warn("marked interrupted deploy failed", "deployment_id", run.ID, "repo", run.Repo, "stage", run.Stage, "reason", reason)
+			continue
+		}
+		run, err := runs.update(run.ID, func(r *DeployRun) {
+			r.Resumed++
+			r.rewind()
+		})
+		if err != nil {
+			logger.Warn("failed to record deploy run", "deployment_id", run.ID, "error", err)
+			continue
+		}
+		resume = append(resume, run)
+	}
+	if len(resume) == 0 {
+		return
+	}
+
+	resuming.Add(1)
+	go func() {
+		defer resuming.Done()
+		for _, run := range resume {
+			if ctx.Err() != nil {
+				return
+			}
+			resumeRun(ctx, run)
+		}
+	}()
+}
+
+// resumeRun runs the remaining stages of an interrupted run.
+func resumeRun(ctx context.Context, run DeployRun) {
+	ctx = logging.WithDeploymentID(ctx, run.ID)
+	logger.InfoContext(ctx, "resuming interrupted deploy", "repo", run.Repo, "completed", run.Completed)
+	deploysInProgress.Inc()
+	defer deploysInProgress.Dec()
+
+	p, err := runPipeline(ctx, run, "")
+	if shuttingDown(ctx) {
+		return
+	}
+	p.recordOutcome(err)
+	if e, before, after, ok := p.audit(err); ok {
+		appendAudit(ctx, e, before, after)
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "resumed deploy failed", "repo", run.Repo, "stage", p.run.Stage, "error", err)
+		return
+	}
+	logger.InfoContext(ctx, "resumed deploy finished", "repo", run.Repo, "public_url", p.deployment.PublicURL)
+}
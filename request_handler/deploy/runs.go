@@ -0,0 +1,187 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"zenith/shared/auth"
+)
+
+// Run statuses. A run is running from the deploy request until it succeeds
+// or fails; a run still running when the API starts was interrupted.
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// ErrRunNotFailed is returned when retrying a deploy that did not fail.
+var ErrRunNotFailed = errors.New("only failed deploys can be retried")
+
+// maxFinishedRuns is how many finished runs are kept.
+const maxFinishedRuns = 200
+
+// DeployRun is the progress of one deploy through the pipeline stages.
+type DeployRun struct {
+	// ID is the ID the deployment is published under.
+	ID     string `json:"id"`
+	Repo   string `json:"repo"`
+	Source string `json:"source"`
+	// RollbackOf is the deployment whose build a rollback serves again.
+	RollbackOf string `json:"rollback_of,omitempty"`
+	ActorID    string `json:"actor_id,omitempty"`
+	Actor      string `json:"actor,omitempty"`
+	KeyID      string `json:"key_id,omitempty"`
+	Status     string `json:"status"`
+	// Stage is the stage running, or the one that failed.
+	Stage     string   `json:"stage"`
+	Completed []string `json:"completed,omitempty"`
+	// Error, Code and Retryable describe the failure of a failed run, as
+	// in an apierr.Error.
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+	// Upload and Build are the results of those stages, which a resumed
+	// run starts from.
+	Upload *DeployResponse `json:"upload,omitempty"`
+	Build  *BuildResult    `json:"build,omitempty"`
+	// Resumed counts the restarts the run was resumed after, and Retries
+	// the times it was retried after failing.
+	Resumed   int       `json:"resumed,omitempty"`
+	Retries   int       `json:"retries,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// done reports whether stage completed.
+func (r *DeployRun) done(stage string) bool {
+	return slices.Contains(r.Completed, stage)
+}
+
+// rewind forgets the completed stages whose output is not in storage, so
+// that they run again.
+func (r *DeployRun) rewind() {
+	r.Completed = slices.DeleteFunc(r.Completed, func(s string) bool { return !slices.Contains(checkpoints, s) })
+}
+
+// runStore keeps deploy runs in ./data/runs.json, so that a restart knows
+// which deploys it interrupted and how far they got.
+type runStore struct {
+	mu   sync.Mutex
+	path string
+	runs map[string]*DeployRun
+}
+
+var runs *runStore
+
+func loadRunStore(path string) (*runStore, error) {
+	s := &runStore{path: path, runs: map[string]*DeployRun{}}
+	var list []*DeployRun
+	if err := loadJSON(path, &list); err != nil {
+		return nil, fmt.Errorf("failed to load deploy runs: %w", err)
+	}
+	for _, r := range list {
+		s.runs[r.ID] = r
+	}
+	return s, nil
+}
+
+// saveLocked writes the running runs and the newest finished ones.
+func (s *runStore) saveLocked() error {
+	list := make([]*DeployRun, 0, len(s.runs))
+	for _, r := range s.runs {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	finished := 0
+	for _, r := range list {
+		if r.Status != RunRunning {
+			if finished++; finished > maxFinishedRuns {
+				delete(s.runs, r.ID)
+			}
+		}
+	}
+	list = slices.DeleteFunc(list, func(r *DeployRun) bool { return s.runs[r.ID] == nil })
+	return saveJSON(s.path, list)
+}
+
+func copyRun(r *DeployRun) DeployRun {
+	c := *r
+	c.Completed = slices.Clone(r.Completed)
+	return c
+}
+
+// start records r as running.
+func (s *runStore) start(r DeployRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.Status = RunRunning
+	r.StartedAt = time.Now().UTC()
+	r.UpdatedAt = r.StartedAt
+	s.runs[r.ID] = &r
+	return s.saveLocked()
+}
+
+// update applies fn to run id and saves it.
+func (s *runStore) update(id string, fn func(*DeployRun)) (DeployRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.runs[id]
+	if !ok {
+		return DeployRun{}, ErrDeploymentNotFound
+	}
+	fn(r)
+	r.UpdatedAt = time.Now().UTC()
+	return copyRun(r), s.saveLocked()
+}
+
+func (s *runStore) get(id string) (DeployRun, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.runs[id]
+	if !ok {
+		return DeployRun{}, false
+	}
+	return copyRun(r), true
+}
+
+// retry marks failed run id running again, as started by p, from its first
+// stage that did not leave its output in storage.
+func (s *runStore) retry(id string, p *auth.Principal) (DeployRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.runs[id]
+	if !ok {
+		return DeployRun{}, ErrDeploymentNotFound
+	}
+	if r.Status != RunFailed {
+		return DeployRun{}, ErrRunNotFailed
+	}
+	r.Status = RunRunning
+	r.Error, r.Code, r.Retryable = "", "", false
+	r.Retries++
+	r.rewind()
+	if p != nil {
+		r.ActorID, r.Actor, r.KeyID = p.UserID, p.Email, p.KeyID
+	}
+	r.UpdatedAt = time.Now().UTC()
+	return copyRun(r), s.saveLocked()
+}
+
+// interrupted returns the runs still marked running, oldest first.
+func (s *runStore) interrupted() []DeployRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []DeployRun
+	for _, r := range s.runs {
+		if r.Status == RunRunning {
+			result = append(result, copyRun(r))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].StartedAt.Before(result[j].StartedAt) })
+	return result
+}
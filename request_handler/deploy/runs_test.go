@@ -0,0 +1,281 @@
+package deploy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/apierr"
+	"zenith/shared/auth"
+	"zenith/shared/config"
+	"zenith/shared/lifecycle"
+	"zenith/shared/manifest"
+	"zenith/shared/storage"
+)
+
+type fakeUploader struct{}
+
+func (fakeUploader) Upload(context.Context, string, string) (*DeployResponse, error) {
+	return nil, errors.New("upload should not run again")
+}
+
+// fakeBuilder fails its first failures builds and records the sources it
+// was asked to build.
+type fakeBuilder struct {
+	builds   int
+	failures int
+	sources  []string
+}
+
+func (b *fakeBuilder) Build(_ context.Context, req BuildRequest) (*BuildResult, error) {
+	b.builds++
+	b.sources = append(b.sources, req.Source)
+	if b.builds <= b.failures {
+		return nil, errors.New("POST to build_service: connection reset")
+	}
+	return &BuildResult{Status: "success"}, nil
+}
+
+// storeBuildArchive stores a build archive holding an index.html as key in
+// s.
+func storeBuildArchive(t *testing.T, s storage.Store, key string) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	fw, _ := w.Create("index.html")
+	fw.Write([]byte("<h1>resumed</h1>"))
+	w.Close()
+	if err := s.Put(context.Background(), key, &buf, int64(buf.Len()), "application/zip"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setupPipeline points the package at stores in a temporary directory, an
+// uploader that must not be called and b, and stores a build archive for
+// repo.
+func setupPipeline(t *testing.T, b Builder, repo string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	var err error
+	cfg = config.Default()
+	cfg.RequestHandler.DeployedDir = filepath.Join(dir, "deployed")
+	if scratch, err = lifecycle.OpenScratch(filepath.Join(cfg.RequestHandler.DeployedDir, stagingDir)); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = storage.New(config.StorageConfig{Backend: "local", LocalDir: filepath.Join(dir, "storage")}); err != nil {
+		t.Fatal(err)
+	}
+	if teams, err = loadTeamStore(filepath.Join(dir, "teams.json")); err != nil {
+		t.Fatal(err)
+	}
+	if runs, err = loadRunStore(filepath.Join(dir, "runs.json")); err != nil {
+		t.Fatal(err)
+	}
+	uploader, builder, tunnelProvider = fakeUploader{}, b, &noneProvider{}
+	t.Cleanup(deployments.closeAll)
+	storeBuildArchive(t, store, repo+"-build.zip")
+}
+
+func TestRecoverRuns(t *testing.T) {
+	b := &fakeBuilder{}
+	setupPipeline(t, b, "resumed-site")
+
+	// One run was interrupted while cloning, the other while extracting
+	// its build after the upload completed.
+	runs.start(DeployRun{ID: "cloning", Repo: "lost-site", Source: "https://github.com/o/lost-site", Stage: "upload"})
+	runs.start(DeployRun{ID: "extracting", Repo: "resumed-site", Source: "https://github.com/o/resumed-site"})
+	runs.update("extracting", func(r *DeployRun) {
+		r.Stage = "extract"
+		r.Completed = []string{"upload", "secrets", "download"}
+		r.Upload = &DeployResponse{Repo: "resumed-site"}
+	})
+
+	// Reload as a restart would.
+	var err error
+	if runs, err = loadRunStore(runs.path); err != nil {
+		t.Fatal(err)
+	}
+	recoverRuns(context.Background())
+	if !lifecycle.Wait(&resuming, 10*time.Second) {
+		t.Fatal("resumed runs did not finish")
+	}
+
+	lost, _ := runs.get("cloning")
+	if lost.Status != RunFailed || lost.Error == "" {
+		t.Errorf("run interrupted before upload: status %q, error %q", lost.Status, lost.Error)
+	}
+	resumed, _ := runs.get("extracting")
+	if resumed.Status != RunSucceeded || resumed.Resumed != 1 {
+		t.Errorf("resumed run: status %q, resumed %d, error %q", resumed.Status, resumed.Resumed, resumed.Error)
+	}
+	// The build never completed, so it runs again; the upload does not.
+	if b.builds != 1 {
+		t.Errorf("%d builds, want 1", b.builds)
+	}
+	if d, ok := deployments.forRepo("resumed-site"); !ok || d.ID != "extracting" {
+		t.Errorf("deployment = %+v, %v", d, ok)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.RequestHandler.DeployedDir, "resumed-site", "index.html")); err != nil {
+		t.Errorf("site not installed: %v", err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(cfg.RequestHandler.DeployedDir, stagingDir, "extracting-*")); len(left) > 0 {
+		t.Errorf("staging directories left: %v", left)
+	}
+}
+
+func TestRetryFailedRun(t *testing.T) {
+	b := &fakeBuilder{failures: 1}
+	setupPipeline(t, b, "retried-site")
+	source := manifest.SourceKey("retried-site", "flaky")
+	storeBuildArchive(t, store, source)
+	runs.start(DeployRun{ID: "flaky", Repo: "retried-site"})
+	run, _ := runs.update("flaky", func(r *DeployRun) {
+		r.Completed = []string{"upload", "secrets"}
+		r.Upload = &DeployResponse{Repo: "retried-site", File: source}
+	})
+
+	if _, err := runPipeline(context.Background(), run, ""); err == nil {
+		t.Fatal("build failure not reported")
+	}
+	failed, _ := runs.get("flaky")
+	if failed.Status != RunFailed || failed.Stage != "build" || failed.Code != apierr.CodeInternal {
+		t.Fatalf("run after failing: status %q, stage %q, code %q", failed.Status, failed.Stage, failed.Code)
+	}
+
+	run, err := runs.retry("flaky", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runs.retry("flaky", nil); !errors.Is(err, ErrRunNotFailed) {
+		t.Errorf("retrying a running deploy: err = %v", err)
+	}
+	p, err := runPipeline(context.Background(), run, "")
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if p.run.Status != RunSucceeded || p.run.Retries != 1 || b.builds != 2 {
+		t.Errorf("after retry: status %q, retries %d, builds %d", p.run.Status, p.run.Retries, b.builds)
+	}
+	// The retry builds the source the run's upload stored, not whatever
+	// another deploy of the project uploaded since.
+	for _, s := range b.sources {
+		if s != source {
+			t.Errorf("built %q, want %q", s, source)
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	setupPipeline(t, &fakeBuilder{}, "site")
+	keys := setupRBAC(t)
+	ctx := context.Background()
+	for _, id := range []string{"v1", "v2"} {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>"+id+"</h1>"), 0644)
+		os.WriteFile(filepath.Join(dir, "app.js"), []byte("app()"), 0644)
+		if _, _, err := manifest.Build(ctx, store, dir, "site", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page := func() string {
+		data, _ := os.ReadFile(filepath.Join(cfg.RequestHandler.DeployedDir, "site", "index.html"))
+		return string(data)
+	}
+
+	// v2 is deployed from its manifest as a build would leave it.
+	runs.start(DeployRun{ID: "v2", Repo: "site"})
+	run, _ := runs.update("v2", func(r *DeployRun) {
+		r.Completed = []string{"upload", "secrets", "build"}
+		r.Upload = &DeployResponse{Repo: "site"}
+		r.Build = &BuildResult{Status: "success", Manifest: manifest.Key("site", "v2")}
+	})
+	if _, err := runPipeline(ctx, run, ""); err != nil {
+		t.Fatal(err)
+	}
+	if page() != "<h1>v2</h1>" {
+		t.Fatalf("deployed page = %q", page())
+	}
+
+	r := gin.New()
+	r.POST("/projects/:name/rollback", auth.Require(users, auth.ScopeDeploy), handleRollback)
+	rollback := func(who, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/projects/site/rollback", strings.NewReader(`{"deployment_id":"`+id+`"}`))
+		req.Header.Set("Authorization", "Bearer "+keys[who])
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := rollback("viewer", "v1"); rec.Code != http.StatusForbidden {
+		t.Errorf("viewer: status %d", rec.Code)
+	}
+	if rec := rollback("deployer", "v0"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown deployment: status %d", rec.Code)
+	}
+	rec := rollback("deployer", "v1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rollback: status %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		DeploymentID string `json:"deployment_id"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rolled, _ := runs.get(body.DeploymentID); rolled.RollbackOf != "v1" || rolled.Status != RunSucceeded {
+		t.Errorf("rollback run = %+v", rolled)
+	}
+	if page() != "<h1>v1</h1>" {
+		t.Errorf("page after rollback = %q", page())
+	}
+	if release, err := manifest.LoadRelease(ctx, store, "site"); err != nil || release.Manifest != manifest.Key("site", "v1") {
+		t.Errorf("release after rollback = %+v, %v", release, err)
+	}
+
+	// app.js is stored once for both deployments.
+	r.GET("/projects/:name/usage", auth.Require(users, auth.ScopeRead), handleProjectUsage)
+	req := httptest.NewRequest(http.MethodGet, "/projects/site/usage", nil)
+	req.Header.Set("Authorization", "Bearer "+keys["viewer"])
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	var usage struct {
+		Usage manifest.Usage `json:"usage"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &usage)
+	if rec.Code != http.StatusOK || usage.Usage.Manifests != 2 || usage.Usage.Blobs != 3 {
+		t.Errorf("usage: status %d, %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRunStoreKeepsRecentFinishedRuns(t *testing.T) {
+	s, err := loadRunStore(filepath.Join(t.TempDir(), "runs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.start(DeployRun{ID: "running"})
+	for i := 0; i < maxFinishedRuns+5; i++ {
+		id := fmt.Sprintf("run-%d", i)
+		s.start(DeployRun{ID: id})
+		s.update(id, func(r *DeployRun) { r.Status = RunFailed })
+	}
+
+	s, err = loadRunStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.runs); n != maxFinishedRuns+1 {
+		t.Errorf("%d runs kept, want %d", n, maxFinishedRuns+1)
+	}
+	if _, ok := s.get("running"); !ok {
+		t.Error("running run dropped")
+	}
+}
@@ -0,0 +1,71 @@
+package deploy
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upload scans every repository for credentials before it is built. The
+// findings are reported with the deploy and kept on the deployment; a
+// project's secret policy decides whether they block it and whether
+// dotfiles are removed from what gets published.
+
+// SecretPolicy is what a project does about secrets in its repository.
+type SecretPolicy struct {
+	// Block refuses to build a repository in which secrets were found.
+	Block bool `json:"block"`
+	// StripDotfiles removes files and directories whose names start with a
+	// dot, other than .well-known, from the publish directory.
+	StripDotfiles bool `json:"strip_dotfiles"`
+}
+
+// stripDotfiles removes dotfiles from dir and returns their paths relative
+// to it.
+func stripDotfiles(dir string) ([]string, error) {
+	var removed []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if p == dir || !strings.HasPrefix(name, ".") || (name == ".well-known" && d.IsDir()) {
+			return nil
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		removed = append(removed, filepath.ToSlash(rel))
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func handleSetSecretPolicy(c *gin.Context) {
+	name := c.Param("name")
+	var policy SecretPolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !requireProjectRole(c, name, RoleMaintainer) {
+		return
+	}
+	before, _ := teams.project(name)
+	project, err := teams.setSecretPolicy(name, policy)
+	if err != nil {
+		teamError(c, err)
+		return
+	}
+	logger.InfoContext(c.Request.Context(), "set secret policy", "project", name, "block", policy.Block, "strip_dotfiles", policy.StripDotfiles)
+	recordAudit(c, projectAudit("project.secret_policy", name, name), before.SecretPolicy, project.SecretPolicy)
+	c.JSON(http.StatusOK, gin.H{"project": project})
+}
@@ -0,0 +1,74 @@
+package deploy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/auth"
+)
+
+func TestStripDotfiles(t *testing.T) {
+	dir := writeSite(t, map[string]string{
+		"index.html":               "<h1>hi</h1>",
+		".env":                     "SECRET=1",
+		".git/config":              "",
+		"assets/.DS_Store":         "",
+		"assets/app.js":            "",
+		".well-known/security.txt": "Contact: mailto:security@example.com",
+		".well-known/.htpasswd":    "admin:x",
+		"_redirects":               "/old /new 301",
+	})
+
+	removed, err := stripDotfiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(removed)
+	if want := []string{".env", ".git", ".well-known/.htpasswd", "assets/.DS_Store"}; !slices.Equal(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+	for _, kept := range []string{"index.html", "assets/app.js", ".well-known/security.txt", "_redirects"} {
+		if _, err := os.Stat(filepath.Join(dir, kept)); err != nil {
+			t.Errorf("%s was removed", kept)
+		}
+	}
+}
+
+func TestSetSecretPolicy(t *testing.T) {
+	keys := setupRBAC(t)
+
+	r := gin.New()
+	r.PUT("/projects/:name/secret-policy", auth.Require(users, auth.ScopeDeploy), handleSetSecretPolicy)
+	put := func(who, project string) int {
+		req := httptest.NewRequest(http.MethodPut, "/projects/"+project+"/secret-policy", strings.NewReader(`{"block":true,"strip_dotfiles":true}`))
+		req.Header.Set("Authorization", "Bearer "+keys[who])
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := put("deployer", "site"); code != http.StatusForbidden {
+		t.Errorf("deployer: status %d", code)
+	}
+	if code := put("maintainer", "missing"); code != http.StatusNotFound {
+		t.Errorf("missing project: status %d", code)
+	}
+	if code := put("maintainer", "site"); code != http.StatusOK {
+		t.Fatalf("maintainer: status %d", code)
+	}
+
+	// The policy is saved with the project.
+	reloaded, err := loadTeamStore(teams.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := reloaded.project("site"); !p.SecretPolicy.Block || !p.SecretPolicy.StripDotfiles {
+		t.Errorf("policy = %+v", p.SecretPolicy)
+	}
+}
@@ -0,0 +1,247 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"zenith/shared/apierr"
+	"zenith/shared/auth"
+	"zenith/shared/health"
+	"zenith/shared/logging"
+	"zenith/shared/manifest"
+	"zenith/shared/retry"
+	"zenith/shared/tracing"
+)
+
+type DeployResponse struct {
+	Repo      string          `json:"repo"`
+	Status    string          `json:"status"`
+	Message   string          `json:"message"`
+	Bucket    string          `json:"bucket"`
+	File      string          `json:"file"`
+	Timestamp string          `json:"timestamp"`
+	Packaging *Packaging      `json:"packaging,omitempty"`
+	Secrets   []SecretFinding `json:"secrets,omitempty"`
+}
+
+// Packaging is upload's summary of what went into a repository's archive.
+type Packaging struct {
+	Files        int           `json:"files"`
+	Size         int64         `json:"size"`
+	ArchiveSize  int64         `json:"archive_size"`
+	Skipped      []SkippedPath `json:"skipped"`
+	SkippedFiles int           `json:"skipped_files"`
+	SkippedSize  int64         `json:"skipped_size"`
+}
+
+// SkippedPath is a file or directory upload left out of an archive, and why.
+type SkippedPath struct {
+	Path   string `json:"path"`
+	Files  int    `json:"files"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// SecretFinding is a likely credential upload found in a repository. Match
+// only shows the start of the value.
+type SecretFinding struct {
+	Rule  string `json:"rule"`
+	Path  string `json:"path"`
+	Line  int    `json:"line"`
+	Match string `json:"match"`
+}
+
+type BuildRequest struct {
+	Repo string `json:"repo"`
+	// Source is the key of the archive upload stored, DeployResponse.File.
+	Source      string `json:"source"`
+	UseTemplate bool   `json:"use_template"`
+	Template    string `json:"template"`
+}
+
+type BuildResult struct {
+	Message     string `json:"message"`
+	Status      string `json:"status"`
+	CreatedFrom string `json:"created_from"`
+	// Manifest is the key of the manifest of the build output. Builds
+	// stored before manifests were introduced have none.
+	Manifest string          `json:"manifest,omitempty"`
+	Stored   *manifest.Stats `json:"stored,omitempty"`
+}
+
+// Uploader stores a repository's source so it can be built.
+type Uploader interface {
+	// Upload clones repoURL with token, or the uploader's own GitHub token
+	// when empty.
+	Upload(ctx context.Context, repoURL, token string) (*DeployResponse, error)
+}
+
+// Builder builds a stored repository.
+type Builder interface {
+	Build(ctx context.Context, req BuildRequest) (*BuildResult, error)
+}
+
+// HealthChecker is implemented by Uploaders and Builders whose dependencies
+// are part of request_handler's readiness.
+type HealthChecker interface {
+	HealthChecks() []health.Check
+}
+
+// serviceClient calls the internal listener of a service.
+type serviceClient struct {
+	baseURL string
+	secret  string
+	// once is set for calls that must not run twice, such as builds: they
+	// are only tried again when the service cannot have started them.
+	once bool
+}
+
+// post posts payload as JSON to path, signed with the client's secret, and
+// decodes the response into out. Error responses are returned as the
+// *apierr.Error the service answered with. Calls that could not reach the
+// service, or that it answered as unavailable, are retried; errors the
+// service retried itself are not. With once set, only calls that failed to
+// connect or that the service answered with a 503 are retried: a timeout or
+// a dropped connection may come after the service started the work.
+func (s serviceClient) post(ctx context.Context, path string, payload, out any) error {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	err = retry.Do(ctx, "POST "+path, func(ctx context.Context) error {
+		return s.try(ctx, s.baseURL+path, jsonData, out)
+	})
+	if f, ok := err.(final); ok {
+		return f.err
+	}
+	return err
+}
+
+// final is an error response not to retry, whatever it says.
+type final struct {
+	err *apierr.Error
+}
+
+func (f final) Error() string   { return f.err.Error() }
+func (f final) Transient() bool { return false }
+
+// try makes one try of post.
+func (s serviceClient) try(ctx context.Context, url string, jsonData []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := auth.Sign(req, s.secret, jsonData); err != nil {
+		return err
+	}
+	// The signature does not cover the trace context and ID headers.
+	tracing.Inject(ctx, req)
+	logging.Propagate(ctx, req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		var body []byte
+		if body, err = io.ReadAll(resp.Body); err == nil {
+			err = decodeResponse(url, resp.StatusCode, body, out)
+			if e, ok := err.(*apierr.Error); ok && s.once && resp.StatusCode != http.StatusServiceUnavailable {
+				return final{e}
+			}
+			return err
+		}
+	}
+	sent := !isDialError(err)
+	err = fmt.Errorf("POST to %s failed: %w", url, err)
+	if ctx.Err() != nil {
+		return err
+	}
+	e := apierr.Wrap(err, apierr.CodeUnavailable, "").(*apierr.Error)
+	if s.once && sent {
+		return final{e}
+	}
+	return e
+}
+
+// isDialError reports whether err is a failure to connect, before any of
+// the request was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// decodeResponse decodes a 2xx body into out and returns the error of any
+// other response.
+func decodeResponse(url string, status int, body []byte, out any) error {
+	if status < 200 || status >= 300 {
+		e := apierr.Decode(status, body)
+		e.Message = fmt.Sprintf("POST to %s: %s", url, e.Message)
+		switch e.Code {
+		case apierr.CodeUnavailable:
+			return e
+		case apierr.CodeUnauthorized, apierr.CodeForbidden:
+			// The services do not trust each other: a configuration
+			// error, not the caller's.
+			e.Code, e.Status, e.Retryable = apierr.CodeInternal, http.StatusInternalServerError, false
+		}
+		return final{e}
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return apierr.Wrap(fmt.Errorf("invalid response from %s: %v", url, err), apierr.CodeInternal, "")
+	}
+	return nil
+}
+
+// httpUploader calls upload_service.
+type httpUploader struct {
+	serviceClient
+}
+
+// NewHTTPUploader returns an Uploader that calls the internal listener of the
+// upload_service at baseURL, signing requests with secret.
+func NewHTTPUploader(baseURL, secret string) Uploader {
+	return &httpUploader{serviceClient{baseURL: baseURL, secret: secret}}
+}
+
+func (u *httpUploader) Upload(ctx context.Context, repoURL, token string) (*DeployResponse, error) {
+	var resp DeployResponse
+	if err := u.post(ctx, "/upload", map[string]string{"url": repoURL, "token": token}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// HealthChecks checks that upload_service answers on its internal listener.
+func (u *httpUploader) HealthChecks() []health.Check {
+	return []health.Check{health.HTTP("upload_service", u.baseURL+"/healthz")}
+}
+
+// httpBuilder calls build_service.
+type httpBuilder struct {
+	serviceClient
+}
+
+// NewHTTPBuilder returns a Builder that calls the internal listener of the
+// build_service at baseURL, signing requests with secret.
+func NewHTTPBuilder(baseURL, secret string) Builder {
+	return &httpBuilder{serviceClient{baseURL: baseURL, secret: secret, once: true}}
+}
+
+func (b *httpBuilder) Build(ctx context.Context, req BuildRequest) (*BuildResult, error) {
+	var resp BuildResult
+	if err := b.post(ctx, "/build", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// HealthChecks checks that build_service answers on its internal listener.
+func (b *httpBuilder) HealthChecks() []health.Check {
+	return []health.Check{health.HTTP("build_service", b.baseURL+"/healthz")}
+}
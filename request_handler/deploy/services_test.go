@@ -0,0 +1,146 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"zenith/shared/apierr"
+	"zenith/shared/config"
+	"zenith/shared/retry"
+	"zenith/shared/tracing"
+)
+
+func TestPostPropagatesTrace(t *testing.T) {
+	tp := tracing.Install(tracetest.NewInMemoryExporter(), "request_handler")
+	defer tp.Shutdown(context.Background())
+
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	ctx, done := tracing.Stage(context.Background(), "request_handler", "upload")
+	defer done(nil)
+	var out struct{}
+	if err := (serviceClient{baseURL: srv.URL, secret: "secret"}).post(ctx, "/upload", map[string]string{}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := tracing.TraceID(ctx); want == "" || len(traceparent) < 35 || traceparent[3:35] != want {
+		t.Errorf("traceparent = %q, want trace %s", traceparent, want)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	if err := retry.Setup(config.RetryConfig{Attempts: 3, BaseDelay: "1ms", MaxDelay: "1ms"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { retry.Setup(config.Default().Retry) })
+
+	tests := []struct {
+		name      string
+		responses []string
+		status    int
+		code      string
+		stage     string
+		retryable bool
+		tries     int
+	}{
+		{"structured error", []string{`{"error":"npm build failed: exit status 1","code":"build_failed","stage":"npm_build","retryable":false}`}, 422, apierr.CodeBuildFailed, "npm_build", false, 1},
+		{"not found", []string{`{"error":"repository not found","code":"not_found","stage":"download","retryable":false}`}, 404, apierr.CodeNotFound, "download", false, 1},
+		{"retryable storage error", []string{`{"error":"upload failed: SlowDown","code":"storage_error","stage":"store","retryable":true}`}, 502, apierr.CodeStorage, "store", true, 1},
+		{"unavailable until it gives up", []string{"", "", ""}, 503, apierr.CodeUnavailable, "", true, 3},
+		{"unauthorized", []string{`{"error":"invalid signature"}`}, 401, apierr.CodeInternal, "", false, 1},
+		{"plain 500", []string{"Internal Server Error"}, 500, apierr.CodeInternal, "", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tries atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.responses[tries.Load()]))
+				tries.Add(1)
+			}))
+			defer srv.Close()
+
+			result, err := NewHTTPBuilder(srv.URL, "secret").Build(context.Background(), BuildRequest{Repo: "site"})
+			var e *apierr.Error
+			if !errors.As(err, &e) {
+				t.Fatalf("Build = %+v, %v; want an *apierr.Error", result, err)
+			}
+			if e.Code != tt.code || e.Stage != tt.stage || e.Retryable != tt.retryable || int(tries.Load()) != tt.tries {
+				t.Errorf("error %+v after %d tries; want code %q, stage %q, retryable %v after %d", e, tries.Load(), tt.code, tt.stage, tt.retryable, tt.tries)
+			}
+		})
+	}
+}
+
+func TestBuildRetriesUnavailableService(t *testing.T) {
+	if err := retry.Setup(config.RetryConfig{Attempts: 3, BaseDelay: "1ms", MaxDelay: "1ms"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { retry.Setup(config.Default().Retry) })
+
+	tries := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tries++; tries == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"service shutting down","code":"unavailable","retryable":true}`))
+			return
+		}
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer srv.Close()
+
+	result, err := NewHTTPBuilder(srv.URL, "secret").Build(context.Background(), BuildRequest{Repo: "site"})
+	if err != nil || result.Status != "success" || tries != 2 {
+		t.Errorf("Build = %+v, %v after %d tries", result, err, tries)
+	}
+}
+
+func TestBuildNotRetriedOnceSent(t *testing.T) {
+	if err := retry.Setup(config.RetryConfig{Attempts: 3, BaseDelay: "1ms", MaxDelay: "1ms"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { retry.Setup(config.Default().Retry) })
+
+	// A build that timed out or lost its connection may still be running,
+	// and a proxy's 502 may come after it forwarded the request.
+	dropped := func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}
+	badGateway := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	for name, handler := range map[string]http.HandlerFunc{"dropped": dropped, "bad gateway": badGateway} {
+		var tries atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tries.Add(1)
+			handler(w, r)
+		}))
+		if _, err := NewHTTPBuilder(srv.URL, "secret").Build(context.Background(), BuildRequest{Repo: "site"}); err == nil || tries.Load() != 1 {
+			t.Errorf("%s: Build = %v after %d tries, want an error after 1", name, err, tries.Load())
+		}
+		// Uploads can run again.
+		tries.Store(0)
+		if _, err := NewHTTPUploader(srv.URL, "secret").Upload(context.Background(), "https://github.com/acme/site", ""); err == nil || tries.Load() != 3 {
+			t.Errorf("%s: Upload = %v after %d tries, want an error after 3", name, err, tries.Load())
+		}
+		srv.Close()
+	}
+
+	// Nothing was sent to a service that refused the connection.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	_, err := NewHTTPBuilder(srv.URL, "secret").Build(context.Background(), BuildRequest{Repo: "site"})
+	if e := apierr.From(err); e.Code != apierr.CodeUnavailable || !isDialError(err) {
+		t.Errorf("Build to a closed port = %v", err)
+	}
+}
@@ -0,0 +1,422 @@
+package deploy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// siteRules holds the redirect and header rules of a deployment. Rules are
+// read from _redirects, _headers and zenith.json in the publish directory and
+// compiled once when the site is served.
+type siteRules struct {
+	redirects []redirectRule
+	headers   []headerRule
+}
+
+type redirectRule struct {
+	from   pathPattern
+	query  map[string]string
+	to     string
+	status int
+	force  bool
+}
+
+type headerRule struct {
+	path   pathPattern
+	values http.Header
+}
+
+// redirectMatch is the result of matching a request against the redirect rules.
+type redirectMatch struct {
+	target string
+	status int
+}
+
+// pathPattern is a compiled path such as /blog/:year/:slug or /app/*.
+type pathPattern struct {
+	raw      string
+	segments []string
+	splat    bool
+}
+
+// zenithConfig mirrors the routing part of a project's zenith.json.
+type zenithConfig struct {
+	Redirects []struct {
+		From   string            `json:"from"`
+		To     string            `json:"to"`
+		Status int               `json:"status"`
+		Force  bool              `json:"force"`
+		Query  map[string]string `json:"query"`
+	} `json:"redirects"`
+	Headers []struct {
+		For    string            `json:"for"`
+		Values map[string]string `json:"values"`
+	} `json:"headers"`
+}
+
+var placeholderPattern = regexp.MustCompile(`:[A-Za-z_][A-Za-z0-9_]*`)
+
+// loadSiteRules reads every rule file found in dir. Invalid lines are
+// reported in the returned error while the valid rules are still returned.
+func loadSiteRules(dir string) (*siteRules, error) {
+	return parseSiteRules(func(name string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(dir, name))
+	})
+}
+
+// parseSiteRules reads the rule files with readFile, which fails for those
+// the site does not have.
+func parseSiteRules(readFile func(name string) ([]byte, error)) (*siteRules, error) {
+	rules := &siteRules{}
+	var errs []error
+
+	if data, err := readFile("_redirects"); err == nil {
+		redirects, err := parseRedirects(bytes.NewReader(data))
+		rules.redirects = append(rules.redirects, redirects...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("_redirects: %w", err))
+		}
+	}
+
+	if data, err := readFile("_headers"); err == nil {
+		headers, err := parseHeaders(bytes.NewReader(data))
+		rules.headers = append(rules.headers, headers...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("_headers: %w", err))
+		}
+	}
+
+	if data, err := readFile("zenith.json"); err == nil {
+		redirects, headers, err := parseZenithConfig(data)
+		rules.redirects = append(rules.redirects, redirects...)
+		rules.headers = append(rules.headers, headers...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("zenith.json: %w", err))
+		}
+	}
+
+	return rules, errors.Join(errs...)
+}
+
+// parseRedirects parses the Netlify _redirects format:
+//
+//	/from [param=value ...] /to [status[!]]
+func parseRedirects(r io.Reader) ([]redirectRule, error) {
+	var rules []redirectRule
+	var errs []error
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRedirectLine(strings.Fields(line))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", lineNo, err))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return rules, errors.Join(errs...)
+}
+
+func parseRedirectLine(fields []string) (redirectRule, error) {
+	if len(fields) < 2 {
+		return redirectRule{}, fmt.Errorf("expected a source and a destination")
+	}
+
+	from, err := compilePattern(fields[0])
+	if err != nil {
+		return redirectRule{}, err
+	}
+
+	rest := fields[1:]
+	query := map[string]string{}
+	for len(rest) > 0 && isQueryCondition(rest[0]) {
+		key, value, _ := strings.Cut(rest[0], "=")
+		query[key] = value
+		rest = rest[1:]
+	}
+	if len(rest) == 0 {
+		return redirectRule{}, fmt.Errorf("missing destination")
+	}
+
+	to := rest[0]
+	rest = rest[1:]
+
+	status, force := http.StatusMovedPermanently, false
+	if len(rest) > 0 {
+		status, force, err = parseStatus(rest[0])
+		if err != nil {
+			return redirectRule{}, err
+		}
+		rest = rest[1:]
+	}
+	if len(rest) > 0 {
+		return redirectRule{}, fmt.Errorf("unsupported condition %q", rest[0])
+	}
+
+	return newRedirectRule(from, query, to, status, force)
+}
+
+func isQueryCondition(field string) bool {
+	return !strings.HasPrefix(field, "/") && !strings.Contains(field, "://") && strings.Contains(field, "=")
+}
+
+func parseStatus(field string) (int, bool, error) {
+	force := strings.HasSuffix(field, "!")
+	status, err := strconv.Atoi(strings.TrimSuffix(field, "!"))
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid status %q", field)
+	}
+	return status, force, nil
+}
+
+func newRedirectRule(from pathPattern, query map[string]string, to string, status int, force bool) (redirectRule, error) {
+	switch status {
+	case http.StatusOK, http.StatusNotFound:
+		if !strings.HasPrefix(to, "/") {
+			return redirectRule{}, fmt.Errorf("rewrite destination %q must be a local path", to)
+		}
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return redirectRule{}, fmt.Errorf("unsupported status %d", status)
+	}
+
+	return redirectRule{from: from, query: query, to: to, status: status, force: force}, nil
+}
+
+// parseHeaders parses the Netlify _headers format: an unindented path pattern
+// followed by indented "Name: value" lines.
+func parseHeaders(r io.Reader) ([]headerRule, error) {
+	var rules []headerRule
+	var errs []error
+	var current *headerRule
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if raw[0] != ' ' && raw[0] != '\t' {
+			pattern, err := compilePattern(line)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", lineNo, err))
+				current = nil
+				continue
+			}
+			rules = append(rules, headerRule{path: pattern, values: http.Header{}})
+			current = &rules[len(rules)-1]
+			continue
+		}
+
+		if current == nil {
+			errs = append(errs, fmt.Errorf("line %d: header without a path", lineNo))
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			errs = append(errs, fmt.Errorf("line %d: expected \"Name: value\"", lineNo))
+			continue
+		}
+		current.values.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return rules, errors.Join(errs...)
+}
+
+func parseZenithConfig(data []byte) ([]redirectRule, []headerRule, error) {
+	var cfg zenithConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, nil, err
+	}
+
+	var redirects []redirectRule
+	var headers []headerRule
+	var errs []error
+
+	for i, r := range cfg.Redirects {
+		from, err := compilePattern(r.From)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("redirects[%d]: %w", i, err))
+			continue
+		}
+		status := r.Status
+		if status == 0 {
+			status = http.StatusMovedPermanently
+		}
+		rule, err := newRedirectRule(from, r.Query, r.To, status, r.Force)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("redirects[%d]: %w", i, err))
+			continue
+		}
+		redirects = append(redirects, rule)
+	}
+
+	for i, h := range cfg.Headers {
+		pattern, err := compilePattern(h.For)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("headers[%d]: %w", i, err))
+			continue
+		}
+		values := http.Header{}
+		for name, value := range h.Values {
+			values.Add(name, value)
+		}
+		headers = append(headers, headerRule{path: pattern, values: values})
+	}
+
+	return redirects, headers, errors.Join(errs...)
+}
+
+func compilePattern(raw string) (pathPattern, error) {
+	if !strings.HasPrefix(raw, "/") {
+		return pathPattern{}, fmt.Errorf("path %q must start with /", raw)
+	}
+
+	p := pathPattern{raw: raw}
+	segments := splitPath(raw)
+	for i, segment := range segments {
+		if strings.Contains(segment, "*") {
+			if segment != "*" || i != len(segments)-1 {
+				return pathPattern{}, fmt.Errorf("path %q: splat is only allowed as the last segment", raw)
+			}
+			p.splat = true
+			break
+		}
+		p.segments = append(p.segments, segment)
+	}
+	return p, nil
+}
+
+// match reports whether path matches the pattern and returns the values of
+// its placeholders. The splat is returned under the name "splat".
+func (p pathPattern) match(path string) (map[string]string, bool) {
+	segments := splitPath(path)
+	if len(segments) < len(p.segments) || (!p.splat && len(segments) != len(p.segments)) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, want := range p.segments {
+		if strings.HasPrefix(want, ":") {
+			params[want[1:]] = segments[i]
+		} else if want != segments[i] {
+			return nil, false
+		}
+	}
+	if p.splat {
+		params["splat"] = strings.Join(segments[len(p.segments):], "/")
+	}
+	return params, true
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// match returns the first redirect rule that applies to the request. Rules
+// that are not forced are shadowed by files that exist in the publish
+// directory.
+func (s *siteRules) match(path string, query url.Values, fileExists bool) *redirectMatch {
+	for _, rule := range s.redirects {
+		if fileExists && !rule.force {
+			continue
+		}
+		params, ok := rule.from.match(path)
+		if !ok || !matchQuery(rule.query, query, params) || !safeParams(params) {
+			continue
+		}
+
+		target := placeholderPattern.ReplaceAllStringFunc(rule.to, func(token string) string {
+			if value, ok := params[token[1:]]; ok {
+				return value
+			}
+			return token
+		})
+		if rule.status != http.StatusOK && rule.status != http.StatusNotFound &&
+			len(rule.query) == 0 && len(query) > 0 && !strings.Contains(target, "?") {
+			target += "?" + query.Encode()
+		}
+		return &redirectMatch{target: target, status: rule.status}
+	}
+	return nil
+}
+
+func matchQuery(conditions map[string]string, query url.Values, params map[string]string) bool {
+	for key, want := range conditions {
+		if !query.Has(key) {
+			return false
+		}
+		got := query.Get(key)
+		if strings.HasPrefix(want, ":") {
+			params[want[1:]] = got
+		} else if got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// safeParams reports whether the placeholder values can be put into a
+// rewrite target without leaving the publish directory: none has a ".."
+// segment or a backslash, and only the splat spans several segments.
+func safeParams(params map[string]string) bool {
+	for name, value := range params {
+		if strings.Contains(value, `\`) || (name != "splat" && strings.Contains(value, "/")) {
+			return false
+		}
+		for _, segment := range strings.Split(value, "/") {
+			if segment == ".." {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// applyHeaders adds the headers of every rule matching path to h.
+func (s *siteRules) applyHeaders(h http.Header, path string) {
+	for _, rule := range s.headers {
+		if _, ok := rule.path.match(path); !ok {
+			continue
+		}
+		for name, values := range rule.values {
+			for _, value := range values {
+				h.Add(name, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package deploy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeSite(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestParseRedirectsErrors(t *testing.T) {
+	input := strings.Join([]string{
+		"# comment",
+		"/ok /fine 302",
+		"/missing",
+		"/bad /status abc",
+		"/rewrite https://example.com 200",
+		"/a/*/b /c",
+		"/country /x 302 Country=us",
+	}, "\n")
+
+	rules, err := parseRedirects(strings.NewReader(input))
+	if len(rules) != 1 {
+		t.Fatalf("expected 1 valid rule, got %d", len(rules))
+	}
+	if err == nil {
+		t.Fatal("expected errors for invalid lines")
+	}
+	for _, line := range []string{"line 3", "line 4", "line 5", "line 6", "line 7"} {
+		if !strings.Contains(err.Error(), line) {
+			t.Errorf("error %q does not mention %s", err, line)
+		}
+	}
+}
+
+func TestStaticHandlerRules(t *testing.T) {
+	dir := writeSite(t, map[string]string{
+		"index.html":       "index",
+		"about.html":       "about",
+		"app/index.html":   "app shell",
+		"docs/v2/guide.md": "guide",
+		"404.html":         "not found page",
+		"old.html":         "old file",
+		"_redirects": strings.Join([]string{
+			"/home              /                     301",
+			"/temp              /elsewhere            302",
+			"/blog/:year/:slug  /posts/:year-:slug    301",
+			"/docs/*            /docs/v2/:splat       200",
+			"/app/*             /app/index.html       200",
+			"/store id=:id      /products/:id         301",
+			"/search q=zenith   /found                302",
+			"/old.html          /new.html             301",
+			"/forced.html       /about.html           200!",
+			"/about.html        /never                301",
+			"/gone              /404.html             404",
+			"/ext               https://example.com/x 302",
+		}, "\n"),
+		"_headers": strings.Join([]string{
+			"/*",
+			"  X-Frame-Options: DENY",
+			"/app/*",
+			"  Cache-Control: no-store",
+			"  X-Custom: one",
+			"  X-Custom: two",
+		}, "\n"),
+		"zenith.json": `{
+			"redirects": [{"from": "/legacy/:id", "to": "/modern/:id", "status": 308}],
+			"headers": [{"for": "/about.html", "values": {"X-Page": "about"}}]
+		}`,
+	})
+	handler := newStaticHandler(context.Background(), dir)
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantLoc    string
+		wantBody   string
+		wantHeader map[string]string
+	}{
+		{name: "existing file", path: "/about.html", wantStatus: 200, wantBody: "about",
+			wantHeader: map[string]string{"X-Frame-Options": "DENY", "X-Page": "about"}},
+		{name: "permanent redirect", path: "/home", wantStatus: 301, wantLoc: "/"},
+		{name: "temporary redirect", path: "/temp", wantStatus: 302, wantLoc: "/elsewhere"},
+		{name: "query string passed through", path: "/temp?a=1", wantStatus: 302, wantLoc: "/elsewhere?a=1"},
+		{name: "placeholders", path: "/blog/2024/hello", wantStatus: 301, wantLoc: "/posts/2024-hello"},
+		{name: "trailing slash", path: "/blog/2024/hello/", wantStatus: 301, wantLoc: "/posts/2024-hello"},
+		{name: "splat rewrite", path: "/docs/guide.md", wantStatus: 200, wantBody: "guide"},
+		{name: "spa rewrite", path: "/app/settings/profile", wantStatus: 200, wantBody: "app shell",
+			wantHeader: map[string]string{"Cache-Control": "no-store", "X-Custom": "one"}},
+		{name: "query placeholder", path: "/store?id=42", wantStatus: 301, wantLoc: "/products/42"},
+		{name: "query condition missing", path: "/store", wantStatus: 200, wantBody: "index"},
+		{name: "query literal match", path: "/search?q=zenith", wantStatus: 302, wantLoc: "/found"},
+		{name: "query literal mismatch", path: "/search?q=other", wantStatus: 200, wantBody: "index"},
+		{name: "existing file shadows rule", path: "/old.html", wantStatus: 200, wantBody: "old file"},
+		{name: "forced rule", path: "/forced.html", wantStatus: 200, wantBody: "about"},
+		{name: "custom 404", path: "/gone", wantStatus: 404, wantBody: "not found page"},
+		{name: "external redirect", path: "/ext", wantStatus: 302, wantLoc: "https://example.com/x"},
+		{name: "zenith.json redirect", path: "/legacy/7", wantStatus: 308, wantLoc: "/modern/7"},
+		{name: "spa fallback", path: "/unknown/route", wantStatus: 200, wantBody: "index"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantLoc != "" && rec.Header().Get("Location") != tt.wantLoc {
+				t.Errorf("Location = %q, want %q", rec.Header().Get("Location"), tt.wantLoc)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			for name, want := range tt.wantHeader {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStaticHandlerRewritesStayInSite(t *testing.T) {
+	root := writeSite(t, map[string]string{
+		"secret.txt":      "secret",
+		"site/index.html": "index",
+		"site/_redirects": strings.Join([]string{
+			"/file p=:p  /:p  200",
+			"/gone p=:p  /:p  404",
+			"/docs/*     /:splat 200",
+		}, "\n"),
+	})
+	handler := newStaticHandler(context.Background(), filepath.Join(root, "site"))
+
+	for _, path := range []string{
+		"/file?p=../secret.txt",
+		"/file?p=..%2F..%2Fsecret.txt",
+		`/gone?p=..\secret.txt`,
+		"/gone?p=..",
+		"/docs/%2E%2E/secret.txt",
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if strings.Contains(rec.Body.String(), "secret") {
+			t.Errorf("%s: served a file outside the site: status %d, body %q", path, rec.Code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package deploy
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// siteRegistry maps a project (the repository name) to the handler serving
+// its current deployment.
+type siteRegistry struct {
+	mu    sync.RWMutex
+	sites map[string]http.Handler
+}
+
+var sites = &siteRegistry{sites: map[string]http.Handler{}}
+
+func (s *siteRegistry) set(repo string, handler http.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sites[repo] = handler
+}
+
+// get returns the handler for repo. Sites deployed before a restart are
+// loaded from the deployed directory on first use.
+func (s *siteRegistry) get(repo string) (http.Handler, bool) {
+	s.mu.RLock()
+	handler, ok := s.sites[repo]
+	s.mu.RUnlock()
+	if ok {
+		return handler, true
+	}
+
+	dir := filepath.Join(cfg.RequestHandler.DeployedDir, repo)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if handler, ok := s.sites[repo]; ok {
+		return handler, true
+	}
+	handler = newStaticHandler(context.Background(), dir)
+	s.sites[repo] = handler
+	return handler, true
+}
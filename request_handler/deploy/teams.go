@@ -0,0 +1,611 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/auth"
+	"zenith/shared/manifest"
+)
+
+// Role is a member's role in a team. Each role can do everything the roles
+// below it can.
+type Role string
+
+const (
+	// RoleViewer can see deployments, domains and logs.
+	RoleViewer Role = "viewer"
+	// RoleDeployer can also deploy, tear down and roll back.
+	RoleDeployer Role = "deployer"
+	// RoleMaintainer can also manage domains, environment variables and
+	// deployers and viewers.
+	RoleMaintainer Role = "maintainer"
+	// RoleOwner can also manage every member and delete the team.
+	RoleOwner Role = "owner"
+)
+
+var roleRank = map[Role]int{RoleViewer: 1, RoleDeployer: 2, RoleMaintainer: 3, RoleOwner: 4}
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool { return roleRank[r] > 0 }
+
+// Includes reports whether r grants everything other does.
+func (r Role) Includes(other Role) bool { return roleRank[r] >= roleRank[other] }
+
+var (
+	ErrTeamNotFound    = errors.New("team not found")
+	ErrTeamExists      = errors.New("team already exists")
+	ErrTeamNotEmpty    = errors.New("team still owns projects")
+	ErrMemberNotFound  = errors.New("member not found")
+	ErrMemberExists    = errors.New("user is already a member")
+	ErrLastOwner       = errors.New("a team must keep at least one owner")
+	ErrProjectNotFound = errors.New("project not found")
+	ErrProjectExists   = errors.New("project already exists")
+)
+
+var teamSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,38}[a-z0-9]$`)
+
+type Member struct {
+	UserID  string    `json:"user_id"`
+	Email   string    `json:"email"`
+	Role    Role      `json:"role"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// MembershipEvent records one change to a team's members.
+type MembershipEvent struct {
+	At           time.Time `json:"at"`
+	Actor        string    `json:"actor"`
+	Action       string    `json:"action"`
+	Email        string    `json:"email"`
+	Role         Role      `json:"role,omitempty"`
+	PreviousRole Role      `json:"previous_role,omitempty"`
+}
+
+// Team is a group of users that owns projects.
+type Team struct {
+	Slug      string            `json:"slug"`
+	Name      string            `json:"name"`
+	Members   []Member          `json:"members"`
+	History   []MembershipEvent `json:"history,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+func (t *Team) member(userID string) (int, bool) {
+	i := slices.IndexFunc(t.Members, func(m Member) bool { return m.UserID == userID })
+	return i, i >= 0
+}
+
+func (t *Team) owners() int {
+	n := 0
+	for _, m := range t.Members {
+		if m.Role == RoleOwner {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *Team) record(actor, action string, m Member, previous Role) {
+	t.History = append(t.History, MembershipEvent{
+		At:           time.Now().UTC(),
+		Actor:        actor,
+		Action:       action,
+		Email:        m.Email,
+		Role:         m.Role,
+		PreviousRole: previous,
+	})
+}
+
+// Project is a deployable repository owned by a team.
+type Project struct {
+	Name         string       `json:"name"`
+	Team         string       `json:"team"`
+	CreatedAt    time.Time    `json:"created_at"`
+	SecretPolicy SecretPolicy `json:"secret_policy"`
+}
+
+// teamStore keeps teams and project ownership in ./data/teams.json.
+type teamStore struct {
+	mu       sync.RWMutex
+	path     string
+	teams    map[string]*Team
+	projects map[string]*Project
+}
+
+type teamFile struct {
+	Teams    []*Team    `json:"teams"`
+	Projects []*Project `json:"projects"`
+}
+
+var teams *teamStore
+
+func loadTeamStore(path string) (*teamStore, error) {
+	s := &teamStore{path: path, teams: map[string]*Team{}, projects: map[string]*Project{}}
+	var f teamFile
+	if err := loadJSON(path, &f); err != nil {
+		return nil, fmt.Errorf("failed to load teams: %w", err)
+	}
+	for _, t := range f.Teams {
+		s.teams[t.Slug] = t
+	}
+	for _, p := range f.Projects {
+		s.projects[p.Name] = p
+	}
+	return s, nil
+}
+
+func (s *teamStore) saveLocked() error {
+	var f teamFile
+	for _, t := range s.teams {
+		f.Teams = append(f.Teams, t)
+	}
+	for _, p := range s.projects {
+		f.Projects = append(f.Projects, p)
+	}
+	sort.Slice(f.Teams, func(i, j int) bool { return f.Teams[i].Slug < f.Teams[j].Slug })
+	sort.Slice(f.Projects, func(i, j int) bool { return f.Projects[i].Name < f.Projects[j].Name })
+	return saveJSON(s.path, f)
+}
+
+func copyTeam(t *Team) Team {
+	c := *t
+	c.Members = slices.Clone(t.Members)
+	c.History = slices.Clone(t.History)
+	return c
+}
+
+// create adds a team with owner as its only member.
+func (s *teamStore) create(slug, name string, owner Member) (Team, error) {
+	if !teamSlugPattern.MatchString(slug) {
+		return Team{}, fmt.Errorf("invalid team slug %q: use 2-40 lowercase letters, digits and dashes", slug)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.teams[slug]; ok {
+		return Team{}, ErrTeamExists
+	}
+	if name == "" {
+		name = slug
+	}
+	owner.Role = RoleOwner
+	owner.AddedAt = time.Now().UTC()
+	t := &Team{Slug: slug, Name: name, Members: []Member{owner}, CreatedAt: owner.AddedAt}
+	t.record(owner.Email, "created", owner, "")
+	s.teams[slug] = t
+	return copyTeam(t), s.saveLocked()
+}
+
+func (s *teamStore) get(slug string) (Team, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.teams[slug]
+	if !ok {
+		return Team{}, false
+	}
+	return copyTeam(t), true
+}
+
+// list returns the teams userID belongs to, or every team if userID is empty.
+func (s *teamStore) list(userID string) []Team {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := []Team{}
+	for _, t := range s.teams {
+		if _, ok := t.member(userID); userID == "" || ok {
+			result = append(result, copyTeam(t))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Slug < result[j].Slug })
+	return result
+}
+
+func (s *teamStore) remove(slug string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.teams[slug]; !ok {
+		return ErrTeamNotFound
+	}
+	for _, p := range s.projects {
+		if p.Team == slug {
+			return ErrTeamNotEmpty
+		}
+	}
+	delete(s.teams, slug)
+	return s.saveLocked()
+}
+
+// role returns userID's role in team slug.
+func (s *teamStore) role(slug, userID string) (Role, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.teams[slug]
+	if !ok {
+		return "", false
+	}
+	i, ok := t.member(userID)
+	if !ok {
+		return "", false
+	}
+	return t.Members[i].Role, true
+}
+
+func (s *teamStore) addMember(slug, actor string, m Member) (Member, error) {
+	if !m.Role.Valid() {
+		return Member{}, fmt.Errorf("invalid role %q", m.Role)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.teams[slug]
+	if !ok {
+		return Member{}, ErrTeamNotFound
+	}
+	if _, ok := t.member(m.UserID); ok {
+		return Member{}, ErrMemberExists
+	}
+	m.AddedAt = time.Now().UTC()
+	t.Members = append(t.Members, m)
+	t.record(actor, "added", m, "")
+	return m, s.saveLocked()
+}
+
+func (s *teamStore) setRole(slug, actor, userID string, role Role) (Member, error) {
+	if !role.Valid() {
+		return Member{}, fmt.Errorf("invalid role %q", role)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.teams[slug]
+	if !ok {
+		return Member{}, ErrTeamNotFound
+	}
+	i, ok := t.member(userID)
+	if !ok {
+		return Member{}, ErrMemberNotFound
+	}
+	previous := t.Members[i].Role
+	if previous == role {
+		return t.Members[i], nil
+	}
+	if previous == RoleOwner && t.owners() == 1 {
+		return Member{}, ErrLastOwner
+	}
+	t.Members[i].Role = role
+	t.record(actor, "role_changed", t.Members[i], previous)
+	return t.Members[i], s.saveLocked()
+}
+
+func (s *teamStore) removeMember(slug, actor, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.teams[slug]
+	if !ok {
+		return ErrTeamNotFound
+	}
+	i, ok := t.member(userID)
+	if !ok {
+		return ErrMemberNotFound
+	}
+	m := t.Members[i]
+	if m.Role == RoleOwner && t.owners() == 1 {
+		return ErrLastOwner
+	}
+	t.Members = slices.Delete(t.Members, i, i+1)
+	previous := m.Role
+	m.Role = ""
+	t.record(actor, "removed", m, previous)
+	return s.saveLocked()
+}
+
+func (s *teamStore) project(name string) (Project, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.projects[name]
+	if !ok {
+		return Project{}, false
+	}
+	return *p, true
+}
+
+func (s *teamStore) addProject(name, team string) (Project, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.teams[team]; !ok {
+		return Project{}, ErrTeamNotFound
+	}
+	if _, ok := s.projects[name]; ok {
+		return Project{}, ErrProjectExists
+	}
+	p := &Project{Name: name, Team: team, CreatedAt: time.Now().UTC()}
+	s.projects[name] = p
+	return *p, s.saveLocked()
+}
+
+func (s *teamStore) setSecretPolicy(name string, policy SecretPolicy) (Project, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.projects[name]
+	if !ok {
+		return Project{}, ErrProjectNotFound
+	}
+	p.SecretPolicy = policy
+	return *p, s.saveLocked()
+}
+
+// listProjects returns the projects of team, or every project if team is
+// empty.
+func (s *teamStore) listProjects(team string) []Project {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := []Project{}
+	for _, p := range s.projects {
+		if team == "" || p.Team == team {
+			result = append(result, *p)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// projectRole returns userID's role on project name through its team.
+func (s *teamStore) projectRole(name, userID string) (Role, bool) {
+	p, ok := s.project(name)
+	if !ok {
+		return "", false
+	}
+	return s.role(p.Team, userID)
+}
+
+// managerRole is the role needed to grant, change or revoke role.
+func managerRole(role Role) Role {
+	if role.Includes(RoleMaintainer) {
+		return RoleOwner
+	}
+	return RoleMaintainer
+}
+
+func teamError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrTeamNotFound), errors.Is(err, ErrMemberNotFound), errors.Is(err, ErrProjectNotFound),
+		errors.Is(err, auth.ErrUserNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrTeamExists), errors.Is(err, ErrMemberExists), errors.Is(err, ErrProjectExists),
+		errors.Is(err, ErrLastOwner), errors.Is(err, ErrTeamNotEmpty):
+		status = http.StatusConflict
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+func handleListTeams(c *gin.Context) {
+	p := auth.Current(c)
+	owner := p.UserID
+	if c.Query("all") == "true" && p.Can(auth.ScopeAdmin) {
+		owner = ""
+	}
+	list := teams.list(owner)
+	for i := range list {
+		list[i].History = nil
+	}
+	c.JSON(http.StatusOK, gin.H{"teams": list})
+}
+
+func handleCreateTeam(c *gin.Context) {
+	var req struct {
+		Slug string `json:"slug" binding:"required"`
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	p := auth.Current(c)
+	t, err := teams.create(req.Slug, req.Name, Member{UserID: p.UserID, Email: p.Email})
+	if err != nil {
+		if errors.Is(err, ErrTeamExists) {
+			teamError(c, err)
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	logger.InfoContext(c.Request.Context(), "created team", "user", p.Email, "team", t.Slug)
+	recordAudit(c, AuditEntry{Action: "team.create", Target: t.Slug, Team: t.Slug}, nil, gin.H{"name": t.Name})
+	t.History = nil
+	c.JSON(http.StatusCreated, gin.H{"team": t})
+}
+
+func handleGetTeam(c *gin.Context) {
+	slug := c.Param("team")
+	if !requireTeamRole(c, slug, RoleViewer) {
+		return
+	}
+	t, _ := teams.get(slug)
+	t.History = nil
+	c.JSON(http.StatusOK, gin.H{"team": t, "projects": teams.listProjects(slug)})
+}
+
+func handleDeleteTeam(c *gin.Context) {
+	slug := c.Param("team")
+	if !requireTeamRole(c, slug, RoleOwner) {
+		return
+	}
+	if err := teams.remove(slug); err != nil {
+		teamError(c, err)
+		return
+	}
+	recordAudit(c, AuditEntry{Action: "team.delete", Target: slug, Team: slug}, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Team deleted"})
+}
+
+func handleTeamHistory(c *gin.Context) {
+	slug := c.Param("team")
+	if !requireTeamRole(c, slug, RoleMaintainer) {
+		return
+	}
+	t, _ := teams.get(slug)
+	history := t.History
+	if history == nil {
+		history = []MembershipEvent{}
+	}
+	c.JSON(http.StatusOK, gin.H{"history": history})
+}
+
+func handleAddMember(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required"`
+		Role  Role   `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.Role.Valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of owner, maintainer, deployer, viewer"})
+		return
+	}
+
+	slug := c.Param("team")
+	if !requireTeamRole(c, slug, managerRole(req.Role)) {
+		return
+	}
+	user, ok := users.UserByEmail(req.Email)
+	if !ok {
+		teamError(c, auth.ErrUserNotFound)
+		return
+	}
+
+	p := auth.Current(c)
+	m, err := teams.addMember(slug, p.Email, Member{UserID: user.ID, Email: user.Email, Role: req.Role})
+	if err != nil {
+		teamError(c, err)
+		return
+	}
+	logger.InfoContext(c.Request.Context(), "added team member", "user", p.Email, "member", m.Email, "team", slug, "role", m.Role)
+	recordAudit(c, AuditEntry{Action: "team.member.add", Target: m.Email, Team: slug}, nil, gin.H{"role": m.Role})
+	c.JSON(http.StatusCreated, gin.H{"member": m})
+}
+
+func handleSetMemberRole(c *gin.Context) {
+	var req struct {
+		Role Role `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.Role.Valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of owner, maintainer, deployer, viewer"})
+		return
+	}
+
+	slug, userID := c.Param("team"), c.Param("user")
+	current, ok := teams.role(slug, userID)
+	if !ok {
+		if requireTeamRole(c, slug, RoleViewer) {
+			teamError(c, ErrMemberNotFound)
+		}
+		return
+	}
+	need := managerRole(req.Role)
+	if managerRole(current).Includes(need) {
+		need = managerRole(current)
+	}
+	if !requireTeamRole(c, slug, need) {
+		return
+	}
+
+	p := auth.Current(c)
+	m, err := teams.setRole(slug, p.Email, userID, req.Role)
+	if err != nil {
+		teamError(c, err)
+		return
+	}
+	logger.InfoContext(c.Request.Context(), "changed team member role", "user", p.Email, "member", m.Email, "team", slug, "role", m.Role)
+	recordAudit(c, AuditEntry{Action: "team.member.role", Target: m.Email, Team: slug}, gin.H{"role": current}, gin.H{"role": m.Role})
+	c.JSON(http.StatusOK, gin.H{"member": m})
+}
+
+func handleRemoveMember(c *gin.Context) {
+	slug, userID := c.Param("team"), c.Param("user")
+	current, ok := teams.role(slug, userID)
+	if !ok {
+		if requireTeamRole(c, slug, RoleViewer) {
+			teamError(c, ErrMemberNotFound)
+		}
+		return
+	}
+	if !requireTeamRole(c, slug, managerRole(current)) {
+		return
+	}
+
+	p := auth.Current(c)
+	if err := teams.removeMember(slug, p.Email, userID); err != nil {
+		teamError(c, err)
+		return
+	}
+	logger.InfoContext(c.Request.Context(), "removed team member", "user", p.Email, "member", userID, "team", slug)
+	recordAudit(c, AuditEntry{Action: "team.member.remove", Target: userID, Team: slug}, gin.H{"role": current}, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+func handleListProjects(c *gin.Context) {
+	p := auth.Current(c)
+	list := []Project{}
+	for _, project := range teams.listProjects(c.Query("team")) {
+		if canView(p, project.Name) {
+			list = append(list, project)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"projects": list})
+}
+
+// handleProjectUsage reports the storage the stored builds of a project
+// take, counting files shared between its deployments once.
+func handleProjectUsage(c *gin.Context) {
+	name := c.Param("name")
+	if !requireProjectRole(c, name, RoleViewer) {
+		return
+	}
+	usage, err := manifest.ProjectUsage(c.Request.Context(), store, name)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Failed to read stored builds: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"usage": usage})
+}
+
+func handleCreateProject(c *gin.Context) {
+	var req struct {
+		Name string `json:"name" binding:"required"`
+		Team string `json:"team" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.Contains(req.Name, "/") || strings.Contains(req.Name, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid repository name"})
+		return
+	}
+	if !requireTeamRole(c, req.Team, RoleMaintainer) {
+		return
+	}
+
+	project, err := teams.addProject(req.Name, req.Team)
+	if err != nil {
+		teamError(c, err)
+		return
+	}
+	recordAudit(c, projectAudit("project.create", project.Name, project.Name), nil, gin.H{"team": project.Team})
+	c.JSON(http.StatusCreated, gin.H{"project": project})
+}
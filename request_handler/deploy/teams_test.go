@@ -0,0 +1,185 @@
+package deploy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/auth"
+)
+
+func TestTeamMembership(t *testing.T) {
+	s, err := loadTeamStore(filepath.Join(t.TempDir(), "teams.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := Member{UserID: "u1", Email: "owner@example.com"}
+	if _, err := s.create("web", "Web", owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.create("web", "", owner); !errors.Is(err, ErrTeamExists) {
+		t.Errorf("duplicate team: err = %v", err)
+	}
+	if _, err := s.create("Not A Slug", "", owner); err == nil {
+		t.Error("invalid slug accepted")
+	}
+
+	if _, err := s.addMember("web", owner.Email, Member{UserID: "u2", Email: "dev@example.com", Role: RoleDeployer}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.removeMember("web", owner.Email, "u1"); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("removing the last owner: err = %v", err)
+	}
+	if _, err := s.setRole("web", owner.Email, "u1", RoleViewer); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("demoting the last owner: err = %v", err)
+	}
+	if _, err := s.setRole("web", owner.Email, "u2", RoleMaintainer); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.removeMember("web", owner.Email, "u2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.addProject("site", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.remove("web"); !errors.Is(err, ErrTeamNotEmpty) {
+		t.Errorf("deleting a team with projects: err = %v", err)
+	}
+
+	// Reload from disk to check the history survives a restart.
+	s, err = loadTeamStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	team, _ := s.get("web")
+	var actions []string
+	for _, e := range team.History {
+		actions = append(actions, e.Action+":"+e.Email+":"+string(e.Role)+":"+string(e.PreviousRole))
+	}
+	want := []string{
+		"created:owner@example.com:owner:",
+		"added:dev@example.com:deployer:",
+		"role_changed:dev@example.com:maintainer:deployer",
+		"removed:dev@example.com::maintainer",
+	}
+	if strings.Join(actions, " ") != strings.Join(want, " ") {
+		t.Errorf("history = %v, want %v", actions, want)
+	}
+	if role, ok := s.projectRole("site", "u1"); !ok || role != RoleOwner {
+		t.Errorf("projectRole = %q, %v", role, ok)
+	}
+}
+
+// setupRBAC creates a team "web" owning project "site" with a member of each
+// role and returns a key for each of them plus one for an outsider.
+func setupRBAC(t *testing.T) map[string]string {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+
+	var err error
+	users, err = auth.Open(filepath.Join(dir, "auth.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	teams, err = loadTeamStore(filepath.Join(dir, "teams.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains, err = loadDomainStore(filepath.Join(dir, "domains.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]string{}
+	for _, name := range []string{"owner", "maintainer", "deployer", "viewer", "outsider"} {
+		u, err := users.CreateUser(name+"@example.com", "password123", []string{auth.ScopeDeploy, auth.ScopeRead})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name], _, _ = users.CreateKey(u.ID, "test", []string{auth.ScopeDeploy, auth.ScopeRead}, 0)
+
+		switch name {
+		case "owner":
+			teams.create("web", "", Member{UserID: u.ID, Email: u.Email})
+		case "outsider":
+		default:
+			teams.addMember("web", "owner@example.com", Member{UserID: u.ID, Email: u.Email, Role: Role(name)})
+		}
+	}
+	teams.addProject("site", "web")
+	domains.add(&Domain{Name: "www.example.com", Repo: "site", Method: verifyDNS})
+	return keys
+}
+
+func TestProjectRolesAreEnforced(t *testing.T) {
+	keys := setupRBAC(t)
+
+	r := gin.New()
+	canRead := auth.Require(users, auth.ScopeRead)
+	canDeploy := auth.Require(users, auth.ScopeDeploy)
+	r.GET("/domains", canRead, handleListDomains)
+	r.DELETE("/domains/:domain", canDeploy, handleRemoveDomain)
+	r.POST("/teams/:team/members", canDeploy, handleAddMember)
+	r.GET("/teams/:team/history", canRead, handleTeamHistory)
+
+	tests := []struct {
+		name   string
+		who    string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"outsider cannot see history", "outsider", "GET", "/teams/web/history", "", http.StatusForbidden},
+		{"viewer cannot see history", "viewer", "GET", "/teams/web/history", "", http.StatusForbidden},
+		{"maintainer sees history", "maintainer", "GET", "/teams/web/history", "", http.StatusOK},
+		{"deployer cannot remove domains", "deployer", "DELETE", "/domains/www.example.com", "", http.StatusForbidden},
+		{"maintainer cannot add owners", "maintainer", "POST", "/teams/web/members", `{"email":"outsider@example.com","role":"owner"}`, http.StatusForbidden},
+		{"deployer cannot add viewers", "deployer", "POST", "/teams/web/members", `{"email":"outsider@example.com","role":"viewer"}`, http.StatusForbidden},
+		{"maintainer adds viewers", "maintainer", "POST", "/teams/web/members", `{"email":"outsider@example.com","role":"viewer"}`, http.StatusCreated},
+		{"maintainer removes domains", "maintainer", "DELETE", "/domains/www.example.com", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+keys[tt.who])
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestListsOnlyShowVisibleProjects(t *testing.T) {
+	keys := setupRBAC(t)
+
+	r := gin.New()
+	r.GET("/domains", auth.Require(users, auth.ScopeRead), handleListDomains)
+
+	count := func(who string) int {
+		req := httptest.NewRequest("GET", "/domains", nil)
+		req.Header.Set("Authorization", "Bearer "+keys[who])
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var body struct {
+			Domains []Domain `json:"domains"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return len(body.Domains)
+	}
+	if n := count("viewer"); n != 1 {
+		t.Errorf("viewer sees %d domains, want 1", n)
+	}
+	if n := count("outsider"); n != 0 {
+		t.Errorf("outsider sees %d domains, want 0", n)
+	}
+}
@@ -0,0 +1,410 @@
+package deploy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"zenith/shared/config"
+)
+
+// Tunnel exposes a single deployment's local server on a public URL.
+type Tunnel interface {
+	PublicURL() string
+	Close() error
+}
+
+// TunnelProvider opens tunnels. name identifies the deployment and localAddr
+// is the host:port its static server listens on. Check reports whether new
+// tunnels can be opened.
+type TunnelProvider interface {
+	Name() string
+	Open(ctx context.Context, name, localAddr string) (Tunnel, error)
+	Check(ctx context.Context) error
+}
+
+// newTunnelProvider selects the configured provider: ngrok, cloudflared,
+// ssh or none.
+func newTunnelProvider(cfg config.TunnelConfig) (TunnelProvider, error) {
+	switch cfg.Provider {
+	case "", "ngrok":
+		return &ngrokProvider{apiURL: cfg.NgrokAPIURL, authToken: cfg.NgrokAuthToken}, nil
+	case "cloudflared":
+		return &cloudflaredProvider{binary: cfg.CloudflaredBin}, nil
+	case "ssh":
+		return &sshProvider{target: cfg.SSHTarget, keyFile: cfg.SSHKey, urlTemplate: cfg.PublicURL}, nil
+	case "none":
+		return &noneProvider{urlTemplate: cfg.PublicURL}, nil
+	}
+	return nil, fmt.Errorf("unknown tunnel provider %q", cfg.Provider)
+}
+
+// expandURLTemplate fills {name}, {port} and {addr} in a public URL template.
+func expandURLTemplate(template, name, port, addr string) string {
+	return strings.NewReplacer("{name}", name, "{port}", port, "{addr}", addr).Replace(template)
+}
+
+// ngrokProvider creates named tunnels through the local ngrok agent API,
+// starting the agent without any tunnels if it is not already running.
+type ngrokProvider struct {
+	apiURL    string
+	authToken string
+
+	mu    sync.Mutex
+	agent *exec.Cmd
+}
+
+type ngrokTunnel struct {
+	provider  *ngrokProvider
+	name      string
+	publicURL string
+}
+
+func (p *ngrokProvider) Name() string { return "ngrok" }
+
+func (p *ngrokProvider) Open(ctx context.Context, name, localAddr string) (Tunnel, error) {
+	if err := p.ensureAgent(ctx); err != nil {
+		return nil, err
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"name":  name,
+		"proto": "http",
+		"addr":  localAddr,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.apiURL+"/api/tunnels", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ngrok tunnel: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ngrok API response: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ngrok API returned %s: %s", resp.Status, respBody)
+	}
+
+	var data struct {
+		PublicURL string `json:"public_url"`
+	}
+	if err := json.Unmarshal(respBody, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse ngrok API response: %v", err)
+	}
+	if data.PublicURL == "" {
+		return nil, fmt.Errorf("ngrok API response has no public URL")
+	}
+
+	return &ngrokTunnel{provider: p, name: name, publicURL: data.PublicURL}, nil
+}
+
+// Check passes when the agent answers or can be started.
+func (p *ngrokProvider) Check(ctx context.Context) error {
+	if p.agentReachable(ctx) {
+		return nil
+	}
+	if _, err := exec.LookPath("ngrok"); err != nil {
+		return fmt.Errorf("ngrok agent not reachable at %s and cannot be started: %w", p.apiURL, err)
+	}
+	return nil
+}
+
+// ensureAgent starts `ngrok start --none` unless an agent already answers on
+// the API address.
+func (p *ngrokProvider) ensureAgent(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.agentReachable(ctx) {
+		return nil
+	}
+
+	cmd := exec.Command("ngrok", "start", "--none")
+	if p.authToken != "" {
+		// Through the environment, not the command line every local user
+		// can read.
+		cmd.Env = append(os.Environ(), "NGROK_AUTHTOKEN="+p.authToken)
+	}
+	if err := startLogged(cmd, "ngrok"); err != nil {
+		return fmt.Errorf("failed to start ngrok: %v", err)
+	}
+	p.agent = cmd
+
+	logger.InfoContext(ctx, "waiting for ngrok to start")
+	deadline := time.Now().Add(30 * time.Second)
+	for !p.agentReachable(ctx) {
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			p.agent = nil
+			return fmt.Errorf("timed out waiting for ngrok to start")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// Close stops the agent if the provider started it.
+func (p *ngrokProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.agent == nil {
+		return nil
+	}
+	err := p.agent.Process.Kill()
+	p.agent = nil
+	if err != nil && err != os.ErrProcessDone {
+		return err
+	}
+	return nil
+}
+
+func (p *ngrokProvider) agentReachable(ctx context.Context) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.apiURL+"/api/tunnels", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func (t *ngrokTunnel) PublicURL() string { return t.publicURL }
+
+func (t *ngrokTunnel) Close() error {
+	req, err := http.NewRequest(http.MethodDelete, t.provider.apiURL+"/api/tunnels/"+t.name, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to close ngrok tunnel %s: %v", t.name, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to close ngrok tunnel %s: %s", t.name, resp.Status)
+	}
+	return nil
+}
+
+// cloudflaredProvider runs a quick tunnel (trycloudflare.com) per deployment.
+type cloudflaredProvider struct {
+	binary string
+}
+
+var cloudflaredURLPattern = regexp.MustCompile(`https://[a-z0-9-]+\.trycloudflare\.com`)
+
+func (p *cloudflaredProvider) Name() string { return "cloudflared" }
+
+func (p *cloudflaredProvider) Check(context.Context) error {
+	_, err := exec.LookPath(p.binary)
+	return err
+}
+
+func (p *cloudflaredProvider) Open(ctx context.Context, name, localAddr string) (Tunnel, error) {
+	cmd := exec.Command(p.binary, "tunnel", "--no-autoupdate", "--url", "http://"+localAddr)
+	publicURL, err := startAndWaitForLine(ctx, cmd, "cloudflared "+name, func(line string) (string, bool) {
+		match := cloudflaredURLPattern.FindString(line)
+		return match, match != ""
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cloudflared: %w", err)
+	}
+	return &processTunnel{cmd: cmd, publicURL: publicURL}, nil
+}
+
+// sshProvider opens a reverse tunnel to a self-hosted server with
+// `ssh -R 0:<localAddr>`. The server picks a port and a reverse proxy there
+// is expected to map the public URL template ({port} or {name}) onto it.
+type sshProvider struct {
+	target      string
+	keyFile     string
+	urlTemplate string
+}
+
+var sshAllocatedPortPattern = regexp.MustCompile(`Allocated port (\d+) for remote forward`)
+
+func (p *sshProvider) Name() string { return "ssh" }
+
+func (p *sshProvider) Check(context.Context) error {
+	if p.target == "" {
+		return fmt.Errorf("no ssh target configured")
+	}
+	_, err := exec.LookPath("ssh")
+	return err
+}
+
+func (p *sshProvider) Open(ctx context.Context, name, localAddr string) (Tunnel, error) {
+	args := []string{
+		"-N",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ServerAliveInterval=30",
+		"-o", "BatchMode=yes",
+		"-R", "0:" + localAddr,
+	}
+	if p.keyFile != "" {
+		args = append(args, "-i", p.keyFile)
+	}
+	args = append(args, p.target)
+
+	cmd := exec.Command("ssh", args...)
+	port, err := startAndWaitForLine(ctx, cmd, "ssh "+name, func(line string) (string, bool) {
+		m := sshAllocatedPortPattern.FindStringSubmatch(line)
+		if m == nil {
+			return "", false
+		}
+		return m[1], true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ssh tunnel: %w", err)
+	}
+	return &processTunnel{cmd: cmd, publicURL: expandURLTemplate(p.urlTemplate, name, port, localAddr)}, nil
+}
+
+// noneProvider is for setups with their own ingress: the public URL comes
+// from the configured template, or is the local address itself.
+type noneProvider struct {
+	urlTemplate string
+}
+
+type staticTunnel struct {
+	publicURL string
+}
+
+func (p *noneProvider) Name() string { return "none" }
+
+func (p *noneProvider) Check(context.Context) error { return nil }
+
+func (p *noneProvider) Open(_ context.Context, name, localAddr string) (Tunnel, error) {
+	if p.urlTemplate == "" {
+		return &staticTunnel{publicURL: "http://" + localAddr}, nil
+	}
+	_, port, _ := strings.Cut(localAddr, ":")
+	return &staticTunnel{publicURL: expandURLTemplate(p.urlTemplate, name, port, localAddr)}, nil
+}
+
+func (t *staticTunnel) PublicURL() string { return t.publicURL }
+func (t *staticTunnel) Close() error      { return nil }
+
+// processTunnel is a tunnel backed by a child process that is killed when
+// the tunnel is closed.
+type processTunnel struct {
+	cmd       *exec.Cmd
+	publicURL string
+}
+
+func (t *processTunnel) PublicURL() string { return t.publicURL }
+
+func (t *processTunnel) Close() error {
+	if t.cmd.Process == nil {
+		return nil
+	}
+	if err := t.cmd.Process.Kill(); err != nil && err != os.ErrProcessDone {
+		return err
+	}
+	return nil
+}
+
+// startLogged starts cmd and copies its output to the log.
+func startLogged(cmd *exec.Cmd, prefix string) error {
+	_, err := startWithLines(cmd, prefix, nil)
+	return err
+}
+
+// startAndWaitForLine starts cmd and waits until match finds a value in its
+// output. The process keeps running after the value is found.
+func startAndWaitForLine(ctx context.Context, cmd *exec.Cmd, prefix string, match func(string) (string, bool)) (string, error) {
+	found := make(chan string, 1)
+	exited, err := startWithLines(cmd, prefix, func(line string) bool {
+		if value, ok := match(line); ok {
+			found <- value
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return "", err
+	}
+
+	timer := time.NewTimer(30 * time.Second)
+	defer timer.Stop()
+
+	select {
+	case value := <-found:
+		return value, nil
+	case err := <-exited:
+		return "", fmt.Errorf("process exited before it was ready: %v", err)
+	case <-timer.C:
+		cmd.Process.Kill()
+		return "", fmt.Errorf("timed out waiting for the tunnel")
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return "", ctx.Err()
+	}
+}
+
+// startWithLines starts cmd, logs each output line and passes it to onLine
+// until onLine returns true. The returned channel receives the exit error.
+func startWithLines(cmd *exec.Cmd, prefix string, onLine func(string) bool) (<-chan error, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stderr pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	done := onLine == nil
+	scan := func(r io.Reader) {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := scanner.Text()
+			logger.Info("command output", "command", prefix, "line", line)
+			mu.Lock()
+			if !done {
+				done = onLine(line)
+			}
+			mu.Unlock()
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); scan(stdout) }()
+	go func() { defer wg.Done(); scan(stderr) }()
+
+	exited := make(chan error, 1)
+	go func() {
+		wg.Wait()
+		exited <- cmd.Wait()
+	}()
+	return exited, nil
+}
@@ -0,0 +1,190 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"zenith/shared/config"
+)
+
+func TestNewTunnelProvider(t *testing.T) {
+	tests := []struct {
+		cfg  config.TunnelConfig
+		want TunnelProvider
+	}{
+		{config.TunnelConfig{NgrokAPIURL: "http://localhost:4040", NgrokAuthToken: "tok"}, &ngrokProvider{apiURL: "http://localhost:4040", authToken: "tok"}},
+		{config.TunnelConfig{Provider: "ngrok", NgrokAPIURL: "http://agent:4040"}, &ngrokProvider{apiURL: "http://agent:4040"}},
+		{config.TunnelConfig{Provider: "cloudflared", CloudflaredBin: "/usr/bin/cloudflared"}, &cloudflaredProvider{binary: "/usr/bin/cloudflared"}},
+		{config.TunnelConfig{Provider: "ssh", SSHTarget: "tunnel@example.com", SSHKey: "id_ed25519", PublicURL: "https://{port}.example.com"}, &sshProvider{target: "tunnel@example.com", keyFile: "id_ed25519", urlTemplate: "https://{port}.example.com"}},
+		{config.TunnelConfig{Provider: "none", PublicURL: "https://{name}.example.com"}, &noneProvider{urlTemplate: "https://{name}.example.com"}},
+	}
+	for _, tt := range tests {
+		got, err := newTunnelProvider(tt.cfg)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("newTunnelProvider(%+v) = %#v, %v; want %#v", tt.cfg, got, err, tt.want)
+		}
+	}
+	if _, err := newTunnelProvider(config.TunnelConfig{Provider: "localtunnel"}); err == nil {
+		t.Error("unknown provider accepted")
+	}
+}
+
+func TestNgrokPublicURL(t *testing.T) {
+	var created map[string]string
+	closed := ""
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/tunnels", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /api/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&created)
+		w.WriteHeader(http.StatusCreated)
+		if created["addr"] == "127.0.0.1:1" {
+			w.Write([]byte(`{"name":"x"}`))
+			return
+		}
+		w.Write([]byte(`{"name":"zenith-d1","public_url":"https://d1.ngrok.app","proto":"https"}`))
+	})
+	mux.HandleFunc("DELETE /api/tunnels/{name}", func(w http.ResponseWriter, r *http.Request) {
+		closed = r.PathValue("name")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	agent := httptest.NewServer(mux)
+	defer agent.Close()
+
+	p := &ngrokProvider{apiURL: agent.URL}
+	tunnel, err := p.Open(context.Background(), "zenith-d1", "127.0.0.1:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.PublicURL() != "https://d1.ngrok.app" {
+		t.Errorf("PublicURL = %q", tunnel.PublicURL())
+	}
+	if created["name"] != "zenith-d1" || created["proto"] != "http" || created["addr"] != "127.0.0.1:8000" {
+		t.Errorf("created tunnel %v", created)
+	}
+	if err := tunnel.Close(); err != nil || closed != "zenith-d1" {
+		t.Errorf("Close = %v, closed %q", err, closed)
+	}
+	if _, err := p.Open(context.Background(), "zenith-d2", "127.0.0.1:1"); err == nil {
+		t.Error("response without a public URL accepted")
+	}
+}
+
+// fakeCommand writes an executable shell script name to a directory and
+// returns its path.
+func fakeCommand(t *testing.T, name, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProcessTunnelPublicURLs(t *testing.T) {
+	ctx := context.Background()
+
+	cloudflared := fakeCommand(t, "cloudflared", `
+echo "INF Requesting new quick Tunnel on trycloudflare.com..." >&2
+echo "INF |  https://quiet-river-1234.trycloudflare.com  |" >&2
+exec sleep 60
+`)
+	tunnel, err := (&cloudflaredProvider{binary: cloudflared}).Open(ctx, "zenith-d1", "127.0.0.1:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.PublicURL() != "https://quiet-river-1234.trycloudflare.com" {
+		t.Errorf("cloudflared PublicURL = %q", tunnel.PublicURL())
+	}
+	tunnel.Close()
+
+	if _, err := (&cloudflaredProvider{binary: fakeCommand(t, "cloudflared", "echo failed; exit 1\n")}).Open(ctx, "zenith-d1", "127.0.0.1:8000"); err == nil {
+		t.Error("cloudflared exiting without a URL succeeded")
+	}
+
+	ssh := fakeCommand(t, "ssh", `
+echo "Allocated port 43022 for remote forward to 127.0.0.1:8000" >&2
+exec sleep 60
+`)
+	t.Setenv("PATH", filepath.Dir(ssh)+string(os.PathListSeparator)+os.Getenv("PATH"))
+	p := &sshProvider{target: "tunnel@example.com", urlTemplate: "https://{port}.tunnel.example.com/{name}?to={addr}"}
+	tunnel, err = p.Open(ctx, "zenith-d1", "127.0.0.1:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://43022.tunnel.example.com/zenith-d1?to=127.0.0.1:8000"; tunnel.PublicURL() != want {
+		t.Errorf("ssh PublicURL = %q, want %q", tunnel.PublicURL(), want)
+	}
+	tunnel.Close()
+}
+
+func TestNonePublicURL(t *testing.T) {
+	for template, want := range map[string]string{
+		"":                            "http://127.0.0.1:8000",
+		"https://{name}.example.com":  "https://zenith-d1.example.com",
+		"https://{port}.example.com/": "https://8000.example.com/",
+	} {
+		tunnel, err := (&noneProvider{urlTemplate: template}).Open(context.Background(), "zenith-d1", "127.0.0.1:8000")
+		if err != nil || tunnel.PublicURL() != want {
+			t.Errorf("template %q: PublicURL = %q, %v; want %q", template, tunnel.PublicURL(), err, want)
+		}
+	}
+}
+
+func TestDeploymentListensOnLoopback(t *testing.T) {
+	tunnelProvider = &noneProvider{}
+	d, err := startDeployment(context.Background(), "d1", "loopback-site", http.NotFoundHandler(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(deployments.closeAll)
+
+	host, _, err := net.SplitHostPort(d.LocalAddr)
+	if err != nil || host != "127.0.0.1" {
+		t.Errorf("LocalAddr = %q, want a loopback address", d.LocalAddr)
+	}
+	resp, err := http.Get(d.PublicURL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+func TestNgrokAgentGetsAuthTokenFromEnvironment(t *testing.T) {
+	record := filepath.Join(t.TempDir(), "ngrok.args")
+	ngrok := fakeCommand(t, "ngrok", `
+echo "$* token=$NGROK_AUTHTOKEN" > `+record+`.tmp && mv `+record+`.tmp `+record+`
+exec sleep 60
+`)
+	t.Setenv("PATH", filepath.Dir(ngrok)+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// The agent API answers once the fake agent has started.
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := os.Stat(record); err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer agent.Close()
+
+	p := &ngrokProvider{apiURL: agent.URL, authToken: "2abcSecret"}
+	if err := p.ensureAgent(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	got, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "start --none token=2abcSecret\n"; string(got) != want {
+		t.Errorf("ngrok ran with %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,188 @@
+// Package apierr is the error format the zenith services answer with. An
+// error response is a JSON object:
+//
+//	{"error": "npm build failed: exit status 1", "code": "build_failed", "stage": "build", "retryable": false}
+//
+// code is one of the Code constants, each answered with its own HTTP
+// status, stage is the step that failed and retryable says whether trying
+// the same request again may succeed.
+package apierr
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/redact"
+	"zenith/shared/retry"
+)
+
+// Error codes, the same in every service.
+const (
+	CodeInvalidRequest = "invalid_request"
+	CodeUnauthorized   = "unauthorized"
+	CodeForbidden      = "forbidden"
+	CodeNotFound       = "not_found"
+	CodeConflict       = "conflict"
+	CodeTooLarge       = "too_large"
+	// CodeBlocked is a deploy refused because of what the repository holds.
+	CodeBlocked = "blocked"
+	// CodeCloneFailed and CodeBuildFailed are a repository that could not
+	// be cloned or built.
+	CodeCloneFailed = "clone_failed"
+	CodeBuildFailed = "build_failed"
+	// CodeStorage is object storage failing.
+	CodeStorage = "storage_error"
+	// CodeUnavailable is a service that could not be reached or is
+	// shutting down.
+	CodeUnavailable = "unavailable"
+	// CodeInterrupted is a deploy a restart stopped.
+	CodeInterrupted = "interrupted"
+	CodeInternal    = "internal"
+)
+
+// statuses are the HTTP statuses of the codes.
+var statuses = map[string]int{
+	CodeInvalidRequest: http.StatusBadRequest,
+	CodeUnauthorized:   http.StatusUnauthorized,
+	CodeForbidden:      http.StatusForbidden,
+	CodeNotFound:       http.StatusNotFound,
+	CodeConflict:       http.StatusConflict,
+	CodeTooLarge:       http.StatusRequestEntityTooLarge,
+	CodeBlocked:        http.StatusUnprocessableEntity,
+	CodeCloneFailed:    http.StatusUnprocessableEntity,
+	CodeBuildFailed:    http.StatusUnprocessableEntity,
+	CodeStorage:        http.StatusBadGateway,
+	CodeUnavailable:    http.StatusServiceUnavailable,
+	CodeInterrupted:    http.StatusServiceUnavailable,
+	CodeInternal:       http.StatusInternalServerError,
+}
+
+// Error is an error response.
+type Error struct {
+	Code      string `json:"code"`
+	Stage     string `json:"stage,omitempty"`
+	Message   string `json:"error"`
+	Retryable bool   `json:"retryable"`
+	// Status is the HTTP status the error is answered with.
+	Status int `json:"-"`
+
+	err error
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func (e *Error) Unwrap() error { return e.err }
+
+// Transient makes retry.Transient follow Retryable.
+func (e *Error) Transient() bool { return e.Retryable }
+
+// Body returns the JSON body of e, with its message redacted, for handlers
+// that add fields to it.
+func (e *Error) Body() gin.H {
+	return gin.H{
+		"error":     redact.String(e.Message),
+		"code":      e.Code,
+		"stage":     e.Stage,
+		"retryable": e.Retryable,
+	}
+}
+
+// New returns an error with code, failing in stage.
+func New(code, stage, message string) *Error {
+	return &Error{
+		Code:      code,
+		Stage:     stage,
+		Message:   message,
+		Retryable: code == CodeUnavailable || code == CodeInterrupted,
+		Status:    Status(code),
+	}
+}
+
+// Wrap returns err as an *Error failing in stage, or nil for a nil err. An
+// err that already carries an *Error, such as one a service answered with,
+// keeps its code and retryability; otherwise they are code and whether err
+// is transient.
+func Wrap(err error, code, stage string) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		wrapped := *e
+		wrapped.Stage, wrapped.Message, wrapped.err = stage, err.Error(), err
+		return &wrapped
+	}
+	wrapped := New(code, stage, err.Error())
+	wrapped.Retryable = wrapped.Retryable || retry.Transient(err)
+	wrapped.err = err
+	return wrapped
+}
+
+// From returns the *Error err carries, or err as an internal error.
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return Wrap(err, CodeInternal, "").(*Error)
+}
+
+// Status returns the HTTP status of code.
+func Status(code string) int {
+	if status, ok := statuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Respond answers c with err. A request cancelled because the service is
+// shutting down is answered as unavailable, so that the caller tries again
+// once it is back.
+func Respond(c *gin.Context, err error) {
+	e := From(err)
+	if c.Request.Context().Err() != nil {
+		e = &Error{Code: CodeUnavailable, Stage: e.Stage, Message: "service shutting down: " + e.Message, Retryable: true, Status: http.StatusServiceUnavailable}
+	}
+	c.JSON(e.Status, e.Body())
+}
+
+// Decode returns the error of a response with status and body. Bodies
+// without a code, such as those of proxies or older services, get the code
+// of their status.
+func Decode(status int, body []byte) *Error {
+	var e Error
+	if json.Unmarshal(body, &e) != nil || e.Message == "" {
+		e = Error{Message: http.StatusText(status)}
+	}
+	if e.Code == "" {
+		e.Code = code(status)
+		e.Retryable = retry.Status(status)
+	}
+	e.Status = status
+	return &e
+}
+
+// code returns the code answered with status.
+func code(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeTooLarge
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return CodeUnavailable
+	}
+	if status < 500 {
+		return CodeInvalidRequest
+	}
+	return CodeInternal
+}
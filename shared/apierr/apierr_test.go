@@ -0,0 +1,93 @@
+package apierr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/retry"
+)
+
+func TestWrap(t *testing.T) {
+	notFound := errors.New("site.zip not found")
+	tests := []struct {
+		name      string
+		err       error
+		code      string
+		retryable bool
+	}{
+		{"takes the code given", notFound, CodeNotFound, false},
+		{"keeps the code carried", fmt.Errorf("build: %w", New(CodeBuildFailed, "npm_build", "npm build failed")), CodeBuildFailed, false},
+		{"retries transient errors", fmt.Errorf("put: %w", syscall.ECONNRESET), CodeStorage, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e *Error
+			if !errors.As(Wrap(tt.err, tt.code, "build"), &e) {
+				t.Fatal("not an *Error")
+			}
+			if e.Code != tt.code || e.Stage != "build" || e.Retryable != tt.retryable || e.Message != tt.err.Error() {
+				t.Errorf("Wrap = %+v", e)
+			}
+			if !errors.Is(e, tt.err) || retry.Transient(e) != tt.retryable {
+				t.Errorf("Wrap lost %v", tt.err)
+			}
+		})
+	}
+	if Wrap(nil, CodeInternal, "") != nil {
+		t.Error("Wrap(nil) != nil")
+	}
+}
+
+func TestRespondDecode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name      string
+		err       error
+		cancelled bool
+		status    int
+		code      string
+	}{
+		{"apierr error", New(CodeTooLarge, "package", "repository is larger than the upload limit"), false, http.StatusRequestEntityTooLarge, CodeTooLarge},
+		{"other error", errors.New("disk full"), false, http.StatusInternalServerError, CodeInternal},
+		{"shutting down", New(CodeBuildFailed, "npm_build", "signal: killed"), true, http.StatusServiceUnavailable, CodeUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.cancelled {
+				cancel()
+			}
+			defer cancel()
+			c.Request = httptest.NewRequest(http.MethodPost, "/build", nil).WithContext(ctx)
+			Respond(c, tt.err)
+
+			e := Decode(rec.Code, rec.Body.Bytes())
+			if e.Status != tt.status || e.Code != tt.code || e.Retryable != (tt.code == CodeUnavailable) {
+				t.Errorf("Respond answered %d %s, decoded as %+v", rec.Code, rec.Body, e)
+			}
+		})
+	}
+}
+
+func TestDecodeWithoutCode(t *testing.T) {
+	for status, want := range map[int]*Error{
+		http.StatusNotFound:            {Code: CodeNotFound, Message: "Not Found"},
+		http.StatusBadGateway:          {Code: CodeUnavailable, Message: "Bad Gateway", Retryable: true},
+		http.StatusUnprocessableEntity: {Code: CodeInvalidRequest, Message: "Unprocessable Entity"},
+	} {
+		body, _ := json.Marshal(gin.H{"message": "no error field"})
+		e := Decode(status, body)
+		if e.Code != want.Code || e.Message != want.Message || e.Retryable != want.Retryable {
+			t.Errorf("Decode(%d) = %+v, want %+v", status, e, want)
+		}
+	}
+}
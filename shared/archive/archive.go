@@ -0,0 +1,283 @@
+// Package archive extracts zip archives built from untrusted repositories.
+//
+// Extraction keeps every entry inside the destination, never writes through
+// a symbolic link, only creates links whose targets stay inside the
+// destination, caps the number of entries, their total size and their
+// compression ratio, and gives files 0644 or 0755 and directories 0755
+// regardless of the modes stored in the archive.
+package archive
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrUnsafePath   = errors.New("archive entry escapes the destination")
+	ErrUnsafeLink   = errors.New("archive symlink points outside the destination")
+	ErrUnsupported  = errors.New("archive entry is not a regular file, directory or symlink")
+	ErrTooManyFiles = errors.New("archive has too many entries")
+	ErrTooLarge     = errors.New("archive is too large when extracted")
+	ErrRatio        = errors.New("archive entry is compressed suspiciously well")
+)
+
+// Limits bound what an archive may extract to. Zero fields are unlimited.
+type Limits struct {
+	MaxFiles     int
+	MaxTotalSize int64
+	// MaxRatio caps uncompressed/compressed size of entries larger than
+	// ratioFloor.
+	MaxRatio int64
+}
+
+// DefaultLimits fit any reasonable web project and its build output.
+var DefaultLimits = Limits{
+	MaxFiles:     100_000,
+	MaxTotalSize: 2 << 30,
+	MaxRatio:     200,
+}
+
+// Entries smaller than this are too small to be a bomb whatever their ratio.
+const ratioFloor = 1 << 20
+
+// maxLinkSize bounds the target of a symlink entry.
+const maxLinkSize = 4096
+
+// ExtractAt extracts the zip archive of size bytes that r reads into dest.
+// r may be an object in storage: zip reads the directory at the end of the
+// archive first, then each entry in turn.
+func ExtractAt(r io.ReaderAt, size int64, dest string, limits Limits) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	return Extract(zr, dest, limits)
+}
+
+// Extract extracts r into dest, creating dest if needed.
+func Extract(r *zip.Reader, dest string, limits Limits) error {
+	if limits.MaxFiles > 0 && len(r.File) > limits.MaxFiles {
+		return fmt.Errorf("%w: %d entries, limit %d", ErrTooManyFiles, len(r.File), limits.MaxFiles)
+	}
+	// Reject archives whose headers already admit to being too large; the
+	// actual sizes are enforced while copying.
+	var claimed uint64
+	for _, f := range r.File {
+		claimed += f.UncompressedSize64
+	}
+	if limits.MaxTotalSize > 0 && claimed > uint64(limits.MaxTotalSize) {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrTooLarge, claimed, limits.MaxTotalSize)
+	}
+
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	x := &extractor{dest: dest, limits: limits, through: map[string]bool{}}
+	for _, f := range r.File {
+		if err := x.extract(f); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+type extractor struct {
+	dest    string
+	limits  Limits
+	written int64
+	// through holds the paths, relative to dest, that symlink targets pass
+	// through as directories.
+	through map[string]bool
+}
+
+func (x *extractor) extract(f *zip.File) error {
+	name := strings.TrimSuffix(f.Name, "/")
+	if !filepath.IsLocal(name) || strings.Contains(name, `\`) {
+		return ErrUnsafePath
+	}
+	target := filepath.Join(x.dest, filepath.FromSlash(name))
+	if err := x.checkParents(target); err != nil {
+		return err
+	}
+
+	mode := f.Mode()
+	switch {
+	case mode.IsDir():
+		return os.MkdirAll(target, 0755)
+	case mode&fs.ModeSymlink != 0:
+		return x.symlink(f, name, target)
+	case mode.IsRegular():
+		return x.file(f, target, mode)
+	default:
+		return ErrUnsupported
+	}
+}
+
+// checkParents creates the directories above target and makes sure none of
+// them, nor target itself, is a symlink, so nothing is written through one.
+func (x *extractor) checkParents(target string) error {
+	rel, _ := filepath.Rel(x.dest, target)
+	dir := x.dest
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			if i == len(parts)-1 {
+				return nil
+			}
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return ErrUnsafePath
+		}
+		if i < len(parts)-1 && !info.IsDir() {
+			return ErrUnsafePath
+		}
+	}
+	return nil
+}
+
+func (x *extractor) symlink(f *zip.File, name, target string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	link, err := io.ReadAll(io.LimitReader(rc, maxLinkSize+1))
+	if err != nil {
+		return err
+	}
+	if len(link) > maxLinkSize {
+		return ErrUnsafeLink
+	}
+
+	dest := string(link)
+	if x.through[path.Clean(name)] {
+		return ErrUnsafeLink
+	}
+	if err := x.checkLink(name, dest); err != nil {
+		return err
+	}
+	if err := x.count(int64(len(link))); err != nil {
+		return err
+	}
+	return os.Symlink(filepath.FromSlash(dest), target)
+}
+
+// checkLink makes sure the target of the link name stays inside the
+// destination when it is followed. The parents of the link are real
+// directories (checkParents), and so must be every directory the target
+// passes through, for the target to be resolved lexically. Those that do
+// not exist yet are recorded so that no later entry makes them symlinks.
+func (x *extractor) checkLink(name, dest string) error {
+	if path.IsAbs(dest) || strings.Contains(dest, `\`) {
+		return ErrUnsafeLink
+	}
+	var resolved []string
+	if dir := path.Dir(path.Clean(name)); dir != "." {
+		resolved = strings.Split(dir, "/")
+	}
+	var through []string
+	parts := strings.Split(dest, "/")
+	for i, part := range parts {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return ErrUnsafeLink
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		resolved = append(resolved, part)
+		if i == len(parts)-1 {
+			break
+		}
+		rel := strings.Join(resolved, "/")
+		info, err := os.Lstat(filepath.Join(x.dest, filepath.FromSlash(rel)))
+		if err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return ErrUnsafeLink
+		}
+		through = append(through, rel)
+	}
+	for _, rel := range through {
+		x.through[rel] = true
+	}
+	return nil
+}
+
+func (x *extractor) file(f *zip.File, target string, mode fs.FileMode) error {
+	perm := fs.FileMode(0644)
+	if mode&0111 != 0 {
+		perm = 0755
+	}
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// Copy in chunks so sizes are checked against what the entry really
+	// inflates to rather than what its header claims.
+	buf := make([]byte, 32*1024)
+	var n int64
+	for {
+		m, readErr := rc.Read(buf)
+		if m > 0 {
+			n += int64(m)
+			if err := x.count(int64(m)); err != nil {
+				return err
+			}
+			if x.limits.MaxRatio > 0 && n > ratioFloor && n > int64(f.CompressedSize64)*x.limits.MaxRatio {
+				return ErrRatio
+			}
+			if _, err := out.Write(buf[:m]); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	return out.Close()
+}
+
+func (x *extractor) count(n int64) error {
+	x.written += n
+	if x.limits.MaxTotalSize > 0 && x.written > x.limits.MaxTotalSize {
+		return fmt.Errorf("%w: limit %d bytes", ErrTooLarge, x.limits.MaxTotalSize)
+	}
+	return nil
+}
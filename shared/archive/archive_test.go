@@ -0,0 +1,180 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type entry struct {
+	name string
+	mode fs.FileMode
+	body string
+}
+
+func buildZip(t testing.TB, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		h.SetMode(e.mode)
+		f, err := w.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(e.body))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func extractBytes(data []byte, dest string, limits Limits) error {
+	return ExtractAt(bytes.NewReader(data), int64(len(data)), dest, limits)
+}
+
+func TestExtract(t *testing.T) {
+	dest := t.TempDir()
+	data := buildZip(t,
+		entry{"site/", fs.ModeDir | 0777, ""},
+		entry{"site/index.html", 0666 | fs.ModeSetuid, "<h1>hi</h1>"},
+		entry{"site/run.sh", 0777, "#!/bin/sh"},
+		entry{"site/latest", fs.ModeSymlink | 0777, "index.html"},
+		entry{"nested/deep/file.txt", 0600, "x"},
+	)
+	if err := extractBytes(data, dest, DefaultLimits); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]fs.FileMode{
+		"site":                 fs.ModeDir | 0755,
+		"site/index.html":      0644,
+		"site/run.sh":          0755,
+		"nested/deep/file.txt": 0644,
+	} {
+		info, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%s: mode %v, want %v", name, info.Mode(), want)
+		}
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "site/latest")); string(got) != "<h1>hi</h1>" {
+		t.Errorf("symlink reads %q", got)
+	}
+}
+
+func TestExtractRejectsMaliciousArchives(t *testing.T) {
+	bomb := strings.Repeat("0", 4<<20)
+	tests := []struct {
+		name    string
+		entries []entry
+		limits  Limits
+		want    error
+	}{
+		{"zip slip", []entry{{"../evil.txt", 0644, "x"}}, DefaultLimits, ErrUnsafePath},
+		{"nested zip slip", []entry{{"a/../../evil.txt", 0644, "x"}}, DefaultLimits, ErrUnsafePath},
+		{"absolute path", []entry{{"/tmp/evil.txt", 0644, "x"}}, DefaultLimits, ErrUnsafePath},
+		{"backslashes", []entry{{`..\evil.txt`, 0644, "x"}}, DefaultLimits, ErrUnsafePath},
+		{"absolute symlink", []entry{{"link", fs.ModeSymlink | 0777, "/etc"}}, DefaultLimits, ErrUnsafeLink},
+		{"escaping symlink", []entry{{"a/link", fs.ModeSymlink | 0777, "../../etc"}}, DefaultLimits, ErrUnsafeLink},
+		{"write through symlink", []entry{
+			{"dir/", fs.ModeDir | 0755, ""},
+			{"link", fs.ModeSymlink | 0777, "dir"},
+			{"link/file", 0644, "x"},
+		}, DefaultLimits, ErrUnsafePath},
+		{"overwrite symlink", []entry{
+			{"link", fs.ModeSymlink | 0777, "file"},
+			{"link", 0644, "x"},
+		}, DefaultLimits, ErrUnsafePath},
+		{"symlink through symlink", []entry{
+			{"b/", fs.ModeDir | 0755, ""},
+			{"b/c", fs.ModeSymlink | 0777, ".."},
+			{"x", fs.ModeSymlink | 0777, "b/c/../evil.txt"},
+		}, DefaultLimits, ErrUnsafeLink},
+		{"symlink under a symlink target", []entry{
+			{"x", fs.ModeSymlink | 0777, "b/c/../evil.txt"},
+			{"b/", fs.ModeDir | 0755, ""},
+			{"b/c", fs.ModeSymlink | 0777, ".."},
+		}, DefaultLimits, ErrUnsafeLink},
+		{"named pipe", []entry{{"pipe", fs.ModeNamedPipe | 0644, ""}}, DefaultLimits, ErrUnsupported},
+		{"too many files", []entry{{"a", 0644, ""}, {"b", 0644, ""}, {"c", 0644, ""}}, Limits{MaxFiles: 2}, ErrTooManyFiles},
+		{"too large", []entry{{"a", 0644, "0123456789"}, {"b", 0644, "0123456789"}}, Limits{MaxTotalSize: 15}, ErrTooLarge},
+		{"bomb", []entry{{"zeros", 0644, bomb}}, Limits{MaxRatio: 100}, ErrRatio},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dest := filepath.Join(parent, "dest")
+			err := extractBytes(buildZip(t, tt.entries...), dest, tt.limits)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			if _, err := os.Stat(filepath.Join(parent, "evil.txt")); err == nil {
+				t.Error("file written outside the destination")
+			}
+		})
+	}
+}
+
+// FuzzExtract checks that no archive, however malformed, writes outside the
+// destination, leaves a symlink pointing outside it, exceeds the size limit
+// or creates files with modes other than the normalized ones.
+func FuzzExtract(f *testing.F) {
+	for _, entries := range [][]entry{
+		{{"index.html", 0644, "hello"}},
+		{{"../evil", 0644, "x"}},
+		{{"a/", fs.ModeDir | 0755, ""}, {"a/link", fs.ModeSymlink | 0777, "../.."}},
+		{{"link", fs.ModeSymlink | 0777, "."}, {"link/x", 0644, "x"}},
+		{{"zeros", 0644, strings.Repeat("0", 1<<16)}},
+	} {
+		f.Add(buildZip(f, entries...))
+	}
+
+	limits := Limits{MaxFiles: 64, MaxTotalSize: 1 << 16, MaxRatio: 50}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "dest")
+		extractBytes(data, dest, limits)
+
+		entries, _ := os.ReadDir(parent)
+		if len(entries) > 1 {
+			t.Fatalf("extraction wrote outside the destination: %v", entries)
+		}
+		var total int64
+		filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			info, _ := d.Info()
+			switch {
+			case d.Type()&fs.ModeSymlink != 0:
+				resolved, err := filepath.EvalSymlinks(path)
+				if err == nil && !strings.HasPrefix(resolved+string(filepath.Separator), dest+string(filepath.Separator)) {
+					t.Fatalf("%s resolves outside the destination to %s", path, resolved)
+				}
+			case d.IsDir():
+				if info.Mode().Perm() != 0755 {
+					t.Fatalf("%s has mode %v", path, info.Mode())
+				}
+			default:
+				if !info.Mode().IsRegular() || (info.Mode().Perm() != 0644 && info.Mode().Perm() != 0755) {
+					t.Fatalf("%s has mode %v", path, info.Mode())
+				}
+				total += info.Size()
+			}
+			return nil
+		})
+		if total > limits.MaxTotalSize {
+			t.Fatalf("extracted %d bytes, limit %d", total, limits.MaxTotalSize)
+		}
+	})
+}
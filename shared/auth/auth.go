@@ -0,0 +1,435 @@
+// Package auth manages user accounts and the API keys that authenticate
+// requests to every Zenith service.
+//
+// Keys are random bearer tokens of the form zen_<id>_<secret>. Only a
+// SHA-256 hash of each token is stored; passwords are hashed with bcrypt.
+// Users and keys live in one JSON file that request_handler writes and the
+// other services re-read whenever it changes.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Scopes a key can be granted. Admin implies every other scope.
+const (
+	ScopeRead   = "read"
+	ScopeDeploy = "deploy"
+	ScopeAdmin  = "admin"
+)
+
+// AllScopes lists every valid scope.
+var AllScopes = []string{ScopeRead, ScopeDeploy, ScopeAdmin}
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrInvalidToken       = errors.New("invalid or expired API key")
+	ErrUserExists         = errors.New("user already exists")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrKeyNotFound        = errors.New("API key not found")
+	ErrInvalidScope       = errors.New("invalid scope")
+)
+
+const tokenPrefix = "zen_"
+
+type User struct {
+	ID           string    `json:"id"`
+	Email        string    `json:"email"`
+	PasswordHash string    `json:"password_hash"`
+	Scopes       []string  `json:"scopes"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type APIKey struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID string
+	Email  string
+	KeyID  string
+	Scopes []string
+}
+
+// Can reports whether the principal has been granted scope.
+func (p *Principal) Can(scope string) bool {
+	return hasScope(p.Scopes, scope)
+}
+
+func hasScope(scopes []string, scope string) bool {
+	return slices.Contains(scopes, ScopeAdmin) || slices.Contains(scopes, scope)
+}
+
+// ValidateScopes checks that every scope is known and that at least one is
+// given.
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+	for _, s := range scopes {
+		if !slices.Contains(AllScopes, s) {
+			return fmt.Errorf("%w: %q", ErrInvalidScope, s)
+		}
+	}
+	return nil
+}
+
+type storeData struct {
+	Users []*User   `json:"users"`
+	Keys  []*APIKey `json:"keys"`
+}
+
+// Store holds users and API keys, persisted to a JSON file.
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	data    storeData
+}
+
+// Open loads the store at path. A missing file is an empty store.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+	if err := s.reload(); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// reload re-reads the file if another process changed it. The caller must
+// hold s.mu.
+func (s *Store) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var data storeData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return err
+	}
+	s.data = data
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save writes the store atomically. The caller must hold s.mu.
+func (s *Store) save() error {
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// HasUsers reports whether any account exists.
+func (s *Store) HasUsers() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reload()
+	return len(s.data.Users) > 0
+}
+
+// CreateUser adds an account that may hold keys with the given scopes.
+func (s *Store) CreateUser(email, password string, scopes []string) (*User, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" || !strings.Contains(email, "@") {
+		return nil, fmt.Errorf("invalid email %q", email)
+	}
+	if len(password) < 8 {
+		return nil, errors.New("password must be at least 8 characters")
+	}
+	if err := ValidateScopes(scopes); err != nil {
+		return nil, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	if s.userByEmail(email) != nil {
+		return nil, ErrUserExists
+	}
+
+	user := &User{
+		ID:           randomID(),
+		Email:        email,
+		PasswordHash: string(hash),
+		Scopes:       scopes,
+		CreatedAt:    time.Now().UTC(),
+	}
+	s.data.Users = append(s.data.Users, user)
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	copied := *user
+	return &copied, nil
+}
+
+// Users returns every account.
+func (s *Store) Users() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reload()
+	users := make([]User, 0, len(s.data.Users))
+	for _, u := range s.data.Users {
+		users = append(users, *u)
+	}
+	return users
+}
+
+// UserByEmail looks up an account by email address.
+func (s *Store) UserByEmail(email string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reload()
+	u := s.userByEmail(strings.ToLower(strings.TrimSpace(email)))
+	if u == nil {
+		return User{}, false
+	}
+	return *u, true
+}
+
+func (s *Store) userByEmail(email string) *User {
+	for _, u := range s.data.Users {
+		if u.Email == email {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *Store) userByID(id string) *User {
+	for _, u := range s.data.Users {
+		if u.ID == id {
+			return u
+		}
+	}
+	return nil
+}
+
+// Login checks the password and issues a key with the user's scopes that
+// expires after ttl.
+func (s *Store) Login(email, password string, ttl time.Duration) (string, *APIKey, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	s.mu.Lock()
+	if err := s.reload(); err != nil {
+		s.mu.Unlock()
+		return "", nil, err
+	}
+	user := s.userByEmail(email)
+	var hash, userID string
+	var scopes []string
+	if user != nil {
+		hash, userID, scopes = user.PasswordHash, user.ID, user.Scopes
+	}
+	s.mu.Unlock()
+
+	if user == nil {
+		return "", nil, ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return "", nil, ErrInvalidCredentials
+	}
+	return s.CreateKey(userID, "login", scopes, ttl)
+}
+
+// CreateKey issues a key for userID. The scopes must be within the user's
+// own scopes; ttl of zero means the key never expires. The token is only
+// returned here and cannot be recovered later.
+func (s *Store) CreateKey(userID, name string, scopes []string, ttl time.Duration) (string, *APIKey, error) {
+	if err := ValidateScopes(scopes); err != nil {
+		return "", nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return "", nil, err
+	}
+	user := s.userByID(userID)
+	if user == nil {
+		return "", nil, ErrUserNotFound
+	}
+	for _, scope := range scopes {
+		if !hasScope(user.Scopes, scope) {
+			return "", nil, fmt.Errorf("%w: user cannot grant %q", ErrInvalidScope, scope)
+		}
+	}
+
+	id := randomID()
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	token := tokenPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	key := &APIKey{
+		ID:        id,
+		UserID:    userID,
+		Name:      name,
+		Hash:      hashToken(token),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		expires := key.CreatedAt.Add(ttl)
+		key.ExpiresAt = &expires
+	}
+
+	s.pruneExpired()
+	s.data.Keys = append(s.data.Keys, key)
+	if err := s.save(); err != nil {
+		return "", nil, err
+	}
+	copied := *key
+	return token, &copied, nil
+}
+
+// pruneExpired drops keys past their expiry. The caller must hold s.mu.
+func (s *Store) pruneExpired() {
+	now := time.Now()
+	s.data.Keys = slices.DeleteFunc(s.data.Keys, func(k *APIKey) bool {
+		return k.ExpiresAt != nil && now.After(*k.ExpiresAt)
+	})
+}
+
+// Keys returns the keys of userID, or every key if userID is empty.
+func (s *Store) Keys(userID string) []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reload()
+	var keys []APIKey
+	for _, k := range s.data.Keys {
+		if userID == "" || k.UserID == userID {
+			keys = append(keys, *k)
+		}
+	}
+	return keys
+}
+
+// RevokeKey deletes key id. Unless userID is empty the key must belong to
+// that user.
+func (s *Store) RevokeKey(userID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	for i, k := range s.data.Keys {
+		if k.ID == id && (userID == "" || k.UserID == userID) {
+			s.data.Keys = slices.Delete(s.data.Keys, i, i+1)
+			return s.save()
+		}
+	}
+	return ErrKeyNotFound
+}
+
+// Authenticate resolves a bearer token to its principal.
+func (s *Store) Authenticate(token string) (*Principal, error) {
+	rest, ok := strings.CutPrefix(token, tokenPrefix)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	id, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	for _, k := range s.data.Keys {
+		if k.ID != id {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hashToken(token))) != 1 {
+			return nil, ErrInvalidToken
+		}
+		if k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt) {
+			return nil, ErrInvalidToken
+		}
+		user := s.userByID(k.UserID)
+		if user == nil {
+			return nil, ErrInvalidToken
+		}
+		// A key never grants more than its owner currently holds.
+		var scopes []string
+		for _, scope := range k.Scopes {
+			if hasScope(user.Scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		return &Principal{
+			UserID: user.ID,
+			Email:  user.Email,
+			KeyID:  k.ID,
+			Scopes: scopes,
+		}, nil
+	}
+	return nil, ErrInvalidToken
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestStore(t *testing.T) (*Store, *User) {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "auth.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := s.CreateUser("Dev@Example.com", "correct horse", []string{ScopeDeploy, ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, user
+}
+
+func TestKeysAreHashedAndScoped(t *testing.T) {
+	s, user := newTestStore(t)
+
+	token, key, err := s.CreateKey(user.ID, "ci", []string{ScopeRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(s.path)
+	if strings.Contains(string(raw), token) || strings.Contains(string(raw), "correct horse") {
+		t.Fatal("store contains a plaintext secret")
+	}
+
+	p, err := s.Authenticate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.KeyID != key.ID || !p.Can(ScopeRead) || p.Can(ScopeDeploy) {
+		t.Errorf("principal = %+v, want read-only key %s", p, key.ID)
+	}
+
+	if _, err := s.Authenticate(token + "x"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("tampered token: err = %v", err)
+	}
+	if _, _, err := s.CreateKey(user.ID, "escalate", []string{ScopeAdmin}, 0); !errors.Is(err, ErrInvalidScope) {
+		t.Errorf("granting admin: err = %v", err)
+	}
+
+	if err := s.RevokeKey("someone-else", key.ID); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("revoking another user's key: err = %v", err)
+	}
+	if err := s.RevokeKey(user.ID, key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("revoked token: err = %v", err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s, _ := newTestStore(t)
+
+	if _, _, err := s.Login("dev@example.com", "wrong", time.Hour); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password: err = %v", err)
+	}
+
+	token, key, err := s.Login(" DEV@example.com", "correct horse", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ExpiresAt == nil {
+		t.Error("login key does not expire")
+	}
+	p, err := s.Authenticate(token)
+	if err != nil || !p.Can(ScopeDeploy) {
+		t.Errorf("Authenticate = %+v, %v", p, err)
+	}
+
+	expired, _, _ := s.Login("dev@example.com", "correct horse", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, err := s.Authenticate(expired); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expired token: err = %v", err)
+	}
+}
+
+func TestStoreReloadsChangesFromOtherProcesses(t *testing.T) {
+	s, user := newTestStore(t)
+	other, err := Open(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure the write gets a new modification time.
+	time.Sleep(10 * time.Millisecond)
+	token, _, err := s.CreateKey(user.ID, "ci", []string{ScopeDeploy}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Authenticate(token); err != nil {
+		t.Errorf("second store did not pick up the new key: %v", err)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, user := newTestStore(t)
+	readToken, _, _ := s.CreateKey(user.ID, "read", []string{ScopeRead}, 0)
+	deployToken, _, _ := s.CreateKey(user.ID, "deploy", []string{ScopeDeploy}, 0)
+
+	r := gin.New()
+	r.POST("/deploy", Require(s, ScopeDeploy), func(c *gin.Context) {
+		if p, ok := FromContext(c.Request.Context()); !ok || p != Current(c) {
+			t.Error("principal not stored in the request context")
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Basic abc", http.StatusUnauthorized},
+		{"Bearer zen_nope_nope", http.StatusUnauthorized},
+		{"Bearer " + readToken, http.StatusForbidden},
+		{"Bearer " + deployToken, http.StatusNoContent},
+		{"bearer " + deployToken, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/deploy", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("Authorization %q: status = %d, want %d", tt.header, rec.Code, tt.want)
+		}
+	}
+}
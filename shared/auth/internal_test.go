@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func signedRequest(t *testing.T, secret, body string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/build?x=1", bytes.NewReader([]byte(body)))
+	if err := Sign(req, secret, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	v := NewVerifier(secret)
+	body := []byte(`{"repo":"site"}`)
+
+	req := signedRequest(t, secret, string(body))
+	if err := v.Verify(req, body); err != nil {
+		t.Fatalf("valid request: %v", err)
+	}
+	if err := v.Verify(req, body); !errors.Is(err, ErrReplayed) {
+		t.Errorf("replayed request: err = %v", err)
+	}
+
+	if err := v.Verify(signedRequest(t, secret, string(body)), []byte(`{"repo":"other"}`)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("altered body: err = %v", err)
+	}
+	if err := v.Verify(signedRequest(t, "another secret", string(body)), body); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("wrong secret: err = %v", err)
+	}
+	if err := v.Verify(httptest.NewRequest(http.MethodPost, "/build", nil), nil); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unsigned request: err = %v", err)
+	}
+
+	old := signedRequest(t, secret, string(body))
+	v.now = func() time.Time { return time.Now().Add(MaxClockSkew + time.Minute) }
+	if err := v.Verify(old, body); !errors.Is(err, ErrStale) {
+		t.Errorf("stale request: err = %v", err)
+	}
+}
+
+func TestRequireSigned(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const secret = "0123456789abcdef0123456789abcdef"
+
+	r := gin.New()
+	r.POST("/build", RequireSigned(NewVerifier(secret)), func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, string(body))
+	})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, signedRequest(t, secret, "payload"))
+	if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+		t.Errorf("signed request: %d %q", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/build", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned request: status = %d", rec.Code)
+	}
+
+	// Large bodies are refused before they are buffered, signed or not.
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/build", strings.NewReader(strings.Repeat("x", MaxSignedBody+1))))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large unsigned request: status = %d", rec.Code)
+	}
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const principalKey = "auth.principal"
+
+type contextKey struct{}
+
+// Require authenticates the bearer token of each request against s and
+// rejects callers without scope.
+func Require(s *Store, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c.GetHeader("Authorization"))
+		if !ok {
+			c.Header("WWW-Authenticate", `Bearer realm="zenith"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
+			return
+		}
+		p, err := s.Authenticate(token)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="zenith", error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if scope != "" && !p.Can(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + scope + " scope"})
+			return
+		}
+
+		c.Set(principalKey, p)
+		c.Request = c.Request.WithContext(NewContext(c.Request.Context(), p))
+		c.Next()
+	}
+}
+
+// Current returns the principal authenticated by Require.
+func Current(c *gin.Context) *Principal {
+	p, _ := c.Get(principalKey)
+	principal, _ := p.(*Principal)
+	return principal
+}
+
+// NewContext returns a copy of ctx carrying p.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal stored in ctx, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(contextKey{}).(*Principal)
+	return p, ok
+}
+
+func bearerToken(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
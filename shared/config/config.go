@@ -0,0 +1,237 @@
+// Package config loads the settings shared by Zenith's services from
+// defaults, a JSON config file, environment variables and command-line
+// flags, in increasing order of precedence.
+//
+// Every setting is declared once as a struct field. Its tags describe where
+// it comes from and how it is checked:
+//
+//	json     name in the config file; the dotted path is also the flag name
+//	env      environment variable
+//	required services that need the setting ("all" for every service,
+//	         "split" for every service run on its own)
+//	validate addr, url, bucket, duration, size, minlen=n or oneof=a|b|c
+//	backend  storage backend the setting applies to
+//	secret   redacted by --print-config
+package config
+
+// Service names passed to Load.
+const (
+	RequestHandler = "request_handler"
+	Upload         = "upload"
+	Build          = "build"
+	// Server runs every service in one process.
+	Server = "server"
+	// Edge serves deployed sites from storage, without the deploy API.
+	Edge = "edge"
+)
+
+type Config struct {
+	Storage        StorageConfig        `json:"storage"`
+	GitHub         GitHubConfig         `json:"github"`
+	Auth           AuthConfig           `json:"auth"`
+	Services       ServicesConfig       `json:"services"`
+	RequestHandler RequestHandlerConfig `json:"request_handler"`
+	Upload         UploadConfig         `json:"upload"`
+	Build          BuildConfig          `json:"build"`
+	Tracing        TracingConfig        `json:"tracing"`
+	Health         HealthConfig         `json:"health"`
+	Shutdown       ShutdownConfig       `json:"shutdown"`
+	Retry          RetryConfig          `json:"retry"`
+}
+
+// StorageConfig is where source and build archives are kept: an
+// S3-compatible bucket (Backblaze B2 by default) or a local directory.
+type StorageConfig struct {
+	Backend   string `json:"backend" env:"STORAGE_BACKEND" validate:"oneof=s3|local" usage:"storage backend: s3 or local"`
+	Endpoint  string `json:"endpoint" env:"B2_ENDPOINT" required:"all" backend:"s3" usage:"storage endpoint as host[:port]"`
+	Region    string `json:"region" env:"B2_REGION" backend:"s3" usage:"storage region"`
+	AccessKey string `json:"access_key" env:"B2_ACCESS_KEY" required:"all" backend:"s3" secret:"true" usage:"storage access key"`
+	SecretKey string `json:"secret_key" env:"B2_SECRET_KEY" required:"all" backend:"s3" secret:"true" usage:"storage secret key"`
+	Bucket    string `json:"bucket" env:"B2_BUCKET" required:"all" backend:"s3" validate:"bucket" usage:"bucket for source and build archives"`
+	UseSSL    bool   `json:"use_ssl" env:"B2_USE_SSL" backend:"s3" usage:"connect to the storage endpoint over HTTPS"`
+	LocalDir  string `json:"local_dir" env:"STORAGE_LOCAL_DIR" required:"all" backend:"local" usage:"directory for the local storage backend"`
+}
+
+// GitHubConfig sets how repositories are cloned. With a GitHub App, each
+// deploy clones with a short-lived token of an installation the deploying
+// user has connected; otherwise every clone uses Token, or no token for
+// public repositories.
+type GitHubConfig struct {
+	Token        string `json:"token" env:"GITHUB_TOKEN" secret:"true" usage:"token used to clone repositories when no GitHub App is configured"`
+	APIURL       string `json:"api_url" env:"GITHUB_API_URL" validate:"url" usage:"GitHub REST API base URL"`
+	WebURL       string `json:"web_url" env:"GITHUB_WEB_URL" validate:"url" usage:"GitHub web base URL for app installation and OAuth"`
+	AppID        string `json:"app_id" env:"GITHUB_APP_ID" usage:"GitHub App ID; enables per-user installation tokens"`
+	AppSlug      string `json:"app_slug" env:"GITHUB_APP_SLUG" usage:"GitHub App slug used in installation links"`
+	AppKeyFile   string `json:"app_key_file" env:"GITHUB_APP_KEY_FILE" usage:"PEM private key of the GitHub App"`
+	ClientID     string `json:"client_id" env:"GITHUB_CLIENT_ID" usage:"OAuth client ID of the GitHub App"`
+	ClientSecret string `json:"client_secret" env:"GITHUB_CLIENT_SECRET" secret:"true" usage:"OAuth client secret of the GitHub App"`
+}
+
+// AuthConfig locates the users and API keys request_handler authenticates
+// requests against, and the secret it signs its calls to upload and build
+// with. Split deployments must give all services the same secret.
+type AuthConfig struct {
+	File           string `json:"file" env:"AUTH_FILE" required:"request_handler" usage:"JSON file holding users and API keys"`
+	InternalSecret string `json:"internal_secret" env:"INTERNAL_SECRET" required:"split" validate:"minlen=32" secret:"true" usage:"shared secret signing calls between services"`
+	SessionTTL     string `json:"session_ttl" env:"SESSION_TTL" validate:"duration" usage:"lifetime of API keys issued by login"`
+	AdminEmail     string `json:"admin_email" env:"ADMIN_EMAIL" usage:"email of the admin account created when no users exist"`
+	AdminPassword  string `json:"admin_password" env:"ADMIN_PASSWORD" secret:"true" usage:"password of the bootstrap admin account"`
+}
+
+// ServicesConfig holds the internal addresses request_handler uses to reach
+// its peers.
+type ServicesConfig struct {
+	UploadURL string `json:"upload_url" env:"UPLOAD_SERVICE_URL" required:"request_handler" validate:"url" usage:"base URL of upload_service's internal listener"`
+	BuildURL  string `json:"build_url" env:"BUILD_SERVICE_URL" required:"request_handler" validate:"url" usage:"base URL of build_service's internal listener"`
+}
+
+type RequestHandlerConfig struct {
+	Addr           string       `json:"addr" env:"REQUEST_HANDLER_ADDR" required:"request_handler" validate:"addr" usage:"listen address of the deploy API"`
+	MetricsAddr    string       `json:"metrics_addr" env:"METRICS_ADDR" validate:"addr" usage:"listen address of /metrics for Prometheus; empty disables it"`
+	LogLevel       string       `json:"log_level" env:"REQUEST_HANDLER_LOG_LEVEL" validate:"oneof=debug|info|warn|error" usage:"least severe level logged by request_handler"`
+	DataDir        string       `json:"data_dir" env:"DATA_DIR" required:"request_handler" usage:"directory for persistent state"`
+	DeployedDir    string       `json:"deployed_dir" env:"DEPLOYED_DIR" required:"request_handler" usage:"directory deployed sites are extracted to"`
+	CORSOrigins    []string     `json:"cors_origins" env:"CORS_ORIGINS" validate:"url" usage:"comma-separated origins allowed to call the API from a browser"`
+	TrustedProxies []string     `json:"trusted_proxies" env:"TRUSTED_PROXIES" validate:"cidr" usage:"comma-separated addresses or CIDRs of proxies whose X-Forwarded-For gives the client IP; empty trusts none"`
+	Template       string       `json:"template" env:"BUILD_TEMPLATE" validate:"oneof=create-react-app|next|vite" usage:"template used when a repository has no project"`
+	UseTemplate    bool         `json:"use_template" env:"BUILD_USE_TEMPLATE" usage:"ask build_service to create missing projects from the template"`
+	Tunnel         TunnelConfig `json:"tunnel"`
+	Edge           EdgeConfig   `json:"edge"`
+}
+
+type TunnelConfig struct {
+	Provider       string `json:"provider" env:"TUNNEL_PROVIDER" validate:"oneof=ngrok|cloudflared|ssh|none" usage:"tunnel provider for public URLs"`
+	PublicURL      string `json:"public_url" env:"TUNNEL_PUBLIC_URL" usage:"public URL template for ssh and none providers"`
+	NgrokAuthToken string `json:"ngrok_authtoken" env:"NGROK_AUTHTOKEN" secret:"true" usage:"ngrok agent authtoken"`
+	NgrokAPIURL    string `json:"ngrok_api_url" env:"NGROK_API_URL" validate:"url" usage:"ngrok agent API URL"`
+	CloudflaredBin string `json:"cloudflared_bin" env:"CLOUDFLARED_BIN" usage:"cloudflared binary"`
+	SSHTarget      string `json:"ssh_target" env:"TUNNEL_SSH_TARGET" usage:"user@host for ssh reverse tunnels"`
+	SSHKey         string `json:"ssh_key" env:"TUNNEL_SSH_KEY" usage:"private key for ssh reverse tunnels"`
+}
+
+// EdgeConfig sets how custom domains are served: by request_handler when
+// Enabled, or by "zenith edge" servers reading deployments from storage.
+// Edge servers share their certificates through storage rather than
+// ACMECacheDir. Every service reads and writes that storage, so edge
+// servers serving HTTPS need CertKey to encrypt the private keys there.
+type EdgeConfig struct {
+	Enabled          bool   `json:"enabled" env:"EDGE_ENABLED" usage:"serve custom domains over HTTPS"`
+	HTTPAddr         string `json:"http_addr" env:"EDGE_HTTP_ADDR" validate:"addr" usage:"edge HTTP listen address"`
+	HTTPSAddr        string `json:"https_addr" env:"EDGE_HTTPS_ADDR" validate:"addr" usage:"edge HTTPS listen address; empty serves edge servers' sites over plain HTTP, for a load balancer terminating TLS"`
+	ACMEDirectoryURL string `json:"acme_directory_url" env:"ACME_DIRECTORY_URL" validate:"url" usage:"ACME directory URL"`
+	ACMEEmail        string `json:"acme_email" env:"ACME_EMAIL" usage:"ACME account email"`
+	ACMECacheDir     string `json:"acme_cache_dir" env:"ACME_CACHE_DIR" usage:"certificate cache directory"`
+	ACMECACert       string `json:"acme_ca_cert" env:"ACME_CA_CERT" usage:"extra CA certificate trusted for the ACME server"`
+	CertKey          string `json:"cert_key" env:"EDGE_CERT_KEY" validate:"minlen=32" secret:"true" usage:"secret encrypting the certificates and ACME account key edge servers keep in storage"`
+	BaseDomain       string `json:"base_domain" env:"EDGE_BASE_DOMAIN" usage:"domain whose subdomains <repo>.<domain> edge servers serve each project on"`
+	CacheDir         string `json:"cache_dir" env:"EDGE_CACHE_DIR" usage:"directory of the edge server's file cache"`
+	CacheSize        string `json:"cache_size" env:"EDGE_CACHE_SIZE" validate:"size" usage:"largest size of the edge file cache on disk (e.g. 10GB)"`
+	MemoryCacheSize  string `json:"memory_cache_size" env:"EDGE_MEMORY_CACHE_SIZE" validate:"size" usage:"largest size of the small files an edge server keeps in memory (e.g. 256MB)"`
+	RefreshInterval  string `json:"refresh_interval" env:"EDGE_REFRESH_INTERVAL" validate:"duration" usage:"how long an edge server serves a project's deployment and the custom domains before looking them up again"`
+}
+
+// UploadConfig and BuildConfig each have a public listener serving only
+// health checks, and an internal one that only accepts calls signed with the
+// internal secret.
+type UploadConfig struct {
+	Addr         string `json:"addr" env:"UPLOAD_ADDR" required:"upload" validate:"addr" usage:"public listen address of upload_service's health checks"`
+	InternalAddr string `json:"internal_addr" env:"UPLOAD_INTERNAL_ADDR" required:"upload" validate:"addr" usage:"listen address for signed calls from request_handler"`
+	TmpDir       string `json:"tmp_dir" env:"UPLOAD_TMP_DIR" required:"upload" usage:"scratch directory for clones"`
+	MaxRepoSize  string `json:"max_repo_size" env:"UPLOAD_MAX_REPO_SIZE" validate:"size" usage:"largest repository, after .zenithignore, that is packaged (e.g. 500MB)"`
+	MaxFileSize  string `json:"max_file_size" env:"UPLOAD_MAX_FILE_SIZE" validate:"size" usage:"largest single file that is packaged (e.g. 50MB)"`
+	LogLevel     string `json:"log_level" env:"UPLOAD_LOG_LEVEL" validate:"oneof=debug|info|warn|error" usage:"least severe level logged by upload_service"`
+}
+
+type BuildConfig struct {
+	Addr                   string `json:"addr" env:"BUILD_ADDR" required:"build" validate:"addr" usage:"public listen address of build_service's health checks"`
+	InternalAddr           string `json:"internal_addr" env:"BUILD_INTERNAL_ADDR" required:"build" validate:"addr" usage:"listen address for signed calls from request_handler"`
+	TmpDir                 string `json:"tmp_dir" env:"BUILD_TMP_DIR" required:"build" usage:"scratch directory for builds"`
+	DefaultTemplate        string `json:"default_template" env:"BUILD_DEFAULT_TEMPLATE" validate:"oneof=create-react-app|next|vite" usage:"template used when a request names none"`
+	AutoCreateFromTemplate bool   `json:"auto_create_from_template" env:"AUTO_CREATE_FROM_TEMPLATE" usage:"create missing projects from the template even if not requested"`
+	LogLevel               string `json:"log_level" env:"BUILD_LOG_LEVEL" validate:"oneof=debug|info|warn|error" usage:"least severe level logged by build_service"`
+}
+
+// TracingConfig sets where every service exports its spans.
+type TracingConfig struct {
+	Endpoint string `json:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" validate:"url" usage:"OTLP/HTTP collector base URL spans are exported to; empty disables export"`
+}
+
+// ShutdownConfig sets how services stop on SIGINT or SIGTERM.
+type ShutdownConfig struct {
+	Timeout string `json:"timeout" env:"SHUTDOWN_TIMEOUT" validate:"duration" usage:"how long to wait for running requests and deploys before cancelling them on shutdown"`
+}
+
+// RetryConfig sets how storage and service calls are retried after
+// transient errors such as timeouts and dropped connections.
+type RetryConfig struct {
+	Attempts  int    `json:"attempts" env:"RETRY_ATTEMPTS" usage:"tries of a storage or service call before giving up; 1 disables retries"`
+	BaseDelay string `json:"base_delay" env:"RETRY_BASE_DELAY" validate:"duration" usage:"wait before the first retry, doubled for each one after it"`
+	MaxDelay  string `json:"max_delay" env:"RETRY_MAX_DELAY" validate:"duration" usage:"longest wait between two tries"`
+}
+
+// HealthConfig sets the thresholds of the /readyz checks.
+type HealthConfig struct {
+	MinFreeDisk string `json:"min_free_disk" env:"HEALTH_MIN_FREE_DISK" validate:"size" usage:"least free space in scratch and deploy directories for a service to be ready (e.g. 1GB)"`
+}
+
+// Default returns the configuration used when nothing else is set.
+func Default() *Config {
+	return &Config{
+		Storage: StorageConfig{Backend: "s3", UseSSL: true, LocalDir: "./storage"},
+		GitHub: GitHubConfig{
+			APIURL: "https://api.github.com",
+			WebURL: "https://github.com",
+		},
+		Auth: AuthConfig{
+			File:       "./data/auth.json",
+			SessionTTL: "24h",
+		},
+		Services: ServicesConfig{
+			UploadURL: "http://127.0.0.1:8091",
+			BuildURL:  "http://127.0.0.1:8092",
+		},
+		RequestHandler: RequestHandlerConfig{
+			Addr:        ":8080",
+			MetricsAddr: "127.0.0.1:9090",
+			LogLevel:    "info",
+			DataDir:     "./data",
+			DeployedDir: "./deployed",
+			CORSOrigins: []string{"http://localhost:3000"},
+			Template:    "create-react-app",
+			UseTemplate: true,
+			Tunnel: TunnelConfig{
+				Provider:       "ngrok",
+				NgrokAPIURL:    "http://localhost:4040",
+				CloudflaredBin: "cloudflared",
+			},
+			Edge: EdgeConfig{
+				HTTPAddr:         ":80",
+				HTTPSAddr:        ":443",
+				ACMEDirectoryURL: "https://acme-v02.api.letsencrypt.org/directory",
+				ACMECacheDir:     "./data/certs",
+				CacheDir:         "./data/edge-cache",
+				CacheSize:        "10GB",
+				MemoryCacheSize:  "256MB",
+				RefreshInterval:  "10s",
+			},
+		},
+		Upload: UploadConfig{
+			Addr:         ":8081",
+			InternalAddr: "127.0.0.1:8091",
+			TmpDir:       "./tmp",
+			MaxRepoSize:  "500MB",
+			MaxFileSize:  "50MB",
+			LogLevel:     "info",
+		},
+		Build: BuildConfig{
+			Addr:            ":8082",
+			InternalAddr:    "127.0.0.1:8092",
+			TmpDir:          "tmp",
+			DefaultTemplate: "create-react-app",
+			LogLevel:        "info",
+		},
+		Health:   HealthConfig{MinFreeDisk: "1GB"},
+		Shutdown: ShutdownConfig{Timeout: "2m"},
+		Retry:    RetryConfig{Attempts: 4, BaseDelay: "500ms", MaxDelay: "10s"},
+	}
+}
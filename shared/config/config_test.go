@@ -0,0 +1,153 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(file, []byte(`{"storage": {"bucket": "from-file", "endpoint": "s3.example.com"}, "upload": {"addr": ":9000"}}`), 0644)
+
+	t.Setenv("B2_ACCESS_KEY", "key")
+	t.Setenv("B2_SECRET_KEY", "secret")
+	t.Setenv("GITHUB_TOKEN", "ghp_token")
+	t.Setenv("B2_BUCKET", "from-env")
+	t.Setenv("INTERNAL_SECRET", strings.Repeat("s", 32))
+
+	cfg, _, err := Load(Upload, []string{"--config", file, "--upload.addr", ":9100"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Storage.Endpoint != "s3.example.com" {
+		t.Errorf("endpoint = %q, want value from file", cfg.Storage.Endpoint)
+	}
+	if cfg.Storage.Bucket != "from-env" {
+		t.Errorf("bucket = %q, want env to override file", cfg.Storage.Bucket)
+	}
+	if cfg.Upload.Addr != ":9100" {
+		t.Errorf("addr = %q, want flag to override file", cfg.Upload.Addr)
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	t.Setenv("B2_BUCKET", "Invalid_Bucket")
+	t.Setenv("UPLOAD_SERVICE_URL", "localhost:8081")
+	t.Setenv("TUNNEL_PROVIDER", "carrier-pigeon")
+	t.Setenv("EDGE_ENABLED", "maybe")
+	t.Setenv("CORS_ORIGINS", "http://localhost:3000,app.example.com")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8,lb.internal")
+	t.Setenv("INTERNAL_SECRET", "hunter2")
+
+	_, _, err := Load(RequestHandler, nil)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{
+		"storage.endpoint (B2_ENDPOINT) is required",
+		"storage.access_key (B2_ACCESS_KEY) is required",
+		"storage.bucket (B2_BUCKET)",
+		"services.upload_url (UPLOAD_SERVICE_URL)",
+		"request_handler.tunnel.provider (TUNNEL_PROVIDER)",
+		"request_handler.edge.enabled (EDGE_ENABLED)",
+		"request_handler.cors_origins (CORS_ORIGINS): \"app.example.com\"",
+		"request_handler.trusted_proxies (TRUSTED_PROXIES): \"lb.internal\"",
+		"auth.internal_secret (INTERNAL_SECRET): must be at least 32 characters",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "github.token") {
+		t.Errorf("request_handler should not require the GitHub token:\n%v", err)
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("error leaks the internal secret:\n%v", err)
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.Storage.SecretKey = "super-secret"
+	cfg.GitHub.Token = "ghp_abc"
+
+	var buf bytes.Buffer
+	if err := cfg.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "super-secret") || strings.Contains(out, "ghp_abc") {
+		t.Errorf("secrets leaked:\n%s", out)
+	}
+	if cfg.Storage.SecretKey != "super-secret" {
+		t.Error("Print modified the original config")
+	}
+	if got := cfg.Secrets(); strings.Join(got, " ") != "super-secret ghp_abc" {
+		t.Errorf("Secrets = %q", got)
+	}
+}
+
+func TestLoadServerWithLocalStorage(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "local")
+	t.Setenv("UPLOAD_SERVICE_URL", "not a url")
+	t.Setenv("GITHUB_APP_ID", "1234")
+
+	_, _, err := Load(Server, nil)
+	if err == nil {
+		t.Fatal("expected the GitHub App settings to be required")
+	}
+	if strings.Contains(err.Error(), "storage.") {
+		t.Errorf("local storage should not need bucket settings:\n%v", err)
+	}
+	if strings.Contains(err.Error(), "services.") || strings.Contains(err.Error(), "internal_secret") {
+		t.Errorf("server should not need peer URLs or the internal secret:\n%v", err)
+	}
+	if !strings.Contains(err.Error(), "github.app_key_file (GITHUB_APP_KEY_FILE) is required for the GitHub App") {
+		t.Errorf("error does not mention the GitHub App key:\n%v", err)
+	}
+	if strings.Contains(err.Error(), "github.token") {
+		t.Errorf("a GitHub App replaces the global token:\n%v", err)
+	}
+}
+
+func TestLoadEdge(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "local")
+	t.Setenv("INTERNAL_SECRET", "")
+	t.Setenv("EDGE_CACHE_DIR", "")
+	t.Setenv("EDGE_CACHE_SIZE", "lots")
+
+	_, _, err := Load(Edge, []string{"--request_handler.edge.cache_dir="})
+	if err == nil {
+		t.Fatal("expected the cache settings to be checked")
+	}
+	for _, want := range []string{
+		"request_handler.edge.cache_dir (EDGE_CACHE_DIR) is required for edge servers",
+		"request_handler.edge.cache_size (EDGE_CACHE_SIZE)",
+		"request_handler.edge.cert_key (EDGE_CERT_KEY) is required for edge servers serving HTTPS",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "internal_secret") || strings.Contains(err.Error(), "request_handler.addr") {
+		t.Errorf("edge servers only need storage and the edge settings:\n%v", err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"512": 512, "64KB": 64 << 10, "50MB": 50 << 20, "50 mb": 50 << 20, "1.5GB": 3 << 29, "2GiB": 2 << 30,
+	} {
+		if got, err := ParseSize(in); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "MB", "ten MB", "5PB", "1..5KB"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) succeeded", in)
+		}
+	}
+}
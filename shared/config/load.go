@@ -0,0 +1,447 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redacted = "[redacted]"
+
+// Options are the flags that control loading rather than set a value.
+type Options struct {
+	File        string
+	PrintConfig bool
+}
+
+// sectionServices limits validation of a top-level section to the services
+// that use it. Sections not listed apply to every service. The all-in-one
+// server calls its peers in process, so it has no use for "services"; edge
+// servers only read storage and the edge settings of "request_handler".
+var sectionServices = map[string][]string{
+	"services":        {RequestHandler},
+	"auth":            {RequestHandler, Upload, Build, Server},
+	"request_handler": {RequestHandler, Server, Edge},
+	"upload":          {Upload, Server},
+	"build":           {Build, Server},
+}
+
+var bucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// setting is one leaf field of Config.
+type setting struct {
+	path     string
+	section  string
+	env      string
+	usage    string
+	required []string
+	validate string
+	backend  string
+	secret   bool
+	value    reflect.Value
+}
+
+func settings(c *Config) []setting {
+	var result []setting
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			path := name
+			if prefix != "" {
+				path = prefix + "." + name
+			}
+			if f.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), path)
+				continue
+			}
+			section, _, _ := strings.Cut(path, ".")
+			s := setting{
+				path:     path,
+				section:  section,
+				env:      f.Tag.Get("env"),
+				usage:    f.Tag.Get("usage"),
+				validate: f.Tag.Get("validate"),
+				backend:  f.Tag.Get("backend"),
+				secret:   f.Tag.Get("secret") == "true",
+				value:    v.Field(i),
+			}
+			if required := f.Tag.Get("required"); required != "" {
+				s.required = strings.Split(required, ",")
+			}
+			result = append(result, s)
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return result
+}
+
+func (s setting) name() string {
+	if s.env != "" {
+		return fmt.Sprintf("%s (%s)", s.path, s.env)
+	}
+	return s.path
+}
+
+func (s setting) set(raw string) error {
+	switch s.value.Kind() {
+	case reflect.String:
+		s.value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a boolean", s.name(), raw)
+		}
+		s.value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not an integer", s.name(), raw)
+		}
+		s.value.SetInt(n)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		s.value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("%s: unsupported setting type %s", s.path, s.value.Kind())
+	}
+	return nil
+}
+
+// Load builds the configuration for service. Problems with the config file,
+// environment or flags and every failed validation are collected into one
+// error; the returned Config is still usable for --print-config.
+func Load(service string, args []string) (*Config, Options, error) {
+	cfg := Default()
+	var opts Options
+	var errs []error
+
+	fs := flag.NewFlagSet(service, flag.ContinueOnError)
+	fs.StringVar(&opts.File, "config", os.Getenv("ZENITH_CONFIG"), "path to a JSON config file")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration with secrets redacted and exit")
+
+	flagValues := map[string]string{}
+	for _, s := range settings(cfg) {
+		path := s.path
+		record := func(v string) error { flagValues[path] = v; return nil }
+		if s.value.Kind() == reflect.Bool {
+			fs.BoolFunc(path, s.usage, record)
+		} else {
+			fs.Func(path, s.usage, record)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, opts, err
+	}
+
+	if opts.File != "" {
+		if err := loadFile(cfg, opts.File); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	all := settings(cfg)
+	for _, s := range all {
+		if s.env == "" {
+			continue
+		}
+		if raw := os.Getenv(s.env); raw != "" {
+			if err := s.set(raw); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	// The upload and build services historically read PORT.
+	if port := os.Getenv("PORT"); port != "" {
+		switch {
+		case service == Server && os.Getenv("REQUEST_HANDLER_ADDR") == "":
+			cfg.RequestHandler.Addr = ":" + port
+		case service == Upload && os.Getenv("UPLOAD_ADDR") == "":
+			cfg.Upload.Addr = ":" + port
+		case service == Build && os.Getenv("BUILD_ADDR") == "":
+			cfg.Build.Addr = ":" + port
+		}
+	}
+
+	for _, s := range all {
+		if raw, ok := flagValues[s.path]; ok {
+			if err := s.set(raw); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	errs = append(errs, cfg.validate(service)...)
+	return cfg, opts, errors.Join(errs...)
+}
+
+func loadFile(cfg *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks every setting used by service and reports all problems.
+func (c *Config) Validate(service string) error {
+	return errors.Join(c.validate(service)...)
+}
+
+func (c *Config) validate(service string) []error {
+	var errs []error
+	for _, s := range settings(c) {
+		if services, ok := sectionServices[s.section]; ok && !slices.Contains(services, service) {
+			continue
+		}
+		if s.backend != "" && s.backend != c.Storage.Backend {
+			continue
+		}
+
+		if s.value.IsZero() {
+			if requiredBy(s.required, service) {
+				errs = append(errs, fmt.Errorf("%s is required", s.name()))
+			}
+			continue
+		}
+
+		if err := checkValue(s); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", s.name(), err))
+		}
+	}
+
+	if (service == RequestHandler || service == Server) && c.GitHub.AppID != "" {
+		for _, s := range []struct{ value, name string }{
+			{c.GitHub.AppSlug, "github.app_slug (GITHUB_APP_SLUG)"},
+			{c.GitHub.AppKeyFile, "github.app_key_file (GITHUB_APP_KEY_FILE)"},
+			{c.GitHub.ClientID, "github.client_id (GITHUB_CLIENT_ID)"},
+			{c.GitHub.ClientSecret, "github.client_secret (GITHUB_CLIENT_SECRET)"},
+		} {
+			if s.value == "" {
+				errs = append(errs, fmt.Errorf("%s is required for the GitHub App", s.name))
+			}
+		}
+	}
+
+	if (service == RequestHandler || service == Server) && c.RequestHandler.Tunnel.Provider == "ssh" {
+		if c.RequestHandler.Tunnel.SSHTarget == "" {
+			errs = append(errs, fmt.Errorf("request_handler.tunnel.ssh_target (TUNNEL_SSH_TARGET) is required for the ssh tunnel provider"))
+		}
+		if c.RequestHandler.Tunnel.PublicURL == "" {
+			errs = append(errs, fmt.Errorf("request_handler.tunnel.public_url (TUNNEL_PUBLIC_URL) is required for the ssh tunnel provider"))
+		}
+	}
+	if service == Edge {
+		for _, s := range []struct{ value, name string }{
+			{c.RequestHandler.Edge.HTTPAddr, "request_handler.edge.http_addr (EDGE_HTTP_ADDR)"},
+			{c.RequestHandler.Edge.CacheDir, "request_handler.edge.cache_dir (EDGE_CACHE_DIR)"},
+		} {
+			if s.value == "" {
+				errs = append(errs, fmt.Errorf("%s is required for edge servers", s.name))
+			}
+		}
+		if c.RequestHandler.Edge.HTTPSAddr != "" && c.RequestHandler.Edge.CertKey == "" {
+			errs = append(errs, fmt.Errorf("request_handler.edge.cert_key (EDGE_CERT_KEY) is required for edge servers serving HTTPS"))
+		}
+	}
+	return errs
+}
+
+// requiredBy reports whether a setting required by the listed services is
+// needed by service. The all-in-one server needs what any service needs,
+// except settings only used for calls between separate services.
+func requiredBy(required []string, service string) bool {
+	for _, r := range required {
+		if r == "split" {
+			if service != Server {
+				return true
+			}
+			continue
+		}
+		if r == "all" || r == service || (service == Server && r != "") {
+			return true
+		}
+	}
+	return false
+}
+
+func checkValue(s setting) error {
+	switch s.value.Kind() {
+	case reflect.String:
+		return checkString(s.validate, s.value.String())
+	case reflect.Slice:
+		for i := 0; i < s.value.Len(); i++ {
+			if err := checkString(s.validate, s.value.Index(i).String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkString(rule, value string) error {
+	switch {
+	case rule == "addr":
+		_, port, err := net.SplitHostPort(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a host:port address", value)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return fmt.Errorf("%q has an invalid port", value)
+		}
+	case rule == "url":
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%q is not an http(s) URL", value)
+		}
+	case rule == "cidr":
+		if _, _, err := net.ParseCIDR(value); err != nil && net.ParseIP(value) == nil {
+			return fmt.Errorf("%q is not an IP address or CIDR", value)
+		}
+	case rule == "duration":
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("%q is not a positive duration", value)
+		}
+	case rule == "size":
+		if n, err := ParseSize(value); err != nil || n <= 0 {
+			return fmt.Errorf("%q is not a positive size such as 50MB", value)
+		}
+	case rule == "bucket":
+		if !bucketPattern.MatchString(value) {
+			return fmt.Errorf("%q is not a valid bucket name", value)
+		}
+	case strings.HasPrefix(rule, "minlen="):
+		// The value is not quoted: minlen guards secrets.
+		if n, _ := strconv.Atoi(strings.TrimPrefix(rule, "minlen=")); len(value) < n {
+			return fmt.Errorf("must be at least %d characters", n)
+		}
+	case strings.HasPrefix(rule, "oneof="):
+		allowed := strings.Split(strings.TrimPrefix(rule, "oneof="), "|")
+		if !slices.Contains(allowed, value) {
+			return fmt.Errorf("%q must be one of %s", value, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// sizeUnits are the suffixes ParseSize accepts, in binary multiples.
+var sizeUnits = map[string]int64{
+	"": 1, "B": 1,
+	"KB": 1 << 10, "K": 1 << 10, "KIB": 1 << 10,
+	"MB": 1 << 20, "M": 1 << 20, "MIB": 1 << 20,
+	"GB": 1 << 30, "G": 1 << 30, "GIB": 1 << 30,
+}
+
+// ParseSize parses a byte count such as "512", "64KB" or "1.5GB". Units are
+// binary: 1KB is 1024 bytes.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit in %q", s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// Redacted returns a copy of c with every secret replaced by a placeholder.
+func (c *Config) Redacted() *Config {
+	copied := *c
+	for _, s := range settings(&copied) {
+		if s.secret && !s.value.IsZero() {
+			s.value.SetString(redacted)
+		}
+	}
+	return &copied
+}
+
+// Secrets returns the value of every secret setting that is set, for
+// scrubbing from logs and error messages.
+func (c *Config) Secrets() []string {
+	var values []string
+	for _, s := range settings(c) {
+		if s.secret && !s.value.IsZero() {
+			values = append(values, s.value.String())
+		}
+	}
+	return values
+}
+
+// Print writes the configuration as JSON with secrets redacted.
+func (c *Config) Print(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c.Redacted())
+}
+
+// MustLoad loads the configuration for service from os.Args. With
+// --print-config it prints the redacted configuration and exits; otherwise
+// it exits listing every invalid setting.
+func MustLoad(service string) *Config {
+	return MustLoadArgs(service, os.Args[1:])
+}
+
+// MustLoadArgs is MustLoad with explicit command-line arguments, for
+// commands that take a subcommand first.
+func MustLoadArgs(service string, args []string) *Config {
+	cfg, opts, err := Load(service, args)
+	if cfg == nil {
+		os.Exit(2)
+	}
+
+	if opts.PrintConfig {
+		cfg.Print(os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", indent(err))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", indent(err))
+		os.Exit(1)
+	}
+	return cfg
+}
+
+func indent(err error) string {
+	lines := strings.Split(err.Error(), "\n")
+	for i, line := range lines {
+		lines[i] = "  - " + line
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,315 @@
+// Package github talks to GitHub as a GitHub App: it links app installations
+// to users through OAuth and mints short-lived installation tokens for
+// cloning single repositories.
+package github
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"zenith/shared/config"
+)
+
+var (
+	ErrNotInstalled = errors.New("the GitHub App is not installed on this repository")
+	ErrBadCode      = errors.New("GitHub rejected the authorization code")
+)
+
+// Installation is an installation of the app on a user or organization
+// account.
+type Installation struct {
+	ID      int64 `json:"id"`
+	Account struct {
+		Login string `json:"login"`
+	} `json:"account"`
+}
+
+// Token is an installation access token.
+type Token struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// App is a GitHub App with the credentials to act as itself, as its
+// installations and, through OAuth, on behalf of users.
+type App struct {
+	id           string
+	slug         string
+	clientID     string
+	clientSecret string
+	apiURL       string
+	webURL       string
+	key          *rsa.PrivateKey
+	http         *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]*Token
+}
+
+// NewApp returns the App configured in cfg, reading its private key from
+// cfg.AppKeyFile.
+func NewApp(cfg config.GitHubConfig) (*App, error) {
+	pemData, err := os.ReadFile(cfg.AppKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GitHub App key: %w", err)
+	}
+	key, err := parseKey(pemData)
+	if err != nil {
+		return nil, err
+	}
+	return &App{
+		id:           cfg.AppID,
+		slug:         cfg.AppSlug,
+		clientID:     cfg.ClientID,
+		clientSecret: cfg.ClientSecret,
+		apiURL:       strings.TrimSuffix(cfg.APIURL, "/"),
+		webURL:       strings.TrimSuffix(cfg.WebURL, "/"),
+		key:          key,
+		http:         &http.Client{Timeout: 30 * time.Second},
+		tokens:       map[string]*Token{},
+	}, nil
+}
+
+func parseKey(pemData []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("GitHub App key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GitHub App key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("GitHub App key is not an RSA key")
+	}
+	return key, nil
+}
+
+// InstallURL is where a user installs the app. GitHub sends them back to the
+// app's setup URL with state.
+func (a *App) InstallURL(state string) string {
+	return a.webURL + "/apps/" + url.PathEscape(a.slug) + "/installations/new?state=" + url.QueryEscape(state)
+}
+
+// AuthorizeURL is where a user authorizes the app to see their installations.
+// GitHub sends them back to the app's callback URL with a code and state.
+func (a *App) AuthorizeURL(state string) string {
+	return a.webURL + "/login/oauth/authorize?client_id=" + url.QueryEscape(a.clientID) + "&state=" + url.QueryEscape(state)
+}
+
+// Exchange trades an OAuth code for a user access token.
+func (a *App) Exchange(ctx context.Context, code string) (string, error) {
+	form := url.Values{"client_id": {a.clientID}, "client_secret": {a.clientSecret}, "code": {code}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webURL+"/login/oauth/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := a.do(req, &resp); err != nil {
+		return "", err
+	}
+	if resp.AccessToken == "" {
+		return "", fmt.Errorf("%w: %s", ErrBadCode, resp.Error)
+	}
+	return resp.AccessToken, nil
+}
+
+// UserInstallations lists the app's installations the user of userToken can
+// access.
+func (a *App) UserInstallations(ctx context.Context, userToken string) ([]Installation, error) {
+	req, err := a.newRequest(ctx, http.MethodGet, "/user/installations?per_page=100", "token "+userToken, nil)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Installations []Installation `json:"installations"`
+	}
+	if err := a.do(req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Installations, nil
+}
+
+// UserLogin returns the login of the user of userToken.
+func (a *App) UserLogin(ctx context.Context, userToken string) (string, error) {
+	req, err := a.newRequest(ctx, http.MethodGet, "/user", "token "+userToken, nil)
+	if err != nil {
+		return "", err
+	}
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := a.do(req, &user); err != nil {
+		return "", err
+	}
+	return user.Login, nil
+}
+
+// RepoPermission returns the permission of the user login on owner/repo,
+// asked with an installation token covering it: "admin", "write", "read"
+// or "none".
+func (a *App) RepoPermission(ctx context.Context, token, owner, repo, login string) (string, error) {
+	path := "/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(repo) + "/collaborators/" + url.PathEscape(login) + "/permission"
+	req, err := a.newRequest(ctx, http.MethodGet, path, "token "+token, nil)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Permission string `json:"permission"`
+	}
+	if err := a.do(req, &resp); err != nil {
+		var se *statusError
+		if errors.As(err, &se) && se.status == http.StatusNotFound {
+			return "none", nil
+		}
+		return "", err
+	}
+	return resp.Permission, nil
+}
+
+// RepoInstallation returns the installation covering owner/repo.
+func (a *App) RepoInstallation(ctx context.Context, owner, repo string) (*Installation, error) {
+	jwt, err := a.jwt()
+	if err != nil {
+		return nil, err
+	}
+	req, err := a.newRequest(ctx, http.MethodGet, "/repos/"+url.PathEscape(owner)+"/"+url.PathEscape(repo)+"/installation", "Bearer "+jwt, nil)
+	if err != nil {
+		return nil, err
+	}
+	var inst Installation
+	if err := a.do(req, &inst); err != nil {
+		var se *statusError
+		if errors.As(err, &se) && se.status == http.StatusNotFound {
+			return nil, ErrNotInstalled
+		}
+		return nil, err
+	}
+	return &inst, nil
+}
+
+// InstallationToken returns a token of installation id that can only read
+// the contents of repo. Tokens are reused until five minutes before they
+// expire.
+func (a *App) InstallationToken(ctx context.Context, id int64, repo string) (*Token, error) {
+	cacheKey := fmt.Sprintf("%d/%s", id, repo)
+	a.mu.Lock()
+	cached := a.tokens[cacheKey]
+	a.mu.Unlock()
+	if cached != nil && time.Until(cached.ExpiresAt) > 5*time.Minute {
+		return cached, nil
+	}
+
+	jwt, err := a.jwt()
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(map[string]any{
+		"repositories": []string{repo},
+		"permissions":  map[string]string{"contents": "read"},
+	})
+	req, err := a.newRequest(ctx, http.MethodPost, fmt.Sprintf("/app/installations/%d/access_tokens", id), "Bearer "+jwt, body)
+	if err != nil {
+		return nil, err
+	}
+	var token Token
+	if err := a.do(req, &token); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.tokens[cacheKey] = &token
+	a.mu.Unlock()
+	return &token, nil
+}
+
+// jwt returns a token authenticating as the app itself, valid for nine
+// minutes. It is backdated a minute to allow for clock drift.
+func (a *App) jwt() (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.id,
+	})
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (a *App) newRequest(ctx context.Context, method, path, authorization string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, a.apiURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	req.Header.Set("Authorization", authorization)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("GitHub API returned %d: %s", e.status, e.message)
+}
+
+func (a *App) do(req *http.Request, out any) error {
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("GitHub request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("GitHub request failed: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &e)
+		return &statusError{status: resp.StatusCode, message: e.Message}
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,178 @@
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"zenith/shared/config"
+)
+
+// stubGitHub serves the parts of the GitHub API the app uses and checks
+// that app requests carry a JWT signed with key.
+func stubGitHub(t *testing.T, key *rsa.PrivateKey, minted *int) *httptest.Server {
+	t.Helper()
+	checkJWT := func(r *http.Request) bool {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			return false
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig) != nil {
+			return false
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		return strings.Contains(string(claims), `"iss":"42"`)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "good-code" || r.Form.Get("client_secret") != "shh" {
+			fmt.Fprint(w, `{"error":"bad_verification_code"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"gho_user"}`)
+	})
+	mux.HandleFunc("GET /user/installations", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token gho_user" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"total_count":1,"installations":[{"id":7,"account":{"login":"acme"}}]}`)
+	})
+	mux.HandleFunc("GET /user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token gho_user" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"login":"octo"}`)
+	})
+	mux.HandleFunc("GET /repos/acme/{repo}/collaborators/{user}/permission", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "token ghs_") || r.PathValue("user") != "octo" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"permission":"write"}`)
+	})
+	mux.HandleFunc("GET /repos/{owner}/{repo}/installation", func(w http.ResponseWriter, r *http.Request) {
+		if !checkJWT(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.PathValue("owner") != "acme" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"Not Found"}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":7,"account":{"login":"acme"}}`)
+	})
+	mux.HandleFunc("POST /app/installations/7/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		if !checkJWT(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"repositories":["site"]`) {
+			t.Errorf("token request not limited to the repository: %s", body)
+		}
+		*minted++
+		json.NewEncoder(w).Encode(Token{Token: fmt.Sprintf("ghs_%d", *minted), ExpiresAt: time.Now().Add(time.Hour)})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestApp returns an App talking to a stub of GitHub.
+func newTestApp(t *testing.T, minted *int) *App {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "app.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+
+	srv := stubGitHub(t, key, minted)
+	app, err := NewApp(config.GitHubConfig{
+		APIURL:       srv.URL,
+		WebURL:       srv.URL,
+		AppID:        "42",
+		AppSlug:      "zenith",
+		AppKeyFile:   keyFile,
+		ClientID:     "Iv1.abc",
+		ClientSecret: "shh",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+func TestApp(t *testing.T) {
+	var minted int
+	app := newTestApp(t, &minted)
+	ctx := context.Background()
+
+	if _, err := app.Exchange(ctx, "stolen-code"); !errors.Is(err, ErrBadCode) {
+		t.Errorf("bad code: err = %v", err)
+	}
+	userToken, err := app.Exchange(ctx, "good-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insts, err := app.UserInstallations(ctx, userToken)
+	if err != nil || len(insts) != 1 || insts[0].ID != 7 || insts[0].Account.Login != "acme" {
+		t.Fatalf("UserInstallations = %+v, %v", insts, err)
+	}
+
+	inst, err := app.RepoInstallation(ctx, "acme", "site")
+	if err != nil || inst.ID != 7 {
+		t.Fatalf("RepoInstallation = %+v, %v", inst, err)
+	}
+	if _, err := app.RepoInstallation(ctx, "someone", "else"); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("repository without the app: err = %v", err)
+	}
+
+	first, err := app.InstallationToken(ctx, 7, "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := app.InstallationToken(ctx, 7, "site")
+	if first.Token != "ghs_1" || second.Token != first.Token || minted != 1 {
+		t.Errorf("tokens %q and %q, %d minted; want one reused token", first.Token, second.Token, minted)
+	}
+
+	login, err := app.UserLogin(ctx, userToken)
+	if err != nil || login != "octo" {
+		t.Errorf("UserLogin = %q, %v", login, err)
+	}
+	for user, want := range map[string]string{"octo": "write", "stranger": "none"} {
+		if perm, err := app.RepoPermission(ctx, first.Token, "acme", "site", user); err != nil || perm != want {
+			t.Errorf("RepoPermission(%s) = %q, %v; want %q", user, perm, err, want)
+		}
+	}
+
+	if u := app.InstallURL("s t"); !strings.HasSuffix(u, "/apps/zenith/installations/new?state=s+t") {
+		t.Errorf("InstallURL = %s", u)
+	}
+}
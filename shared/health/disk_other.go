@@ -0,0 +1,14 @@
+//go:build !unix
+
+package health
+
+import "os"
+
+// freeSpace only checks that dir exists where free space cannot be read;
+// it reports unlimited space.
+func freeSpace(dir string) (int64, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return 0, err
+	}
+	return 1<<63 - 1, nil
+}
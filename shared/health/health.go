@@ -0,0 +1,191 @@
+// Package health serves the /healthz and /readyz endpoints of every
+// service. Both run the service's dependency checks and return a JSON
+// breakdown of them; /readyz fails with 503 when any check fails, while
+// /healthz only reports that the process is serving.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/config"
+	"zenith/shared/redact"
+)
+
+// Timeout bounds each check.
+const Timeout = 5 * time.Second
+
+// Check is one dependency of a service. Run returns nil when it is usable.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// Report is the outcome of all checks of a service. Status is "ok" when
+// every check passed and "fail" otherwise.
+type Report struct {
+	Service string   `json:"service"`
+	Status  string   `json:"status"`
+	Checks  []Result `json:"checks"`
+}
+
+// Checker holds the checks of a service.
+type Checker struct {
+	service string
+	checks  []Check
+}
+
+// New returns a Checker for service with checks.
+func New(service string, checks ...Check) *Checker {
+	return &Checker{service: service, checks: checks}
+}
+
+// Add adds checks to c.
+func (c *Checker) Add(checks ...Check) {
+	c.checks = append(c.checks, checks...)
+}
+
+// Run runs every check concurrently and reports their results sorted by
+// name.
+func (c *Checker) Run(ctx context.Context) Report {
+	results := make([]Result, len(c.checks))
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = run(ctx, check)
+		}()
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+
+	report := Report{Service: c.service, Status: "ok", Checks: results}
+	for _, r := range results {
+		if r.Status != "ok" {
+			report.Status = "fail"
+		}
+	}
+	return report
+}
+
+func run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	start := time.Now()
+	err := check.Run(ctx)
+	r := Result{Name: check.Name, Status: "ok", DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		r.Status = "fail"
+		r.Error = redact.String(err.Error())
+	}
+	return r
+}
+
+// Routes registers GET /healthz and GET /readyz for c on r. Neither needs
+// authentication.
+func (c *Checker) Routes(r gin.IRoutes) {
+	r.GET("/healthz", c.Healthz)
+	r.GET("/readyz", c.Readyz)
+}
+
+// Healthz responds with the report of c and 200, however the checks went.
+func (c *Checker) Healthz(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, c.Run(ctx.Request.Context()))
+}
+
+// Readyz responds with the report of c and 200, or 503 when a check
+// failed.
+func (c *Checker) Readyz(ctx *gin.Context) {
+	report := c.Run(ctx.Request.Context())
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	ctx.JSON(status, report)
+}
+
+// Binaries checks that each of names is an executable on PATH.
+func Binaries(names ...string) []Check {
+	var checks []Check
+	for _, name := range names {
+		checks = append(checks, Check{Name: "bin:" + name, Run: func(context.Context) error {
+			_, err := exec.LookPath(name)
+			return err
+		}})
+	}
+	return checks
+}
+
+// DiskSpace checks that the file system holding dir has at least min
+// bytes available. A min of 0 only checks that dir exists.
+func DiskSpace(name, dir string, min int64) Check {
+	return Check{Name: "disk:" + name, Run: func(context.Context) error {
+		free, err := freeSpace(dir)
+		if err != nil {
+			return err
+		}
+		if free < min {
+			return fmt.Errorf("%s has %s free, below the minimum of %s", dir, formatBytes(free), formatBytes(min))
+		}
+		return nil
+	}}
+}
+
+// MinFreeDisk parses cfg.MinFreeDisk, where empty means no minimum.
+func MinFreeDisk(cfg config.HealthConfig) (int64, error) {
+	if cfg.MinFreeDisk == "" {
+		return 0, nil
+	}
+	n, err := config.ParseSize(cfg.MinFreeDisk)
+	if err != nil {
+		return 0, fmt.Errorf("invalid minimum free disk space: %w", err)
+	}
+	return n, nil
+}
+
+// HTTP checks that GET url answers with a 2xx status.
+func HTTP(name, url string) Check {
+	return Check{Name: name, Run: func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+		return nil
+	}}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
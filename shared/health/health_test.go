@@ -0,0 +1,75 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadiness(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer peer.Close()
+
+	c := New("test",
+		Check{Name: "storage", Run: func(context.Context) error { return nil }},
+		DiskSpace("tmp", t.TempDir(), 0),
+		HTTP("peer", peer.URL+"/healthz"),
+	)
+	c.Add(Binaries("go")...)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	c.Routes(r)
+	get := func(path string) (int, Report) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var report Report
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		return rec.Code, report
+	}
+
+	code, report := get("/readyz")
+	if code != http.StatusOK || report.Status != "ok" || report.Service != "test" || len(report.Checks) != 4 {
+		t.Fatalf("ready: %d %+v", code, report)
+	}
+
+	c.Add(
+		Check{Name: "bucket", Run: func(context.Context) error { return errors.New("bucket 'site' does not exist") }},
+		DiskSpace("full", t.TempDir(), 1<<62),
+		HTTP("missing-peer", peer.URL+"/nope"),
+	)
+	c.Add(Binaries("zenith-no-such-binary")...)
+	code, report = get("/readyz")
+	if code != http.StatusServiceUnavailable || report.Status != "fail" {
+		t.Fatalf("not ready: %d %+v", code, report)
+	}
+	failed := map[string]string{}
+	for _, r := range report.Checks {
+		if r.Status != "ok" {
+			failed[r.Name] = r.Error
+		}
+	}
+	for _, name := range []string{"bucket", "disk:full", "missing-peer", "bin:zenith-no-such-binary"} {
+		if failed[name] == "" {
+			t.Errorf("check %s did not fail with an error: %v", name, failed)
+		}
+	}
+	if len(failed) != 4 {
+		t.Errorf("unexpected failures: %v", failed)
+	}
+
+	if code, report := get("/healthz"); code != http.StatusOK || report.Status != "fail" {
+		t.Errorf("healthz: %d %s", code, report.Status)
+	}
+}
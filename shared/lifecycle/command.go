@@ -0,0 +1,21 @@
+package lifecycle
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// WaitDelay is how long a cancelled command's output is waited for after it
+// is killed.
+const WaitDelay = 5 * time.Second
+
+// Command is exec.CommandContext for commands that start children of their
+// own, such as npm and git. The command runs in a new process group and
+// cancelling ctx kills the whole group, so no child outlives it.
+func Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = WaitDelay
+	return cmd
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package lifecycle
+
+import "os/exec"
+
+// setProcessGroup leaves cmd as it is: without process groups, cancelling
+// the command only kills the command itself.
+func setProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package lifecycle
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		// The group has the ID of its leader, the command itself.
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
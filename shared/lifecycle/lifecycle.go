@@ -0,0 +1,132 @@
+// Package lifecycle stops every service gracefully.
+//
+// On SIGINT or SIGTERM a service stops accepting connections and gives the
+// requests it is handling, deploys and builds included, the configured
+// shutdown timeout to finish. Requests still running after that have their
+// contexts cancelled, which kills the commands they started with Command,
+// and get a short grace period to record how far they got before the
+// process exits.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"zenith/shared/config"
+)
+
+// Grace is how long requests get to return once their contexts are
+// cancelled.
+const Grace = 10 * time.Second
+
+// SignalContext returns a context that is cancelled on SIGINT or SIGTERM.
+func SignalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// Timeout parses cfg.Timeout, where empty means the default of two minutes.
+func Timeout(cfg config.ShutdownConfig) (time.Duration, error) {
+	if cfg.Timeout == "" {
+		return 2 * time.Minute, nil
+	}
+	d, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid shutdown timeout: %w", err)
+	}
+	return d, nil
+}
+
+// Serve serves each of servers on its Addr, over TLS when it has a
+// TLSConfig, until ctx is done or one of them fails. It then shuts them all
+// down: new connections are refused, requests in flight get timeout to
+// finish, and the contexts of those still running after that are cancelled.
+// Serve returns once every request has returned or the grace period after
+// cancelling them is over.
+func Serve(ctx context.Context, timeout time.Duration, servers ...*http.Server) error {
+	base, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	var inflight sync.WaitGroup
+	errc := make(chan error, len(servers))
+	for _, srv := range servers {
+		srv.BaseContext = func(net.Listener) context.Context { return base }
+		srv.Handler = track(&inflight, srv.Handler)
+		go func() {
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if errors.Is(err, http.ErrServerClosed) {
+				err = nil
+			}
+			errc <- err
+		}()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errc:
+		if err != nil {
+			err = fmt.Errorf("server stopped: %w", err)
+		}
+	}
+
+	shutdownCtx, stop := context.WithTimeout(context.Background(), timeout)
+	defer stop()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.Shutdown(shutdownCtx)
+		}()
+	}
+	wg.Wait()
+
+	// Shutdown gave up on requests still running: cancel them and wait for
+	// them to clean up before closing their connections.
+	cancel()
+	Wait(&inflight, Grace)
+	for _, srv := range servers {
+		srv.Close()
+	}
+	return err
+}
+
+// Wait waits for wg for at most timeout and reports whether it finished.
+func Wait(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// track counts the requests h is handling in wg.
+func track(wg *sync.WaitGroup, h http.Handler) http.Handler {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,169 @@
+package lifecycle
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"zenith/shared/logging"
+)
+
+// serveOnFreePort starts Serve for a server running h and returns its URL
+// and the channel Serve's result arrives on.
+func serveOnFreePort(t *testing.T, ctx context.Context, timeout time.Duration, h http.Handler) (string, <-chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	errc := make(chan error, 1)
+	go func() { errc <- Serve(ctx, timeout, &http.Server{Addr: addr, Handler: h}) }()
+	url := "http://" + addr
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			return url, errc
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not start")
+	return "", nil
+}
+
+func TestServeDrainsRequests(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	url, errc := serveOnFreePort(t, ctx, 5*time.Second, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		if r.Context().Err() != nil {
+			t.Error("request cancelled while draining")
+		}
+		io.WriteString(w, "done")
+	}))
+
+	resp := make(chan string, 1)
+	go func() {
+		r, err := http.Get(url)
+		if err != nil {
+			resp <- err.Error()
+			return
+		}
+		defer r.Body.Close()
+		body, _ := io.ReadAll(r.Body)
+		resp <- string(body)
+	}()
+	<-started
+	stop()
+
+	if got := <-resp; got != "done" {
+		t.Errorf("response = %q, want done", got)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
+
+func TestServeCancelsRequestsAfterTimeout(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	url, errc := serveOnFreePort(t, ctx, 100*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+
+	go http.Get(url)
+	<-started
+	stop()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not cancelled after the shutdown timeout")
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
+
+func TestCommandKillsProcessGroup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no process groups")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	// The shell waits for a child that would outlive it if only the shell
+	// were killed.
+	cmd := Command(ctx, "sh", "-c", "sleep 30 & wait")
+	start := time.Now()
+	if err := cmd.Run(); err == nil {
+		t.Fatal("cancelled command succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("command took %v to stop", d)
+	}
+}
+
+func TestScratchRemovesLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenScratch(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := filepath.Join(dir, "done.zip")
+	left := filepath.Join(dir, "left.zip")
+	other := filepath.Join(dir, "other")
+	for _, p := range []string{done, left, other} {
+		os.WriteFile(p, []byte("x"), 0644)
+	}
+	s.Add(done)
+	s.Add(left)
+	if err := s.Remove(done); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart finds left.zip still listed.
+	if _, err := OpenScratch(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(left); !os.IsNotExist(err) {
+		t.Error("leftover not removed")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Error("untracked file removed")
+	}
+}
+
+func TestScratchMkdir(t *testing.T) {
+	s, err := OpenScratch(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := logging.WithDeploymentID(context.Background(), "d-1")
+	a, err := s.Mkdir(ctx, "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := s.Mkdir(ctx, "site")
+	if a == b || !strings.HasPrefix(filepath.Base(a), "d-1-site-") {
+		t.Errorf("Mkdir = %s, %s", a, b)
+	}
+	if err := s.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(a); !os.IsNotExist(err) {
+		t.Error("directory not removed")
+	}
+}
@@ -0,0 +1,113 @@
+package lifecycle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"zenith/shared/logging"
+)
+
+// scratchJournal is the file in a scratch directory listing its paths in
+// use.
+const scratchJournal = ".zenith-scratch.json"
+
+// Scratch tracks the clones, archives and build trees a service writes to
+// its tmp directory. The paths in use are listed in a journal in the
+// directory, so after a crash or a kill the next OpenScratch removes what
+// was left half-written without touching anything else in the directory.
+type Scratch struct {
+	mu      sync.Mutex
+	dir     string
+	journal string
+	paths   map[string]int
+}
+
+// OpenScratch removes the paths a previous run of the service left in dir
+// and starts a new journal.
+func OpenScratch(dir string) (*Scratch, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Scratch{dir: dir, journal: filepath.Join(dir, scratchJournal), paths: map[string]int{}}
+
+	data, err := os.ReadFile(s.journal)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var leftover []string
+	if len(data) > 0 {
+		// A corrupt journal is dropped: it only lists garbage.
+		json.Unmarshal(data, &leftover)
+	}
+	for _, p := range leftover {
+		os.RemoveAll(p)
+	}
+	return s, s.save()
+}
+
+// Add records that path is being written. A nil Scratch records nothing.
+func (s *Scratch) Add(path string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths[path]++
+	s.save()
+}
+
+// Mkdir creates and records a directory of its own for one job, so that
+// jobs for the same repository never share files. Its name starts with
+// the deployment ID in ctx, when there is one, and name. A nil Scratch
+// creates it in the system's temporary directory.
+func (s *Scratch) Mkdir(ctx context.Context, name string) (string, error) {
+	pattern := name + "-*"
+	if id := logging.DeploymentID(ctx); id != "" {
+		pattern = id + "-" + pattern
+	}
+	if s == nil {
+		return os.MkdirTemp("", pattern)
+	}
+	dir, err := os.MkdirTemp(s.dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	s.Add(dir)
+	return dir, nil
+}
+
+// Remove deletes path and, once every Add of it is matched, drops it from
+// the journal.
+func (s *Scratch) Remove(path string) error {
+	err := os.RemoveAll(path)
+	if s == nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paths[path]--; s.paths[path] <= 0 {
+		delete(s.paths, path)
+	}
+	s.save()
+	return err
+}
+
+func (s *Scratch) save() error {
+	paths := make([]string, 0, len(s.paths))
+	for p := range s.paths {
+		paths = append(paths, p)
+	}
+	data, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+	tmp := s.journal + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.journal)
+}
@@ -0,0 +1,231 @@
+// Package logging writes structured JSON logs for every service with
+// log/slog.
+//
+// Each line names its service and carries the request ID, deployment ID and
+// trace ID of the context it was logged with. The request and deployment IDs
+// travel between services in the X-Request-ID and X-Deployment-ID headers,
+// so the lines of one deploy can be found in the logs of every service.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"zenith/shared/redact"
+)
+
+// Headers carrying the IDs between services.
+const (
+	HeaderRequestID    = "X-Request-ID"
+	HeaderDeploymentID = "X-Deployment-ID"
+)
+
+// maxIDLength bounds the IDs accepted from callers.
+const maxIDLength = 128
+
+// New returns a logger for service that writes JSON lines at level or
+// above to stderr, with secrets redacted. Unknown levels mean "info".
+func New(service, level string) *slog.Logger {
+	h := slog.NewJSONHandler(redact.Default.Writer(os.Stderr), &slog.HandlerOptions{Level: ParseLevel(level)})
+	return slog.New(contextHandler{h}).With("service", service)
+}
+
+// ParseLevel returns the slog level named by s: debug, info, warn or error.
+func ParseLevel(s string) slog.Level {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	deploymentIDKey
+)
+
+// WithRequestID returns ctx carrying the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID in ctx, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithDeploymentID returns ctx carrying the ID of the deployment its work
+// is for.
+func WithDeploymentID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, deploymentIDKey, id)
+}
+
+// DeploymentID returns the deployment ID in ctx, or "".
+func DeploymentID(ctx context.Context) string {
+	id, _ := ctx.Value(deploymentIDKey).(string)
+	return id
+}
+
+// NewID returns a random 16-character hex ID.
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+var idPattern = regexp.MustCompile(`^[0-9a-f]{16,32}$`)
+
+// ValidID reports whether id looks like an ID NewID returns.
+func ValidID(id string) bool {
+	return idPattern.MatchString(id)
+}
+
+// Propagate adds the request and deployment IDs in ctx to the headers of
+// req.
+func Propagate(ctx context.Context, req *http.Request) {
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(HeaderRequestID, id)
+	}
+	if id := DeploymentID(ctx); id != "" {
+		req.Header.Set(HeaderDeploymentID, id)
+	}
+}
+
+// contextHandler adds the IDs in the context of each record to it.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if id := DeploymentID(ctx); id != "" {
+		r.AddAttrs(slog.String("deployment_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Middleware tags each request with the caller's X-Request-ID, or a new one,
+// echoes it in the response, and logs the request with logger when it
+// completes. It replaces gin's own request logger. A caller's
+// X-Deployment-ID is only kept by TrustDeploymentID.
+func Middleware(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(HeaderRequestID)
+		if id == "" || len(id) > maxIDLength {
+			id = NewID()
+		}
+		c.Request = c.Request.WithContext(WithRequestID(c.Request.Context(), id))
+		c.Header(HeaderRequestID, id)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		logger.LogAttrs(c.Request.Context(), level, "request",
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", c.ClientIP()),
+		)
+	}
+}
+
+// TrustDeploymentID keeps the caller's X-Deployment-ID in the request
+// context when it is an ID like NewID's. Deployment IDs name stored
+// manifests, so it only belongs behind auth.RequireSigned.
+func TrustDeploymentID(c *gin.Context) {
+	if id := c.GetHeader(HeaderDeploymentID); ValidID(id) {
+		c.Request = c.Request.WithContext(WithDeploymentID(c.Request.Context(), id))
+	}
+}
+
+// Writer returns a writer that logs each line written to it with logger as
+// msg, the line in "line". It lets the output of commands such as npm join
+// the structured logs. Close logs a last unterminated line.
+func Writer(ctx context.Context, logger *slog.Logger, msg string, args ...any) io.WriteCloser {
+	return &lineWriter{ctx: ctx, logger: logger.With(args...), msg: msg}
+}
+
+// maxLineLength is the longest line lineWriter buffers before logging it.
+const maxLineLength = 64 << 10
+
+type lineWriter struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	logger *slog.Logger
+	msg    string
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.log(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) > maxLineLength {
+		w.log(w.buf)
+		w.buf = nil
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.log(w.buf)
+	w.buf = nil
+	return nil
+}
+
+func (w *lineWriter) log(line []byte) {
+	if s := strings.TrimRight(string(line), "\r"); strings.TrimSpace(s) != "" {
+		w.logger.InfoContext(w.ctx, w.msg, "line", s)
+	}
+}
@@ -0,0 +1,129 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recordLogger returns a logger like New's that writes to buf.
+func recordLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(contextHandler{slog.NewJSONHandler(buf, nil)}).With("service", "test")
+}
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := recordLogger(&buf)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Middleware(logger))
+	r.GET("/work", func(c *gin.Context) {
+		logger.InfoContext(c.Request.Context(), "working")
+		c.Status(http.StatusTeapot)
+	})
+
+	req := httptest.NewRequest("GET", "/work", nil)
+	req.Header.Set(HeaderRequestID, "req-1")
+	req.Header.Set(HeaderDeploymentID, "0123456789abcdef")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if got := rec.Header().Get(HeaderRequestID); got != "req-1" {
+		t.Errorf("response request ID = %q", got)
+	}
+
+	lines := decodeLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatalf("%d log lines, want 2", len(lines))
+	}
+	for _, l := range lines {
+		if l["request_id"] != "req-1" || l["service"] != "test" {
+			t.Errorf("log line lacks IDs: %v", l)
+		}
+		if _, ok := l["deployment_id"]; ok {
+			t.Errorf("deployment ID taken from an untrusted caller: %v", l)
+		}
+	}
+	if l := lines[1]; l["msg"] != "request" || l["level"] != "WARN" || l["status"] != float64(http.StatusTeapot) {
+		t.Errorf("request line = %v", l)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/work", nil))
+	if id := rec.Header().Get(HeaderRequestID); len(id) != 16 {
+		t.Errorf("generated request ID = %q", id)
+	}
+}
+
+func TestTrustDeploymentID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/work", TrustDeploymentID, func(c *gin.Context) {
+		c.String(http.StatusOK, DeploymentID(c.Request.Context()))
+	})
+	for header, want := range map[string]string{
+		"0123456789abcdef":         "0123456789abcdef",
+		"0123456789ABCDEF":         "",
+		"../../manifests/site/v1":  "",
+		"0123456789abcdef/../x":    "",
+		"":                         "",
+		"0123456789abcdef01234567": "0123456789abcdef01234567",
+	} {
+		req := httptest.NewRequest("GET", "/work", nil)
+		req.Header.Set(HeaderDeploymentID, header)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Body.String() != want {
+			t.Errorf("X-Deployment-ID %q: deployment ID = %q, want %q", header, rec.Body, want)
+		}
+	}
+}
+
+func TestPropagate(t *testing.T) {
+	ctx := WithDeploymentID(WithRequestID(context.Background(), "req-1"), "dep-1")
+	req := httptest.NewRequest("POST", "/upload", nil)
+	Propagate(ctx, req)
+	if req.Header.Get(HeaderRequestID) != "req-1" || req.Header.Get(HeaderDeploymentID) != "dep-1" {
+		t.Errorf("headers = %v", req.Header)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := Writer(WithDeploymentID(context.Background(), "dep-1"), recordLogger(&buf), "command output", "command", "npm")
+	w.Write([]byte("added 12 packages\n\nfound 0 vuln"))
+	w.Write([]byte("erabilities\r\nlast"))
+	w.Close()
+
+	var got []string
+	for _, l := range decodeLines(t, &buf) {
+		if l["command"] != "npm" || l["deployment_id"] != "dep-1" {
+			t.Errorf("line lacks attributes: %v", l)
+		}
+		got = append(got, l["line"].(string))
+	}
+	want := []string{"added 12 packages", "found 0 vulnerabilities", "last"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,333 @@
+// Package manifest stores build output by content. Every file is stored
+// once as a blob named after its SHA-256, shared by every deploy of every
+// project that has the same file, and a deploy is a manifest mapping its
+// paths to those blobs:
+//
+//	blobs/sha256/ab/ab12…           the content of a file
+//	manifests/<repo>/<id>.json      the paths of one deploy
+//	releases/<repo>.json            the deploy a project serves
+//	routes/hosts.json               custom domains and their projects
+//	sources/<repo>/<id>.zip         the source a deploy was built from
+//
+// Storing a build uploads only the blobs storage does not have yet, and
+// going back to an earlier deploy only needs its manifest. Edge servers
+// serve projects from storage through the releases and the hosts table.
+package manifest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"zenith/shared/storage"
+)
+
+var (
+	ErrUnsafePath = errors.New("manifest path escapes the destination")
+	ErrCorrupt    = errors.New("blob does not match its checksum")
+)
+
+// workers is how many files are hashed and uploaded, or downloaded, at
+// once.
+const workers = 8
+
+// Manifest lists the files of one deploy of a project.
+type Manifest struct {
+	Repo      string    `json:"repo"`
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Files maps slash-separated paths to their blobs.
+	Files map[string]Entry `json:"files"`
+}
+
+// Entry is the blob of one file.
+type Entry struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Stats describes a stored build: its files and how many of them storage
+// did not already hold.
+type Stats struct {
+	Files    int   `json:"files"`
+	Size     int64 `json:"size"`
+	NewFiles int   `json:"new_files"`
+	NewSize  int64 `json:"new_size"`
+}
+
+// Key returns the key of the manifest id of repo.
+func Key(repo, id string) string {
+	return "manifests/" + repo + "/" + id + ".json"
+}
+
+// SourceKey returns the key of the source archive of deploy id of repo.
+func SourceKey(repo, id string) string {
+	return "sources/" + repo + "/" + id + ".zip"
+}
+
+// SourceID returns the deploy ID in key, and whether key is a SourceKey of
+// repo at all.
+func SourceID(repo, key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, "sources/"+repo+"/")
+	if !ok {
+		return "", false
+	}
+	id, ok := strings.CutSuffix(rest, ".zip")
+	return id, ok && id != "" && !strings.ContainsAny(id, "/\\")
+}
+
+// BlobKey returns the key of the blob with the hex SHA-256 sum, which must
+// pass ValidSum. Blobs are spread over 256 prefixes.
+func BlobKey(sum string) string {
+	return "blobs/sha256/" + sum[:2] + "/" + sum
+}
+
+// ValidSum reports whether sum is a hex SHA-256 sum as Build writes them:
+// 64 lowercase hex digits.
+func ValidSum(sum string) bool {
+	if len(sum) != sha256.Size*2 {
+		return false
+	}
+	for _, r := range sum {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Build stores the regular files below dir as blobs, skipping those
+// already in s, then stores their manifest as Key(repo, id). Symlinks and
+// other special files are left out.
+func Build(ctx context.Context, s storage.Store, dir, repo, id string) (*Manifest, Stats, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, Stats{}, err
+	}
+
+	m := &Manifest{Repo: repo, ID: id, CreatedAt: time.Now().UTC(), Files: make(map[string]Entry, len(paths))}
+	var (
+		mu    sync.Mutex
+		stats Stats
+	)
+	err = each(ctx, paths, func(ctx context.Context, name string) error {
+		entry, stored, err := storeFile(ctx, s, filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		m.Files[name] = entry
+		stats.Files++
+		stats.Size += entry.Size
+		if stored {
+			stats.NewFiles++
+			stats.NewSize += entry.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, stats, err
+	}
+
+	if err := putJSON(ctx, s, Key(repo, id), m); err != nil {
+		return nil, stats, fmt.Errorf("storing manifest: %w", err)
+	}
+	return m, stats, nil
+}
+
+// storeFile hashes the file at path and stores it unless its blob exists.
+// stored reports whether it had to be.
+func storeFile(ctx context.Context, s storage.Store, path string) (entry Entry, stored bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	entry = Entry{SHA256: hex.EncodeToString(h.Sum(nil)), Size: size}
+
+	key := BlobKey(entry.SHA256)
+	exists, err := s.Exists(ctx, key)
+	if err != nil || exists {
+		return entry, false, err
+	}
+	// The file is seekable, so storage can retry the upload.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return Entry{}, false, err
+	}
+	if err := s.Put(ctx, key, f, size, "application/octet-stream"); err != nil {
+		return Entry{}, false, err
+	}
+	return entry, true, nil
+}
+
+// Load reads the manifest stored as key. It fails with ErrCorrupt if an
+// entry's checksum is not a valid SHA-256 sum, which would otherwise be
+// used in blob keys and cache paths.
+func Load(ctx context.Context, s storage.Store, key string) (*Manifest, error) {
+	var m Manifest
+	if err := getJSON(ctx, s, key, &m); err != nil {
+		return nil, err
+	}
+	for name, entry := range m.Files {
+		if !ValidSum(entry.SHA256) {
+			return nil, fmt.Errorf("%s: %s: invalid checksum %q: %w", key, name, entry.SHA256, ErrCorrupt)
+		}
+	}
+	return &m, nil
+}
+
+// Materialize writes the files of m from their blobs in s to dest,
+// checking each against its checksum.
+func Materialize(ctx context.Context, s storage.Store, m *Manifest, dest string) error {
+	names := make([]string, 0, len(m.Files))
+	for name := range m.Files {
+		if !filepath.IsLocal(name) || strings.Contains(name, `\`) {
+			return fmt.Errorf("%s: %w", name, ErrUnsafePath)
+		}
+		names = append(names, name)
+	}
+	return each(ctx, names, func(ctx context.Context, name string) error {
+		if err := fetchFile(ctx, s, m.Files[name], filepath.Join(dest, filepath.FromSlash(name))); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+func fetchFile(ctx context.Context, s storage.Store, entry Entry, target string) error {
+	if !ValidSum(entry.SHA256) {
+		return ErrCorrupt
+	}
+	obj, err := s.Open(ctx, BlobKey(entry.SHA256))
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), io.NewSectionReader(obj, 0, obj.Size()))
+	if err != nil {
+		return err
+	}
+	if n != entry.Size || hex.EncodeToString(h.Sum(nil)) != entry.SHA256 {
+		return ErrCorrupt
+	}
+	return out.Close()
+}
+
+// Usage is the storage a project uses.
+type Usage struct {
+	Repo      string `json:"repo"`
+	Manifests int    `json:"manifests"`
+	// Blobs and Bytes count the distinct files of all the manifests, which
+	// is what the project stores; other projects may share some of them.
+	Blobs int   `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+	// LogicalBytes is the size of every manifest added up, what storing
+	// each deploy whole would take.
+	LogicalBytes int64 `json:"logical_bytes"`
+}
+
+// ProjectUsage adds up the manifests of repo.
+func ProjectUsage(ctx context.Context, s storage.Store, repo string) (Usage, error) {
+	u := Usage{Repo: repo}
+	keys, err := List(ctx, s, repo)
+	if err != nil {
+		return u, err
+	}
+	blobs := map[string]bool{}
+	for _, key := range keys {
+		m, err := Load(ctx, s, key)
+		if err != nil {
+			return u, err
+		}
+		u.Manifests++
+		for _, entry := range m.Files {
+			u.LogicalBytes += entry.Size
+			if !blobs[entry.SHA256] {
+				blobs[entry.SHA256] = true
+				u.Blobs++
+				u.Bytes += entry.Size
+			}
+		}
+	}
+	return u, nil
+}
+
+// List returns the keys of the manifests of repo.
+func List(ctx context.Context, s storage.Store, repo string) ([]string, error) {
+	keys, err := s.List(ctx, "manifests/"+repo+"/")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// each calls fn for every name with up to workers calls at once, and
+// returns the first error, cancelling the calls still running.
+func each(ctx context.Context, names []string, fn func(context.Context, string) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				if err := fn(ctx, name); err != nil {
+					cancel(err)
+				}
+			}
+		}()
+	}
+	for _, name := range names {
+		if ctx.Err() != nil {
+			break
+		}
+		work <- name
+	}
+	close(work)
+	wg.Wait()
+	if err := context.Cause(ctx); err != nil && ctx.Err() != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package manifest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zenith/shared/config"
+	"zenith/shared/storage"
+)
+
+func newStore(t *testing.T) storage.Store {
+	t.Helper()
+	s, err := storage.New(config.StorageConfig{Backend: "local", LocalDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuildDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(t)
+
+	first := t.TempDir()
+	writeFiles(t, first, map[string]string{"index.html": "<h1>v1</h1>", "assets/app.js": "app()", "assets/copy.js": "app()"})
+	_, stats, err := Build(ctx, s, first, "site", "d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (Stats{Files: 3, Size: 21, NewFiles: 2, NewSize: 16}) {
+		t.Errorf("first build: %+v", stats)
+	}
+
+	// Only the changed page is new.
+	second := t.TempDir()
+	writeFiles(t, second, map[string]string{"index.html": "<h1>v2</h1>", "assets/app.js": "app()"})
+	m, stats, err := Build(ctx, s, second, "site", "d2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (Stats{Files: 2, Size: 16, NewFiles: 1, NewSize: 11}) {
+		t.Errorf("second build: %+v", stats)
+	}
+
+	loaded, err := Load(ctx, s, Key("site", "d2"))
+	if err != nil || loaded.ID != "d2" || loaded.Files["assets/app.js"] != m.Files["assets/app.js"] {
+		t.Fatalf("Load = %+v, %v", loaded, err)
+	}
+	dest := filepath.Join(t.TempDir(), "site")
+	if err := Materialize(ctx, s, loaded, dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "assets", "app.js")); string(data) != "app()" {
+		t.Errorf("materialized app.js = %q", data)
+	}
+
+	u, err := ProjectUsage(ctx, s, "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != (Usage{Repo: "site", Manifests: 2, Blobs: 3, Bytes: 27, LogicalBytes: 37}) {
+		t.Errorf("usage = %+v", u)
+	}
+}
+
+func TestMaterializeRejects(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(t)
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"index.html": "<h1>site</h1>"})
+	m, _, err := Build(ctx, s, src, "site", "d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	escaping := &Manifest{Files: map[string]Entry{"../index.html": m.Files["index.html"]}}
+	if err := Materialize(ctx, s, escaping, t.TempDir()); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("escaping path: err = %v", err)
+	}
+
+	wrong := m.Files["index.html"]
+	wrong.Size++
+	corrupt := &Manifest{Files: map[string]Entry{"index.html": wrong}}
+	if err := Materialize(ctx, s, corrupt, t.TempDir()); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("wrong size: err = %v", err)
+	}
+
+	// Checksums that are not 64 hex digits never reach a blob key.
+	for _, sum := range []string{"", "ab", strings.Repeat("A", 64), "../" + strings.Repeat("a", 61), strings.Repeat("a", 31) + "/" + strings.Repeat("a", 32)} {
+		bad := &Manifest{Repo: "site", ID: "bad", Files: map[string]Entry{"index.html": {SHA256: sum, Size: 1}}}
+		if err := Materialize(ctx, s, bad, t.TempDir()); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Materialize with checksum %q: err = %v", sum, err)
+		}
+		if err := putJSON(ctx, s, Key("site", "bad"), bad); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(ctx, s, Key("site", "bad")); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Load with checksum %q: err = %v", sum, err)
+		}
+	}
+	if _, err := Load(ctx, s, Key("site", "d1")); err != nil {
+		t.Errorf("Load: %v", err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(t)
+
+	if _, err := LoadRelease(ctx, s, "site"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("LoadRelease before Publish: err = %v", err)
+	}
+	if err := Publish(ctx, s, Release{Repo: "site", DeploymentID: "d1", Manifest: Key("site", "d1")}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRelease(ctx, s, "site")
+	if err != nil || r.DeploymentID != "d1" || r.Manifest != Key("site", "d1") || r.UpdatedAt.IsZero() {
+		t.Errorf("LoadRelease = %+v, %v", r, err)
+	}
+	if err := Unpublish(ctx, s, "site"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRelease(ctx, s, "site"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("LoadRelease after Unpublish: err = %v", err)
+	}
+
+	if hosts, err := LoadHosts(ctx, s); err != nil || len(hosts) != 0 {
+		t.Errorf("LoadHosts before SaveHosts = %v, %v", hosts, err)
+	}
+	SaveHosts(ctx, s, map[string]string{"www.example.com": "site"})
+	if hosts, err := LoadHosts(ctx, s); err != nil || hosts["www.example.com"] != "site" {
+		t.Errorf("LoadHosts = %v, %v", hosts, err)
+	}
+}
+
+func TestSourceID(t *testing.T) {
+	key := SourceKey("site", "0123456789abcdef")
+	if key != "sources/site/0123456789abcdef.zip" {
+		t.Errorf("SourceKey = %q", key)
+	}
+	for _, tt := range []struct {
+		repo, key, id string
+		ok            bool
+	}{
+		{"site", key, "0123456789abcdef", true},
+		{"blog", key, "", false},
+		{"site", "site.zip", "", false},
+		{"site", "sources/site/.zip", "", false},
+		{"site", "sources/site/a/b.zip", "", false},
+		{"site", "sources/site/d1.json", "", false},
+	} {
+		if id, ok := SourceID(tt.repo, tt.key); ok != tt.ok || (ok && id != tt.id) {
+			t.Errorf("SourceID(%q, %q) = %q, %v", tt.repo, tt.key, id, ok)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"zenith/shared/storage"
+)
+
+// HostsKey is the key of the table of custom domains edge servers serve.
+const HostsKey = "routes/hosts.json"
+
+// Release is the deployment a project serves. request_handler stores one
+// per project when it publishes a deploy, and edge servers follow it, so a
+// deploy or a rollback only replaces this small object.
+type Release struct {
+	Repo         string `json:"repo"`
+	DeploymentID string `json:"deployment_id"`
+	Manifest     string `json:"manifest"`
+	// StripDotfiles hides the paths with a segment starting with a dot,
+	// other than .well-known, as the project's secret policy asks.
+	StripDotfiles bool      `json:"strip_dotfiles,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// ReleaseKey returns the key of the release of repo.
+func ReleaseKey(repo string) string {
+	return "releases/" + repo + ".json"
+}
+
+// Publish stores r as the release of its project.
+func Publish(ctx context.Context, s storage.Store, r Release) error {
+	r.UpdatedAt = time.Now().UTC()
+	return putJSON(ctx, s, ReleaseKey(r.Repo), r)
+}
+
+// Unpublish removes the release of repo, which is then served nowhere.
+func Unpublish(ctx context.Context, s storage.Store, repo string) error {
+	return s.Delete(ctx, ReleaseKey(repo))
+}
+
+// LoadRelease returns the release of repo. It fails with
+// storage.ErrNotFound when repo has none.
+func LoadRelease(ctx context.Context, s storage.Store, repo string) (*Release, error) {
+	var r Release
+	if err := getJSON(ctx, s, ReleaseKey(repo), &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// SaveHosts stores the table mapping verified custom domains to their
+// projects.
+func SaveHosts(ctx context.Context, s storage.Store, hosts map[string]string) error {
+	return putJSON(ctx, s, HostsKey, hosts)
+}
+
+// LoadHosts returns the table SaveHosts stored, or an empty one.
+func LoadHosts(ctx context.Context, s storage.Store) (map[string]string, error) {
+	hosts := map[string]string{}
+	if err := getJSON(ctx, s, HostsKey, &hosts); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+func putJSON(ctx context.Context, s storage.Store, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, key, bytes.NewReader(data), int64(len(data)), "application/json")
+}
+
+func getJSON(ctx context.Context, s storage.Store, key string, v any) error {
+	obj, err := s.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	if err := json.NewDecoder(io.NewSectionReader(obj, 0, obj.Size())).Decode(v); err != nil {
+		return fmt.Errorf("reading %s: %w", key, err)
+	}
+	return nil
+}
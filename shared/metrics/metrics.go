@@ -0,0 +1,303 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format.
+//
+// Metrics are created once, at package level, on the Default registry, with
+// the names of their labels; values are recorded by passing the label values
+// in the same order:
+//
+//	var builds = metrics.NewCounter("zenith_builds_total", "Builds by outcome.", "outcome")
+//	builds.Inc("success")
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry holds metrics and writes them out.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]*metric{}}
+}
+
+// Default is the registry the New functions register with and Handler
+// serves. All services in a process share it.
+var Default = NewRegistry()
+
+type kind string
+
+const (
+	counterKind   kind = "counter"
+	gaugeKind     kind = "gauge"
+	histogramKind kind = "histogram"
+)
+
+// metric is a named family of series, one per combination of label values.
+type metric struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64
+	// Histograms only: counts[i] observations fell in buckets[i], the last
+	// one in +Inf.
+	counts []uint64
+	sum    float64
+}
+
+func (r *Registry) register(m *metric) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[m.name]; ok {
+		panic("metrics: " + m.name + " registered twice")
+	}
+	m.series = map[string]*series{}
+	r.metrics[m.name] = m
+	return m
+}
+
+// get returns the series for values, creating it on first use.
+func (m *metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: slices.Clone(values)}
+		if m.kind == histogramKind {
+			s.counts = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Counter is a value that only goes up.
+type Counter struct{ m *metric }
+
+// NewCounter registers a counter on Default.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{Default.register(&metric{name: name, help: help, kind: counterKind, labels: labels})}
+}
+
+func (c *Counter) Inc(labels ...string) { c.Add(1, labels...) }
+
+// Add adds v, which must not be negative.
+func (c *Counter) Add(v float64, labels ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.m.name + " decreased")
+	}
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.m.get(labels).value += v
+}
+
+// Value returns the current count.
+func (c *Counter) Value(labels ...string) float64 {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	return c.m.get(labels).value
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct{ m *metric }
+
+// NewGauge registers a gauge on Default.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{Default.register(&metric{name: name, help: help, kind: gaugeKind, labels: labels})}
+}
+
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.get(labels).value = v
+}
+
+func (g *Gauge) Add(v float64, labels ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.get(labels).value += v
+}
+
+func (g *Gauge) Inc(labels ...string) { g.Add(1, labels...) }
+func (g *Gauge) Dec(labels ...string) { g.Add(-1, labels...) }
+
+// Value returns the current value.
+func (g *Gauge) Value(labels ...string) float64 {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	return g.m.get(labels).value
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct{ m *metric }
+
+// NewHistogram registers a histogram on Default with the given upper bucket
+// bounds, in increasing order.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !slices.IsSorted(buckets) {
+		panic("metrics: buckets of " + name + " are not sorted")
+	}
+	return &Histogram{Default.register(&metric{name: name, help: help, kind: histogramKind, labels: labels, buckets: buckets})}
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	s := h.m.get(labels)
+	i, _ := slices.BinarySearch(h.m.buckets, v)
+	s.counts[i]++
+	s.sum += v
+}
+
+// ObserveSince observes the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count(labels ...string) uint64 {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	var n uint64
+	for _, c := range h.m.get(labels).counts {
+		n += c
+	}
+	return n
+}
+
+// Buckets for durations in seconds and sizes in bytes.
+var (
+	// DurationBuckets span 5ms to 10 minutes, for anything from a request
+	// to an npm install.
+	DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+	// SizeBuckets span 1KiB to 4GiB in powers of four.
+	SizeBuckets = ExponentialBuckets(1<<10, 4, 12)
+)
+
+// ExponentialBuckets returns n buckets starting at start, each factor times
+// the previous one.
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	buckets := make([]float64, n)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// WriteTo writes every metric in the text exposition format, sorted by name
+// and label values.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		r.mu.Lock()
+		m := r.metrics[name]
+		r.mu.Unlock()
+		m.write(&b)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (m *metric) write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, escapeHelp(m.help), m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != histogramKind {
+			fmt.Fprintf(b, "%s%s %s\n", m.name, labelString(m.labels, s.labels, "", 0), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, c := range s.counts {
+			cumulative += c
+			le := math.Inf(1)
+			if i < len(m.buckets) {
+				le = m.buckets[i]
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, labelString(m.labels, s.labels, "le", le), cumulative)
+		}
+		fmt.Fprintf(b, "%s_sum%s %s\n", m.name, labelString(m.labels, s.labels, "", 0), formatFloat(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", m.name, labelString(m.labels, s.labels, "", 0), cumulative)
+	}
+}
+
+// labelString formats names and values as {a="1",b="2"}, adding le when
+// set.
+func labelString(names, values []string, le string, bound float64) string {
+	if len(names) == 0 && le == "" {
+		return ""
+	}
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, name+`="`+escapeValue(values[i])+`"`)
+	}
+	if le != "" {
+		parts = append(parts, le+`="`+formatFloat(bound)+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	valueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeValue(s string) string { return valueEscaper.Replace(s) }
+
+// Handler serves the Default registry to Prometheus.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.WriteTo(w)
+	})
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	requests := NewCounter("test_requests_total", "Requests.\nBy code.", "site", "code")
+	inflight := NewGauge("test_inflight", "In flight.")
+	latency := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "site")
+
+	requests.Inc("a", "200")
+	requests.Add(2, "a", "200")
+	requests.Inc(`we"ird\`, "404")
+	inflight.Inc()
+	inflight.Inc()
+	inflight.Dec()
+	latency.Observe(0.05, "a")
+	latency.Observe(0.1, "a")
+	latency.Observe(3, "a")
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# HELP test_requests_total Requests.\\nBy code.\n# TYPE test_requests_total counter\n",
+		`test_requests_total{site="a",code="200"} 3` + "\n",
+		`test_requests_total{site="we\"ird\\",code="404"} 1` + "\n",
+		"# TYPE test_inflight gauge\ntest_inflight 1\n",
+		`test_latency_seconds_bucket{site="a",le="0.1"} 2` + "\n",
+		`test_latency_seconds_bucket{site="a",le="1"} 2` + "\n",
+		`test_latency_seconds_bucket{site="a",le="+Inf"} 3` + "\n",
+		`test_latency_seconds_sum{site="a"} 3.15` + "\n",
+		`test_latency_seconds_count{site="a"} 3` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("exposition lacks %q:\n%s", want, body)
+		}
+	}
+	if strings.Index(body, "test_inflight") > strings.Index(body, "test_latency_seconds") {
+		t.Error("metrics are not sorted by name")
+	}
+}
+
+func TestTimeStage(t *testing.T) {
+	TimeStage("upload", "clone")(nil)
+	TimeStage("upload", "clone")(errors.New("boom"))
+	TimeStage("upload", "clone")(nil)
+	if n := StageDuration.Count("upload", "clone", "success"); n != 2 {
+		t.Errorf("%d successes, want 2", n)
+	}
+	if n := StageDuration.Count("upload", "clone", "failure"); n != 1 {
+		t.Errorf("%d failures, want 1", n)
+	}
+}
@@ -0,0 +1,32 @@
+package metrics
+
+import "time"
+
+// Metrics recorded by more than one service.
+var (
+	StageDuration = NewHistogram("zenith_stage_duration_seconds",
+		"Duration of deploy pipeline stages.", DurationBuckets, "service", "stage", "outcome")
+	ArtifactBytes = NewHistogram("zenith_artifact_bytes",
+		"Bytes stored per source archive and build; builds count only the files storage did not hold.", SizeBuckets, "kind")
+	CacheRequests = NewCounter("zenith_cache_requests_total",
+		"Cache lookups by cache and result (hit or miss).", "cache", "result")
+	Retries = NewCounter("zenith_retries_total",
+		"Storage and service calls retried after transient errors, by operation.", "operation")
+)
+
+// TimeStage starts timing stage of service. Call the returned function with
+// the stage's error, or nil, when it ends.
+func TimeStage(service, stage string) func(error) {
+	start := time.Now()
+	return func(err error) {
+		StageDuration.ObserveSince(start, service, stage, Outcome(err))
+	}
+}
+
+// Outcome is the outcome label for err: "success" or "failure".
+func Outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -0,0 +1,136 @@
+// Package redact scrubs configured secrets from text before it is logged or
+// returned to a client.
+package redact
+
+import (
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Placeholder replaces every secret.
+const Placeholder = "[redacted]"
+
+// Secrets shorter than this are ignored; replacing them would mangle
+// unrelated text without protecting anything.
+const minLength = 4
+
+// Redactor replaces known secrets, including their URL-escaped forms.
+type Redactor struct {
+	mu       sync.RWMutex
+	secrets  map[string]bool
+	replacer *strings.Replacer
+}
+
+// New returns a Redactor for secrets.
+func New(secrets ...string) *Redactor {
+	r := &Redactor{secrets: map[string]bool{}}
+	r.Add(secrets...)
+	return r
+}
+
+// Add registers more secrets.
+func (r *Redactor) Add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range secrets {
+		if len(s) < minLength {
+			continue
+		}
+		r.secrets[s] = true
+		r.secrets[url.QueryEscape(s)] = true
+		r.secrets[url.PathEscape(s)] = true
+	}
+
+	// Longer secrets go first so one containing another is replaced whole.
+	var all []string
+	for s := range r.secrets {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool { return len(all[i]) > len(all[j]) })
+	var pairs []string
+	for _, s := range all {
+		pairs = append(pairs, s, Placeholder)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// String returns s with every secret replaced.
+func (r *Redactor) String(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.replacer == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// Error returns err with a redacted message. errors.Is and errors.As still
+// see the original error.
+func (r *Redactor) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := r.String(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{msg: msg, err: err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// Writer returns a writer that redacts each write before passing it to w.
+// A secret split across two writes is not caught; the log package and gin
+// write a whole line at a time.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return &writer{r: r, w: w}
+}
+
+type writer struct {
+	r *Redactor
+	w io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	clean := w.r.String(string(p))
+	if _, err := io.WriteString(w.w, clean); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Default is the Redactor used by the package-level functions.
+var Default = New()
+
+// String redacts s with Default.
+func String(s string) string { return Default.String(s) }
+
+// Error redacts err with Default.
+func Error(err error) error { return Default.Error(err) }
+
+// Install adds secrets to Default and routes the standard logger and gin's
+// request and error logs through it. Installing again only adds secrets.
+func Install(secrets ...string) {
+	Default.Add(secrets...)
+	if _, ok := log.Writer().(*writer); !ok {
+		log.SetOutput(Default.Writer(log.Writer()))
+	}
+	if _, ok := gin.DefaultWriter.(*writer); !ok {
+		gin.DefaultWriter = Default.Writer(gin.DefaultWriter)
+	}
+	if _, ok := gin.DefaultErrorWriter.(*writer); !ok {
+		gin.DefaultErrorWriter = Default.Writer(gin.DefaultErrorWriter)
+	}
+}
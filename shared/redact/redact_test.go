@@ -0,0 +1,41 @@
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	r := New("ghp_secret/token+1", "abc", "ghp_secret")
+
+	got := r.String("https://ghp_secret/token+1@github.com ghp_secret%2Ftoken%2B1 ghp_secret abc")
+	want := "https://[redacted]@github.com [redacted] [redacted] abc"
+	if got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+
+	err := r.Error(fmt.Errorf("clone with ghp_secret failed: %w", fs.ErrNotExist))
+	if strings.Contains(err.Error(), "ghp_secret") {
+		t.Errorf("Error = %q", err)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Error("redacted error no longer wraps the original")
+	}
+	if r.Error(nil) != nil {
+		t.Error("Error(nil) != nil")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(New("hunter2hunter2").Writer(&buf), "", 0)
+	logger.Printf("password is %s", "hunter2hunter2")
+	if got := buf.String(); got != "password is [redacted]\n" {
+		t.Errorf("logged %q", got)
+	}
+}
@@ -0,0 +1,163 @@
+// Package retry retries storage and service calls that fail with transient
+// errors, waiting exponentially longer between tries.
+//
+// Only errors known to be transient are retried: timeouts, refused, reset
+// or dropped connections, and errors marked with Mark, such as a 503 from a
+// peer. Anything else, including the caller's context ending, is returned
+// at once.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"zenith/shared/config"
+	"zenith/shared/metrics"
+)
+
+// Policy is how often and how patiently an operation is tried.
+type Policy struct {
+	// Attempts is the number of tries, the first one included.
+	Attempts int
+	// BaseDelay is the wait before the first retry. It doubles for each
+	// retry after that, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// policy is the Policy Do uses, set by Setup.
+var policy = Policy{Attempts: 4, BaseDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second}
+
+// Setup makes Do use the policy in cfg.
+func Setup(cfg config.RetryConfig) error {
+	p := Policy{Attempts: cfg.Attempts, BaseDelay: policy.BaseDelay, MaxDelay: policy.MaxDelay}
+	var err error
+	if cfg.BaseDelay != "" {
+		if p.BaseDelay, err = time.ParseDuration(cfg.BaseDelay); err != nil {
+			return fmt.Errorf("invalid retry base delay: %w", err)
+		}
+	}
+	if cfg.MaxDelay != "" {
+		if p.MaxDelay, err = time.ParseDuration(cfg.MaxDelay); err != nil {
+			return fmt.Errorf("invalid retry max delay: %w", err)
+		}
+	}
+	policy = p
+	return nil
+}
+
+// Do calls fn until it succeeds, fails with an error that is not
+// transient, or has been tried as often as the policy set by Setup allows.
+// op names the operation in logs and in metrics.Retries. Do returns the
+// error of the last try.
+func Do(ctx context.Context, op string, fn func(context.Context) error) error {
+	return policy.Do(ctx, op, fn)
+}
+
+// Do is the package-level Do with policy p.
+func (p Policy) Do(ctx context.Context, op string, fn func(context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= p.Attempts || !Transient(err) || ctx.Err() != nil {
+			return err
+		}
+		delay := p.delay(attempt)
+		slog.WarnContext(ctx, "retrying after transient error", "operation", op, "attempt", attempt, "delay", delay, "error", err)
+		metrics.Retries.Inc(op)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// delay is the wait after try attempt: BaseDelay doubled for each earlier
+// retry, capped at MaxDelay, of which a random half is waited so that
+// callers failing together do not retry together.
+func (p Policy) delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxDelay)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// transientErrnos are the system errors of connections that may succeed
+// when made again.
+var transientErrnos = []error{
+	syscall.ECONNREFUSED,
+	syscall.ECONNRESET,
+	syscall.ECONNABORTED,
+	syscall.EPIPE,
+	syscall.ETIMEDOUT,
+	syscall.EHOSTUNREACH,
+	syscall.ENETUNREACH,
+}
+
+// Transient reports whether err may go away if the operation is tried
+// again.
+func Transient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var marked interface{ Transient() bool }
+	if errors.As(err, &marked) {
+		return marked.Transient()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && (dnsErr.IsTimeout || dnsErr.IsTemporary) {
+		return true
+	}
+	for _, target := range transientErrnos {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	// A connection closed before the whole response arrived.
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// Mark returns err marked as transient, or nil for a nil err.
+func Mark(err error) error {
+	if err == nil {
+		return nil
+	}
+	return transientError{err}
+}
+
+type transientError struct {
+	error
+}
+
+func (transientError) Transient() bool { return true }
+func (e transientError) Unwrap() error { return e.error }
+
+// Status reports whether an HTTP response with status code is worth
+// retrying: the server was overloaded, unavailable or behind a gateway that
+// could not reach it. Other errors, 500 included, are not expected to go
+// away on their own.
+func Status(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var fast = Policy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+func TestDo(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	permanent := errors.New("npm build failed")
+
+	tests := []struct {
+		name  string
+		errs  []error
+		tries int
+		err   error
+	}{
+		{"succeeds after transient errors", []error{refused, Mark(errors.New("503")), nil}, 3, nil},
+		{"gives up after the last attempt", []error{refused, refused, refused, nil}, 3, refused},
+		{"returns other errors at once", []error{permanent, nil}, 1, permanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tries := 0
+			err := fast.Do(context.Background(), "test", func(context.Context) error {
+				tries++
+				return tt.errs[tries-1]
+			})
+			if tries != tt.tries || !errors.Is(err, tt.err) {
+				t.Errorf("%d tries, err %v; want %d, %v", tries, err, tt.tries, tt.err)
+			}
+		})
+	}
+}
+
+func TestDoStopsWhenContextEnds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tries := 0
+	Policy{Attempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}.Do(ctx, "test", func(context.Context) error {
+		tries++
+		cancel()
+		return Mark(errors.New("unavailable"))
+	})
+	if tries != 1 {
+		t.Errorf("%d tries after the context ended, want 1", tries)
+	}
+}
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("get: %w", syscall.ECONNRESET), true},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{fmt.Errorf("read body: %w", errors.New("unexpected EOF")), false},
+		{context.Canceled, false},
+		{Mark(context.DeadlineExceeded), true},
+		{os.ErrNotExist, false},
+	}
+	for _, tt := range tests {
+		if got := Transient(tt.err); got != tt.want {
+			t.Errorf("Transient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	p := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, max := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		if d := p.delay(attempt); d < max/2 || d > max {
+			t.Errorf("delay(%d) = %v, want between %v and %v", attempt, d, max/2, max)
+		}
+	}
+}
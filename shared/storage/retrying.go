@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/minio/minio-go/v7"
+	"zenith/shared/retry"
+)
+
+// retrying retries calls that fail with transient errors, and the reads of
+// the objects it opens. It wraps the traced store, so every try has its own
+// span. Check is not retried: it reports on the store as it is, for health
+// checks.
+type retrying struct {
+	Store
+}
+
+func (r retrying) Exists(ctx context.Context, key string) (bool, error) {
+	var ok bool
+	err := retry.Do(ctx, "storage exists", func(ctx context.Context) error {
+		var err error
+		ok, err = r.Store.Exists(ctx, key)
+		return classify(err)
+	})
+	return ok, err
+}
+
+// Put retries readers it can rewind. Others are read once: an S3 store
+// still retries each part of a multipart upload on its own.
+func (r retrying) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return classify(r.Store.Put(ctx, key, body, size, contentType))
+	}
+	return retry.Do(ctx, "storage put", func(ctx context.Context) error {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return classify(r.Store.Put(ctx, key, body, size, contentType))
+	})
+}
+
+func (r retrying) Open(ctx context.Context, key string) (Object, error) {
+	var obj Object
+	err := retry.Do(ctx, "storage open", func(ctx context.Context) error {
+		var err error
+		obj, err = r.Store.Open(ctx, key)
+		return classify(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return retryingObject{obj, ctx}, nil
+}
+
+func (r retrying) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := retry.Do(ctx, "storage list", func(ctx context.Context) error {
+		var err error
+		keys, err = r.Store.List(ctx, prefix)
+		return classify(err)
+	})
+	return keys, err
+}
+
+func (r retrying) Delete(ctx context.Context, key string) error {
+	return retry.Do(ctx, "storage delete", func(ctx context.Context) error {
+		return classify(r.Store.Delete(ctx, key))
+	})
+}
+
+// retryingObject retries reads, which fetch a range and so can be made
+// again.
+type retryingObject struct {
+	Object
+	ctx context.Context
+}
+
+func (o retryingObject) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	var eof bool
+	err := retry.Do(o.ctx, "storage read", func(context.Context) error {
+		var err error
+		n, err = o.Object.ReadAt(p, off)
+		// The end of the object is not a dropped connection.
+		if eof = err == io.EOF; eof {
+			return nil
+		}
+		return classify(err)
+	})
+	if eof {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// classify marks the errors of S3 services that ask to be retried, such as
+// SlowDown and 503 responses, as transient.
+func classify(err error) error {
+	var resp minio.ErrorResponse
+	if !errors.As(err, &resp) {
+		return err
+	}
+	switch {
+	case resp.Code == "SlowDown", resp.Code == "RequestTimeout", resp.Code == "InternalError",
+		resp.StatusCode == http.StatusInternalServerError, retry.Status(resp.StatusCode):
+		return retry.Mark(err)
+	}
+	return err
+}
@@ -0,0 +1,344 @@
+// Package storage stores source and build archives either in an
+// S3-compatible bucket (Backblaze B2 by default) or in a local directory
+// for single-binary setups.
+//
+// Archives are streamed: Put uploads while the archive is being written,
+// as a multipart upload to S3, and Open reads only the ranges asked for, so
+// that a zip archive can be extracted without a copy on disk.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"zenith/shared/config"
+)
+
+// ErrNotFound is returned when an object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Store is the subset of object storage the services use.
+type Store interface {
+	// Check verifies the store is reachable and the bucket exists.
+	Check(ctx context.Context) error
+	// Exists reports whether key is present.
+	Exists(ctx context.Context, key string) (bool, error)
+	// Put stores what r reads under key. size is the length of r, or -1
+	// when unknown. The object only appears once r is read to its end.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Open opens key for reading. It fails with ErrNotFound when key is
+	// not present.
+	Open(ctx context.Context, key string) (Object, error)
+	// List returns the keys starting with prefix, in order.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes key. Deleting a key that is not present succeeds.
+	Delete(ctx context.Context, key string) error
+	// Describe names the store in logs and responses.
+	Describe() string
+}
+
+// Object is a stored object open for reading. Each ReadAt fetches the range
+// it asks for, or continues the previous one.
+type Object interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// New returns the store selected by cfg.Backend, traced and retrying
+// transient errors with the policy set by retry.Setup.
+func New(cfg config.StorageConfig) (Store, error) {
+	s, err := newStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return retrying{traced{s}}, nil
+}
+
+func newStore(cfg config.StorageConfig) (Store, error) {
+	switch cfg.Backend {
+	case "", "s3":
+		client, err := minio.New(cfg.Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+			Secure: cfg.UseSSL,
+			Region: cfg.Region,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage client: %w", err)
+		}
+		return &S3Store{client: client, bucket: cfg.Bucket}, nil
+	case "local":
+		if err := os.MkdirAll(cfg.LocalDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create storage directory: %w", err)
+		}
+		return &LocalStore{dir: cfg.LocalDir}, nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+}
+
+// S3Store keeps objects in a bucket of an S3-compatible service.
+type S3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+func (s *S3Store) Describe() string { return "bucket " + s.bucket }
+
+func (s *S3Store) Check(ctx context.Context) error {
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return fmt.Errorf("failed to check if bucket exists: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("bucket '%s' does not exist", s.bucket)
+	}
+	return nil
+}
+
+func (s *S3Store) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check if %s exists: %w", key, err)
+	}
+	return true, nil
+}
+
+// partSize is the size of the parts of multipart uploads, and so the memory
+// an upload of unknown size buffers. It allows objects of up to 160GB.
+const partSize = 16 << 20
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType, PartSize: partSize})
+	return err
+}
+
+func (s *S3Store) Open(ctx context.Context, key string) (Object, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		return nil, err
+	}
+	return &s3Object{ctx: ctx, store: s, key: key, etag: info.ETag, size: info.Size}, nil
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, obj.Key)
+	}
+	return keys, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// s3Object reads an object with ranged GETs. A read starting where the
+// previous one ended goes on reading its response; any other read, or one
+// after an error, asks for the range from its offset to the end. Every
+// range must come from the version of the object Open found.
+type s3Object struct {
+	ctx   context.Context
+	store *S3Store
+	key   string
+	etag  string
+	size  int64
+
+	mu   sync.Mutex
+	body io.ReadCloser
+	pos  int64
+}
+
+func (o *s3Object) Size() int64 { return o.size }
+
+func (o *s3Object) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.body == nil || o.pos != off {
+		o.closeBody()
+		opts := minio.GetObjectOptions{}
+		if err := opts.SetRange(off, 0); err != nil {
+			return 0, err
+		}
+		if err := opts.SetMatchETag(o.etag); err != nil {
+			return 0, err
+		}
+		body, _, _, err := minio.Core{Client: o.store.client}.GetObject(o.ctx, o.store.bucket, o.key, opts)
+		if err != nil {
+			return 0, err
+		}
+		o.body, o.pos = body, off
+	}
+
+	n, err := io.ReadFull(o.body, p[:min(int64(len(p)), o.size-off)])
+	o.pos += int64(n)
+	if err != nil {
+		o.closeBody()
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (o *s3Object) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closeBody()
+	return nil
+}
+
+func (o *s3Object) closeBody() {
+	if o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+}
+
+// LocalStore keeps objects as files below a directory.
+type LocalStore struct {
+	dir string
+}
+
+func (s *LocalStore) Describe() string { return "directory " + s.dir }
+
+func (s *LocalStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + filepath.FromSlash(key))
+	if clean == string(filepath.Separator) || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.dir, clean), nil
+}
+
+func (s *LocalStore) Check(context.Context) error {
+	info, err := os.Stat(s.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.dir)
+	}
+	return nil
+}
+
+func (s *LocalStore) Exists(_ context.Context, key string) (bool, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put writes r to a temporary file renamed to the object, so readers never
+// see a partial object.
+func (s *LocalStore) Put(_ context.Context, key string, r io.Reader, _ int64, _ string) error {
+	dst, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+func (s *LocalStore) Open(_ context.Context, key string) (Object, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fileObject{f, info.Size()}, nil
+}
+
+// List walks the directory holding prefix, skipping the temporary files of
+// Puts in progress.
+func (s *LocalStore) List(_ context.Context, prefix string) ([]string, error) {
+	root := filepath.Join(s.dir, filepath.FromSlash(path.Dir("/"+prefix)))
+	var keys []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() || strings.HasSuffix(p, ".tmp") {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (s *LocalStore) Delete(_ context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+type fileObject struct {
+	*os.File
+	size int64
+}
+
+func (o fileObject) Size() int64 { return o.size }
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"zenith/shared/config"
+	"zenith/shared/retry"
+)
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := &LocalStore{dir: t.TempDir()}
+
+	if err := s.Put(ctx, "site.zip", strings.NewReader("archive"), -1, "application/zip"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Exists(ctx, "site.zip"); err != nil || !ok {
+		t.Fatalf("Exists = %v, %v; want true", ok, err)
+	}
+
+	obj, err := s.Open(ctx, "site.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if data, err := io.ReadAll(io.NewSectionReader(obj, 0, obj.Size())); err != nil || string(data) != "archive" {
+		t.Errorf("read %q, %v; want %q", data, err, "archive")
+	}
+
+	if _, err := s.Open(ctx, "missing.zip"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open(missing) = %v, want ErrNotFound", err)
+	}
+	if ok, _ := s.Exists(ctx, "missing.zip"); ok {
+		t.Error("Exists(missing) = true")
+	}
+
+	if err := s.Delete(ctx, "site.zip"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.Exists(ctx, "site.zip"); ok {
+		t.Error("Exists after Delete = true")
+	}
+	if err := s.Delete(ctx, "site.zip"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+}
+
+func TestLocalStoreList(t *testing.T) {
+	ctx := context.Background()
+	s := &LocalStore{dir: t.TempDir()}
+	for _, key := range []string{"manifests/site/b.json", "manifests/site/a.json", "manifests/site-2/a.json", "site.zip"} {
+		if err := s.Put(ctx, key, strings.NewReader("{}"), -1, "application/json"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(s.dir, "manifests", "site", "c.json.tmp"), nil, 0644)
+
+	keys, err := s.List(ctx, "manifests/site/")
+	if err != nil || strings.Join(keys, " ") != "manifests/site/a.json manifests/site/b.json" {
+		t.Errorf("List = %v, %v", keys, err)
+	}
+	if keys, err := s.List(ctx, "manifests/none/"); err != nil || len(keys) != 0 {
+		t.Errorf("List(none) = %v, %v", keys, err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	ctx := context.Background()
+	s := &LocalStore{dir: t.TempDir()}
+
+	err := Stream(ctx, s, "site.zip", "application/zip", func(w io.Writer) error {
+		_, err := io.WriteString(w, "archive")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(s.dir, "site.zip")); string(data) != "archive" {
+		t.Errorf("stored %q", data)
+	}
+
+	tooLarge := errors.New("too large")
+	err = Stream(ctx, s, "big.zip", "application/zip", func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return tooLarge
+	})
+	var werr *WriteError
+	if !errors.As(err, &werr) || !errors.Is(err, tooLarge) {
+		t.Errorf("failed write: err = %v", err)
+	}
+	if ok, _ := s.Exists(ctx, "big.zip"); ok {
+		t.Error("failed write left an object")
+	}
+
+	err = Stream(ctx, &flakyStore{failures: 1, err: errors.New("bucket gone")}, "site.zip", "application/zip", func(w io.Writer) error {
+		_, err := w.Write(make([]byte, 1<<20))
+		return err
+	})
+	if err == nil || errors.As(err, &werr) {
+		t.Errorf("failed store: err = %v, want the storage error", err)
+	}
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	s := &LocalStore{dir: t.TempDir()}
+	for _, key := range []string{"../outside.zip", "a/../../b", "/"} {
+		if _, err := s.path(key); err == nil {
+			t.Errorf("path(%q) succeeded", key)
+		}
+	}
+}
+
+func TestRetryingRetriesTransientErrors(t *testing.T) {
+	retry.Setup(config.RetryConfig{Attempts: 3, BaseDelay: "1ms", MaxDelay: "1ms"})
+	defer retry.Setup(config.Default().Retry)
+	ctx := context.Background()
+
+	flaky := &flakyStore{failures: 2, err: minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}}
+	if err := (retrying{flaky}).Put(ctx, "site.zip", strings.NewReader("archive"), 7, "application/zip"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if flaky.calls != 3 {
+		t.Errorf("%d calls, want 3", flaky.calls)
+	}
+
+	missing := &flakyStore{failures: 5, err: minio.ErrorResponse{Code: "NoSuchBucket", StatusCode: 404}}
+	if _, err := (retrying{missing}).Open(ctx, "site.zip"); err == nil {
+		t.Fatal("Open succeeded")
+	}
+	if missing.calls != 1 {
+		t.Errorf("%d calls for a permanent error, want 1", missing.calls)
+	}
+
+	reset := &flakyStore{failures: 1, err: syscall.ECONNRESET}
+	obj, err := (retrying{reset}).Open(ctx, "site.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset.calls, reset.failures = 0, 1
+	buf := make([]byte, 4)
+	if n, err := obj.ReadAt(buf, 3); n != 4 || err != nil || string(buf) != "hive" {
+		t.Errorf("ReadAt = %d, %v, %q", n, err, buf)
+	}
+	if n, err := obj.ReadAt(buf, 5); n != 2 || err != io.EOF {
+		t.Errorf("ReadAt past the end = %d, %v; want 2, EOF", n, err)
+	}
+}
+
+// flakyStore fails its first failures calls with err. Objects it opens
+// hold "archive" and fail their reads the same way.
+type flakyStore struct {
+	LocalStore
+	failures int
+	err      error
+	calls    int
+}
+
+func (s *flakyStore) fail() error {
+	s.calls++
+	if s.calls <= s.failures {
+		return s.err
+	}
+	return nil
+}
+
+func (s *flakyStore) Put(context.Context, string, io.Reader, int64, string) error { return s.fail() }
+
+func (s *flakyStore) Open(context.Context, string) (Object, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+	return flakyObject{s, strings.NewReader("archive")}, nil
+}
+
+type flakyObject struct {
+	s *flakyStore
+	*strings.Reader
+}
+
+func (o flakyObject) ReadAt(p []byte, off int64) (int, error) {
+	if err := o.s.fail(); err != nil {
+		return 0, err
+	}
+	return o.Reader.ReadAt(p, off)
+}
+
+func (flakyObject) Close() error { return nil }
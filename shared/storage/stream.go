@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// WriteError is the error of the write function passed to Stream.
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string { return e.Err.Error() }
+func (e *WriteError) Unwrap() error { return e.Err }
+
+// errAborted stops the write function of Stream once storing has failed.
+var errAborted = errors.New("storing the stream failed")
+
+// Stream stores under key what write writes, uploading it while it is
+// being written. It fails with a *WriteError when write does; a write
+// stopped because storing failed returns the storage error instead.
+// write has returned when Stream does.
+func Stream(ctx context.Context, s Store, key, contentType string, write func(io.Writer) error) error {
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+
+	err := s.Put(ctx, key, pr, -1, contentType)
+	pr.CloseWithError(errAborted)
+	if werr := <-written; werr != nil && !errors.Is(werr, errAborted) {
+		return &WriteError{werr}
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"go.opentelemetry.io/otel/attribute"
+	"zenith/shared/tracing"
+)
+
+// traced records a span for every call that reaches the store.
+type traced struct {
+	Store
+}
+
+func (t traced) Check(ctx context.Context) error {
+	ctx, span := tracing.Start(ctx, "storage check", attribute.String("storage.store", t.Describe()))
+	err := t.Store.Check(ctx)
+	tracing.End(span, err)
+	return err
+}
+
+func (t traced) Exists(ctx context.Context, key string) (bool, error) {
+	ctx, span := tracing.Start(ctx, "storage exists", t.attrs(key)...)
+	ok, err := t.Store.Exists(ctx, key)
+	span.SetAttributes(attribute.Bool("storage.exists", ok))
+	tracing.End(span, err)
+	return ok, err
+}
+
+func (t traced) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	ctx, span := tracing.Start(ctx, "storage put", t.attrs(key)...)
+	err := t.Store.Put(ctx, key, r, size, contentType)
+	tracing.End(span, err)
+	return err
+}
+
+func (t traced) Open(ctx context.Context, key string) (Object, error) {
+	ctx, span := tracing.Start(ctx, "storage open", t.attrs(key)...)
+	obj, err := t.Store.Open(ctx, key)
+	if err == nil {
+		span.SetAttributes(attribute.Int64("storage.size", obj.Size()))
+	}
+	tracing.End(span, err)
+	return obj, err
+}
+
+func (t traced) List(ctx context.Context, prefix string) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "storage list", attribute.String("storage.store", t.Describe()), attribute.String("storage.prefix", prefix))
+	keys, err := t.Store.List(ctx, prefix)
+	span.SetAttributes(attribute.Int("storage.keys", len(keys)))
+	tracing.End(span, err)
+	return keys, err
+}
+
+func (t traced) Delete(ctx context.Context, key string) error {
+	ctx, span := tracing.Start(ctx, "storage delete", t.attrs(key)...)
+	err := t.Store.Delete(ctx, key)
+	tracing.End(span, err)
+	return err
+}
+
+func (t traced) attrs(key string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("storage.store", t.Describe()),
+		attribute.String("storage.key", key),
+	}
+}
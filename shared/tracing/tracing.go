@@ -0,0 +1,176 @@
+// Package tracing traces deploys across request_handler, upload_service and
+// build_service with OpenTelemetry.
+//
+// Every service propagates W3C trace context on the requests it receives
+// and sends, so one trace covers a deploy from the API call to the last
+// storage write. Spans are exported over OTLP/HTTP when a collector endpoint
+// is configured and dropped otherwise.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+	"zenith/shared/config"
+	"zenith/shared/metrics"
+)
+
+const tracerName = "zenith"
+
+func init() {
+	// Context is propagated even when spans are not exported, so services
+	// with an exporter still see the trace of their callers.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Setup exports the spans of service to the OTLP/HTTP collector in cfg.
+// Without an endpoint it does nothing. The returned function flushes and
+// stops the exporter.
+func Setup(ctx context.Context, cfg config.TracingConfig, service string) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(strings.TrimSuffix(cfg.Endpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+	tp := Install(exporter, service)
+	return tp.Shutdown, nil
+}
+
+// Install sends the spans of service to exporter from now on. Tests pass an
+// in-memory exporter.
+func Install(exporter sdktrace.SpanExporter, service string) *sdktrace.TracerProvider {
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp
+}
+
+// Start starts a span named name as a child of the span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Stage starts a span for stage of the deploy pipeline run by service and
+// times it in metrics.StageDuration. Call the returned function with the
+// stage's error, or nil, when it ends.
+func Stage(ctx context.Context, service, stage string) (context.Context, func(error)) {
+	ctx, span := Start(ctx, stage, attribute.String("zenith.service", service), attribute.String("zenith.stage", stage))
+	timed := metrics.TimeStage(service, stage)
+	return ctx, func(err error) {
+		timed(err)
+		End(span, err)
+	}
+}
+
+// Run runs cmd in a span named after the program and its first argument,
+// such as "npm install". The command line is recorded without the values
+// of -c options, which may hold credentials.
+func Run(ctx context.Context, cmd *exec.Cmd) error {
+	name := filepath.Base(cmd.Path)
+	if args := commandArgs(cmd.Args); len(args) > 0 {
+		name += " " + args[0]
+	}
+	_, span := Start(ctx, name, attribute.String("process.command_line", strings.Join(redactArgs(cmd.Args), " ")))
+	err := cmd.Run()
+	if cmd.ProcessState != nil {
+		span.SetAttributes(attribute.Int("process.exit.code", cmd.ProcessState.ExitCode()))
+	}
+	End(span, err)
+	return err
+}
+
+// commandArgs returns args without the program and the global options
+// before the subcommand, such as git's "-c key=value".
+func commandArgs(args []string) []string {
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		if args[0] == "-c" && len(args) > 1 {
+			args = args[1:]
+		}
+		args = args[1:]
+	}
+	return args
+}
+
+func redactArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		if i > 0 && args[i-1] == "-c" {
+			key, _, _ := strings.Cut(a, "=")
+			a = key + "=..."
+		}
+		out[i] = a
+	}
+	return out
+}
+
+// Middleware continues the trace of incoming requests and wraps each in a
+// server span named after its route.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := otel.Tracer(tracerName).Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", route),
+			))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// Inject adds the trace context of ctx to the headers of req.
+func Inject(ctx context.Context, req *http.Request) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+// TraceID returns the ID of the trace in ctx, or "" outside a trace.
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
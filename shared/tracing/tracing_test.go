@@ -0,0 +1,93 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// setupExporter records spans in memory and returns a function that flushes
+// and returns them.
+func setupExporter(t *testing.T) func() tracetest.SpanStubs {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := Install(exporter, "test")
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	return func() tracetest.SpanStubs {
+		tp.ForceFlush(context.Background())
+		return exporter.GetSpans()
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	spans := setupExporter(t)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Middleware())
+	r.POST("/upload", func(c *gin.Context) {
+		_, done := Stage(c.Request.Context(), "upload", "clone")
+		done(nil)
+		c.Status(http.StatusNoContent)
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	ctx, done := Stage(context.Background(), "request_handler", "upload")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/upload", nil)
+	Inject(ctx, req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	done(errors.New("boom"))
+
+	byName := map[string]tracetest.SpanStub{}
+	for _, s := range spans() {
+		byName[s.Name] = s
+	}
+	upload, server, clone := byName["upload"], byName["POST /upload"], byName["clone"]
+	if !upload.SpanContext.IsValid() || !server.SpanContext.IsValid() || !clone.SpanContext.IsValid() {
+		t.Fatalf("missing spans: %v", byName)
+	}
+	if server.Parent.SpanID() != upload.SpanContext.SpanID() || clone.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Error("spans are not nested upload > POST /upload > clone")
+	}
+	if server.SpanContext.TraceID() != upload.SpanContext.TraceID() {
+		t.Error("server span is in another trace")
+	}
+	if upload.Status.Code != codes.Error {
+		t.Errorf("failed stage has status %v", upload.Status.Code)
+	}
+}
+
+func TestRun(t *testing.T) {
+	spans := setupExporter(t)
+
+	git, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not installed")
+	}
+	cmd := exec.Command(git, "-c", "credential.helper=secret", "version")
+	if err := Run(context.Background(), cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	got := spans()
+	if len(got) != 1 || got[0].Name != "git version" {
+		t.Fatalf("spans = %v", got)
+	}
+	for _, a := range got[0].Attributes {
+		if a.Key == "process.command_line" && a.Value.AsString() != git+" -c credential.helper=... version" {
+			t.Errorf("command line = %q", a.Value.AsString())
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package upload
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// IgnoreFile lists, in gitignore syntax, the paths of a repository that are
+// left out of its archive. Only the file at the repository root is read.
+const IgnoreFile = ".zenithignore"
+
+// ignoreRule is one pattern of an ignore file.
+type ignoreRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// ignoreList matches paths against the rules of an ignore file the way git
+// does: the last matching rule wins, "!" re-includes, a trailing "/" only
+// matches directories, a pattern with a "/" other than a trailing one is
+// relative to the root, any other matches at every depth, and "**" matches
+// any number of directories.
+type ignoreList struct {
+	rules []ignoreRule
+}
+
+// loadIgnore reads the ignore file at path. A missing file ignores nothing.
+func loadIgnore(path string) (*ignoreList, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &ignoreList{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseIgnore(f)
+}
+
+func parseIgnore(r io.Reader) (*ignoreList, error) {
+	l := &ignoreList{}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if rule, ok := parseIgnoreLine(sc.Text()); ok {
+			l.rules = append(l.rules, rule)
+		}
+	}
+	return l, sc.Err()
+}
+
+func parseIgnoreLine(line string) (ignoreRule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are dropped unless escaped.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	var rule ignoreRule
+	switch {
+	case strings.HasPrefix(line, "!"):
+		rule.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	rule.segments = strings.Split(line, "/")
+	if !anchored {
+		rule.segments = append([]string{"**"}, rule.segments...)
+	}
+	return rule, true
+}
+
+// match reports whether the slash-separated path rel, relative to the
+// repository root, is ignored.
+func (l *ignoreList) match(rel string, isDir bool) bool {
+	parts := strings.Split(rel, "/")
+	ignored := false
+	for _, rule := range l.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(rule.segments, parts) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			// A trailing "**" matches everything inside, but not the
+			// directory itself.
+			if len(rest) == 0 {
+				return len(parts) > 0
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(rest, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], parts[0]); err != nil || !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
@@ -0,0 +1,236 @@
+package upload
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+var (
+	ErrFileTooLarge = errors.New("file is larger than the upload limit")
+	ErrRepoTooLarge = errors.New("repository is larger than the upload limit")
+)
+
+// Limits bound what ZipFolder packages. Zero fields are unlimited.
+type Limits struct {
+	MaxRepoSize int64
+	MaxFileSize int64
+}
+
+// maxSkippedListed caps the paths listed in a Packaging; the totals still
+// count every skipped file.
+const maxSkippedListed = 100
+
+// Packaging summarizes what ZipFolder put in an archive and what it left out.
+type Packaging struct {
+	Files        int           `json:"files"`
+	Size         int64         `json:"size"`
+	ArchiveSize  int64         `json:"archive_size"`
+	Skipped      []SkippedPath `json:"skipped"`
+	SkippedFiles int           `json:"skipped_files"`
+	SkippedSize  int64         `json:"skipped_size"`
+}
+
+// SkippedPath is a file, or a directory and everything in it, left out of an
+// archive.
+type SkippedPath struct {
+	Path   string `json:"path"`
+	Files  int    `json:"files"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// packEntry is a file or symlink to be written to the archive.
+type packEntry struct {
+	path string
+	rel  string
+	info fs.FileInfo
+	link string
+}
+
+// ZipFolder writes the repository at source as a zip archive to w, leaving
+// out .git and whatever the repository's .zenithignore lists. Sizes are
+// checked against limits before anything is written. Symlinks are stored
+// as links; those pointing outside the repository are skipped.
+func ZipFolder(source string, w io.Writer, limits Limits) (*Packaging, error) {
+	ignore, err := loadIgnore(filepath.Join(source, IgnoreFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", IgnoreFile, err)
+	}
+	entries, summary, err := planPackage(source, ignore, limits)
+	if err != nil {
+		return nil, err
+	}
+	counter := &countingWriter{w: w}
+	if err := writeZip(counter, entries); err != nil {
+		return nil, err
+	}
+	summary.ArchiveSize = counter.n
+	return summary, nil
+}
+
+func planPackage(source string, ignore *ignoreList, limits Limits) ([]packEntry, *Packaging, error) {
+	var entries []packEntry
+	summary := &Packaging{Skipped: []SkippedPath{}}
+	skip := func(s SkippedPath) {
+		summary.SkippedFiles += s.Files
+		summary.SkippedSize += s.Size
+		if len(summary.Skipped) < maxSkippedListed {
+			summary.Skipped = append(summary.Skipped, s)
+		}
+	}
+
+	err := filepath.WalkDir(source, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path: %w", err)
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if ignore.match(rel, d.IsDir()) {
+			if d.IsDir() {
+				files, size := dirUsage(p)
+				skip(SkippedPath{Path: rel + "/", Files: files, Size: size, Reason: IgnoreFile})
+				return filepath.SkipDir
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			skip(SkippedPath{Path: rel, Files: 1, Size: info.Size(), Reason: IgnoreFile})
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if path.IsAbs(link) || !filepath.IsLocal(path.Join(path.Dir(rel), filepath.ToSlash(link))) {
+				skip(SkippedPath{Path: rel, Files: 1, Reason: "symlink points outside the repository"})
+				return nil
+			}
+			entries = append(entries, packEntry{path: p, rel: rel, info: info, link: link})
+		case info.Mode().IsRegular():
+			if limits.MaxFileSize > 0 && info.Size() > limits.MaxFileSize {
+				return fmt.Errorf("%w: %s is %s, the limit is %s; add it to %s to leave it out",
+					ErrFileTooLarge, rel, formatSize(info.Size()), formatSize(limits.MaxFileSize), IgnoreFile)
+			}
+			summary.Size += info.Size()
+			if limits.MaxRepoSize > 0 && summary.Size > limits.MaxRepoSize {
+				return fmt.Errorf("%w: more than %s to package, the limit is %s; list large files or directories in %s to leave them out",
+					ErrRepoTooLarge, formatSize(summary.Size), formatSize(limits.MaxRepoSize), IgnoreFile)
+			}
+			entries = append(entries, packEntry{path: p, rel: rel, info: info})
+		default:
+			skip(SkippedPath{Path: rel, Files: 1, Reason: "not a regular file"})
+			return nil
+		}
+		summary.Files++
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return entries, summary, nil
+}
+
+func writeZip(w io.Writer, entries []packEntry) error {
+	archive := zip.NewWriter(w)
+	for _, e := range entries {
+		header, err := zip.FileInfoHeader(e.info)
+		if err != nil {
+			return err
+		}
+		header.Name = e.rel
+		if e.link == "" {
+			header.Method = zip.Deflate
+		}
+		writer, err := archive.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("failed to create entry in zip: %w", err)
+		}
+		if e.link != "" {
+			if _, err := io.WriteString(writer, filepath.ToSlash(e.link)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := copyFile(writer, e.path); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func copyFile(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// dirUsage counts the files under dir and their total size.
+func dirUsage(dir string) (files int, size int64) {
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	return files, size
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 2; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%s", float64(n)/float64(div), []string{"KB", "MB", "GB"}[exp])
+}
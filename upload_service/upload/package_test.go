@@ -0,0 +1,145 @@
+package upload
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreMatch(t *testing.T) {
+	l, err := parseIgnore(strings.NewReader(`
+# build output
+node_modules/
+/dist
+*.log
+!keep.log
+docs/**/*.pdf
+assets/raw/**
+\#notes
+trailing
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"node_modules", true, true},
+		{"packages/app/node_modules", true, true},
+		{"node_modules", false, false},
+		{"dist", true, true},
+		{"src/dist", true, false},
+		{"debug.log", false, true},
+		{"logs/debug.log", false, true},
+		{"keep.log", false, false},
+		{"docs/manual.pdf", false, true},
+		{"docs/a/b/manual.pdf", false, true},
+		{"docs/manual.md", false, false},
+		{"assets/raw", true, false},
+		{"assets/raw/photo.tif", false, true},
+		{"#notes", false, true},
+		{"trailing", false, true},
+		{"src/index.js", false, false},
+	}
+	for _, tt := range tests {
+		if got := l.match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("match(%q, dir=%v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+// writeRepo creates files, given as path to content, under a new directory.
+func writeRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, body := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestZipFolder(t *testing.T) {
+	repo := writeRepo(t, map[string]string{
+		".git/HEAD":                   "ref: refs/heads/main",
+		".zenithignore":               "node_modules/\n*.psd\n",
+		"index.html":                  "<h1>hi</h1>",
+		"src/app.js":                  "console.log(1)",
+		"design/logo.psd":             strings.Repeat("x", 300),
+		"node_modules/a/index.js":     strings.Repeat("y", 100),
+		"node_modules/b/package.json": "{}",
+	})
+	os.Symlink("index.html", filepath.Join(repo, "latest.html"))
+	os.Symlink("/etc/passwd", filepath.Join(repo, "passwd"))
+
+	var archive bytes.Buffer
+	summary, err := ZipFolder(repo, &archive, Limits{MaxRepoSize: 1 << 10, MaxFileSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	slices.Sort(names)
+	if want := []string{".zenithignore", "index.html", "latest.html", "src/app.js"}; !slices.Equal(names, want) {
+		t.Errorf("archive has %v, want %v", names, want)
+	}
+
+	if summary.Files != 4 || summary.SkippedFiles != 4 || summary.SkippedSize != 402 {
+		t.Errorf("summary = %+v", summary)
+	}
+	var skipped []string
+	for _, s := range summary.Skipped {
+		skipped = append(skipped, s.Path)
+	}
+	slices.Sort(skipped)
+	if want := []string{"design/logo.psd", "node_modules/", "passwd"}; !slices.Equal(skipped, want) {
+		t.Errorf("skipped %v, want %v", skipped, want)
+	}
+	if summary.ArchiveSize != int64(archive.Len()) {
+		t.Errorf("archive size = %d, wrote %d", summary.ArchiveSize, archive.Len())
+	}
+}
+
+func TestZipFolderLimits(t *testing.T) {
+	repo := writeRepo(t, map[string]string{
+		"a.txt":     strings.Repeat("a", 60),
+		"b.txt":     strings.Repeat("b", 60),
+		"video.mp4": strings.Repeat("v", 200),
+	})
+	var archive bytes.Buffer
+
+	_, err := ZipFolder(repo, &archive, Limits{MaxFileSize: 100})
+	if !errors.Is(err, ErrFileTooLarge) || !strings.Contains(err.Error(), "video.mp4") {
+		t.Errorf("file limit: err = %v", err)
+	}
+	if archive.Len() > 0 {
+		t.Error("archive written before the limits were checked")
+	}
+
+	os.WriteFile(filepath.Join(repo, IgnoreFile), []byte("*.mp4\n"), 0644)
+	if _, err := ZipFolder(repo, &archive, Limits{MaxRepoSize: 100, MaxFileSize: 100}); !errors.Is(err, ErrRepoTooLarge) {
+		t.Errorf("repo limit: err = %v", err)
+	}
+	if _, err := ZipFolder(repo, &archive, Limits{MaxRepoSize: 200, MaxFileSize: 100}); err != nil {
+		t.Errorf("within limits: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Finding is a likely secret in a repository. Match shows only enough of the
+// value to recognize it.
+type Finding struct {
+	Rule  string `json:"rule"`
+	Path  string `json:"path"`
+	Line  int    `json:"line"`
+	Match string `json:"match"`
+}
+
+type secretRule struct {
+	name    string
+	pattern *regexp.Regexp
+	// public rules match a marker, such as a PEM header, rather than the
+	// secret itself, so the match is reported as is.
+	public bool
+}
+
+// secretRules are matched against every line of every text file packaged.
+var secretRules = []secretRule{
+	{"aws-access-key-id", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), false},
+	{"aws-secret-access-key", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})\b`), false},
+	{"github-token", regexp.MustCompile(`\b(?:ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{36,}\b`), false},
+	{"github-fine-grained-token", regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{60,}\b`), false},
+	{"private-key", regexp.MustCompile(`-----BEGIN (?:[A-Z]+ )?PRIVATE KEY(?: BLOCK)?-----`), true},
+}
+
+// envAssignment matches KEY=value lines of .env files.
+var envAssignment = regexp.MustCompile(`^\s*(?:export\s+)?([A-Za-z_][A-Za-z0-9_.]*)\s*=\s*["']?([^"'\s#]+)`)
+
+const (
+	// maxFindings caps what a scan reports.
+	maxFindings = 100
+	// maxScanSize skips files too large to be hand-written configuration.
+	maxScanSize = 1 << 20
+	// Values in .env files at least envSecretLen long with at least
+	// envSecretEntropy bits of entropy per character are reported.
+	envSecretLen     = 16
+	envSecretEntropy = 3.5
+)
+
+// ScanSecrets looks for credentials in the files of the repository at root
+// that would be packaged: everything but .git and what .zenithignore lists.
+func ScanSecrets(root string) ([]Finding, error) {
+	ignore, err := loadIgnore(filepath.Join(root, IgnoreFile))
+	if err != nil {
+		return nil, err
+	}
+	findings := []Finding{}
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if ignore.match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || info.Size() > maxScanSize {
+			return nil
+		}
+		found, err := scanFile(p, rel)
+		if err != nil {
+			return err
+		}
+		findings = append(findings, found...)
+		if len(findings) >= maxFindings {
+			findings = findings[:maxFindings]
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return findings, err
+}
+
+func scanFile(path, rel string) ([]Finding, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Binary files, judged the way git does, are not scanned.
+	if bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+		return nil, nil
+	}
+
+	isEnv := isEnvFile(filepath.Base(rel))
+	var findings []Finding
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), maxScanSize)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		matched := false
+		for _, rule := range secretRules {
+			m := rule.pattern.FindStringSubmatch(text)
+			if m == nil {
+				continue
+			}
+			match := m[0]
+			if !rule.public {
+				match = preview(m[len(m)-1])
+			}
+			findings = append(findings, Finding{Rule: rule.name, Path: rel, Line: line, Match: match})
+			matched = true
+		}
+		if isEnv && !matched {
+			if m := envAssignment.FindStringSubmatch(text); m != nil && len(m[2]) >= envSecretLen && entropy(m[2]) >= envSecretEntropy {
+				findings = append(findings, Finding{Rule: "env-high-entropy", Path: rel, Line: line, Match: m[1] + "=" + preview(m[2])})
+			}
+		}
+	}
+	return findings, nil
+}
+
+// isEnvFile reports whether name is a dotenv file such as .env,
+// .env.production or prod.env.
+func isEnvFile(name string) bool {
+	return name == ".env" || strings.HasPrefix(name, ".env.") || strings.HasSuffix(name, ".env")
+}
+
+// entropy returns the Shannon entropy of s in bits per character.
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+	var h float64
+	n := float64(len([]rune(s)))
+	for _, c := range counts {
+		p := float64(c) / n
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// preview keeps the first four characters of a secret.
+func preview(s string) string {
+	if len(s) <= 4 {
+		return "****"
+	}
+	return s[:4] + "****"
+}
@@ -0,0 +1,331 @@
+// Package upload clones GitHub repositories and stores them as zip archives
+// for the build service.
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/apierr"
+	"zenith/shared/auth"
+	"zenith/shared/config"
+	"zenith/shared/health"
+	"zenith/shared/lifecycle"
+	"zenith/shared/logging"
+	"zenith/shared/manifest"
+	"zenith/shared/metrics"
+	"zenith/shared/redact"
+	"zenith/shared/retry"
+	"zenith/shared/storage"
+	"zenith/shared/tracing"
+)
+
+// ErrInvalidRepoURL is returned for URLs that are not GitHub repositories.
+var ErrInvalidRepoURL = errors.New("URL must be a valid GitHub repository URL")
+
+type DeployRequest struct {
+	URL string `json:"url" binding:"required,url"`
+	// Token is a GitHub token to clone with instead of the configured one.
+	Token string `json:"token"`
+}
+
+// Result describes a repository archive stored by Upload.
+type Result struct {
+	Message   string `json:"message"`
+	Bucket    string `json:"bucket"`
+	File      string `json:"file"`
+	Repo      string `json:"repo"`
+	Timestamp string `json:"timestamp"`
+	// Packaging lists what was left out of the archive and its size.
+	Packaging *Packaging `json:"packaging"`
+	// Secrets lists likely credentials found in the packaged files.
+	Secrets []Finding `json:"secrets"`
+}
+
+var (
+	cfg     *config.Config
+	store   storage.Store
+	limits  Limits
+	logger  = slog.Default()
+	checker *health.Checker
+	scratch *lifecycle.Scratch
+	// minFreeDisk is the least free space in the tmp directory for the
+	// service to be ready.
+	minFreeDisk int64
+)
+
+// Setup configures the package for Upload and the HTTP handlers.
+func Setup(c *config.Config, s storage.Store) error {
+	l, err := limitsFromConfig(c.Upload)
+	if err != nil {
+		return err
+	}
+	cfg = c
+	logger = logging.New("upload_service", c.Upload.LogLevel)
+	store = s
+	limits = l
+	redact.Install(c.Secrets()...)
+	if err := retry.Setup(c.Retry); err != nil {
+		return err
+	}
+	if scratch, err = lifecycle.OpenScratch(cfg.Upload.TmpDir); err != nil {
+		return fmt.Errorf("error creating tmp directory: %w", err)
+	}
+	if minFreeDisk, err = health.MinFreeDisk(c.Health); err != nil {
+		return err
+	}
+	checker = health.New("upload_service", health.Check{Name: "storage", Run: func(ctx context.Context) error {
+		return store.Check(ctx)
+	}})
+	checker.Add(HealthChecks()...)
+	return nil
+}
+
+// HealthChecks checks git and the space left in the tmp directory. Setup
+// must be called first.
+func HealthChecks() []health.Check {
+	return append(health.Binaries("git"), health.DiskSpace("tmp", cfg.Upload.TmpDir, minFreeDisk))
+}
+
+// limitsFromConfig parses the upload size limits; empty settings are
+// unlimited.
+func limitsFromConfig(c config.UploadConfig) (Limits, error) {
+	var l Limits
+	var err error
+	if c.MaxRepoSize != "" {
+		if l.MaxRepoSize, err = config.ParseSize(c.MaxRepoSize); err != nil {
+			return Limits{}, fmt.Errorf("invalid max repo size: %w", err)
+		}
+	}
+	if c.MaxFileSize != "" {
+		if l.MaxFileSize, err = config.ParseSize(c.MaxFileSize); err != nil {
+			return Limits{}, fmt.Errorf("invalid max file size: %w", err)
+		}
+	}
+	return l, nil
+}
+
+// Routes registers the public health checks on r. Uploads are only served
+// on the internal listener: which projects a caller may deploy is known to
+// request_handler alone, so it is the only caller.
+func Routes(r gin.IRoutes) {
+	checker.Routes(r)
+}
+
+// InternalRoutes registers the upload API on r for request_handler, which
+// signs its calls with the internal secret, the metrics for Prometheus and
+// the health checks.
+func InternalRoutes(r gin.IRoutes, v *auth.Verifier) {
+	r.POST("/upload", auth.RequireSigned(v), logging.TrustDeploymentID, handleDeploy)
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+	checker.Routes(r)
+}
+
+// Run serves the health checks on cfg.Upload.Addr and the upload API for
+// request_handler on cfg.Upload.InternalAddr as a standalone service until
+// SIGINT or SIGTERM.
+func Run(c *config.Config) error {
+	s, err := storage.New(c.Storage)
+	if err != nil {
+		return err
+	}
+	if err := Setup(c, s); err != nil {
+		return err
+	}
+	shutdown, err := tracing.Setup(context.Background(), c.Tracing, "upload_service")
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.Background())
+	slog.SetDefault(logger)
+	timeout, err := lifecycle.Timeout(c.Shutdown)
+	if err != nil {
+		return err
+	}
+
+	router := gin.New()
+	router.Use(gin.Recovery(), logging.Middleware(logger), tracing.Middleware())
+	Routes(router)
+	internal := gin.New()
+	internal.Use(gin.Recovery(), logging.Middleware(logger), tracing.Middleware())
+	InternalRoutes(internal, auth.NewVerifier(cfg.Auth.InternalSecret))
+
+	ctx, stop := lifecycle.SignalContext()
+	defer stop()
+	logger.Info("server starting", "addr", cfg.Upload.Addr, "internal_addr", cfg.Upload.InternalAddr)
+	err = lifecycle.Serve(ctx, timeout,
+		&http.Server{Addr: cfg.Upload.Addr, Handler: router},
+		&http.Server{Addr: cfg.Upload.InternalAddr, Handler: internal})
+	logger.Info("server stopped")
+	return err
+}
+
+func handleDeploy(c *gin.Context) {
+	var req DeployRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierr.Respond(c, apierr.New(apierr.CodeInvalidRequest, "", err.Error()))
+		return
+	}
+
+	result, err := Upload(c.Request.Context(), req.URL, req.Token)
+	if err != nil {
+		apierr.Respond(c, err)
+		return
+	}
+
+	c.JSON(200, result)
+}
+
+// Upload clones repoURL with token, or the configured GitHub token when
+// empty, and stores it as the source of the deployment in ctx,
+// sources/<repo>/<deployment id>.zip, so each deploy builds the commit it
+// cloned. Repositories or files over the configured limits fail with
+// ErrRepoTooLarge or ErrFileTooLarge. Errors are *apierr.Error values
+// naming the stage that failed.
+func Upload(ctx context.Context, repoURL, token string) (*Result, error) {
+	if !strings.HasPrefix(repoURL, "https://github.com/") {
+		return nil, apierr.Wrap(ErrInvalidRepoURL, apierr.CodeInvalidRequest, "clone")
+	}
+
+	logger.InfoContext(ctx, "uploading repository", "url", repoURL)
+
+	cloneCtx, done := tracing.Stage(ctx, "upload", "clone")
+	repoPath, repoName, err := CloneRepoWithToken(cloneCtx, repoURL, token)
+	done(err)
+	if err != nil {
+		return nil, apierr.Wrap(fmt.Errorf("Clone failed: %w", err), apierr.CodeCloneFailed, "clone")
+	}
+	logger.InfoContext(ctx, "repository cloned", "path", repoPath)
+
+	defer func() {
+		if err := scratch.Remove(repoPath); err != nil {
+			logger.WarnContext(ctx, "failed to clean up repo directory", "error", err)
+		}
+	}()
+
+	_, done = tracing.Stage(ctx, "upload", "scan")
+	secrets, err := ScanSecrets(repoPath)
+	done(err)
+	if err != nil {
+		return nil, apierr.Wrap(fmt.Errorf("Secret scan failed: %w", err), apierr.CodeInternal, "scan")
+	}
+	if len(secrets) > 0 {
+		logger.WarnContext(ctx, "possible secrets found", "url", repoURL, "count", len(secrets))
+	}
+
+	id := logging.DeploymentID(ctx)
+	if !logging.ValidID(id) {
+		id = logging.NewID()
+	}
+	objectName := manifest.SourceKey(repoName, id)
+
+	// The archive is stored while it is written, so the stage covers both.
+	packageCtx, done := tracing.Stage(ctx, "upload", "package")
+	packaging, err := UploadArchive(packageCtx, repoPath, objectName)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	logger.InfoContext(ctx, "repository packaged", "object", objectName, "files", packaging.Files,
+		"bytes", packaging.ArchiveSize, "skipped_files", packaging.SkippedFiles)
+	metrics.ArtifactBytes.Observe(float64(packaging.ArchiveSize), "source")
+
+	logger.InfoContext(ctx, "repository uploaded", "object", objectName, "store", store.Describe())
+	return &Result{
+		Message:   "Repo uploaded to B2 successfully!",
+		Bucket:    cfg.Storage.Bucket,
+		File:      objectName,
+		Repo:      repoName,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Packaging: packaging,
+		Secrets:   secrets,
+	}, nil
+}
+
+// gitCredentialHelper answers git's credential requests with the token in
+// $ZENITH_GIT_TOKEN, so the token never appears in the clone URL, the
+// command line, .git/config or git's output.
+const gitCredentialHelper = `!f() { test "$1" = get && echo username=x-access-token && echo "password=$ZENITH_GIT_TOKEN"; }; f`
+
+// CloneRepoWithToken shallow-clones repoURL into a scratch directory of its
+// own, authenticating with token or, when empty, the configured GitHub
+// token. Errors never contain the token. The caller removes the clone with
+// scratch.Remove.
+func CloneRepoWithToken(ctx context.Context, repoURL, token string) (string, string, error) {
+	if token == "" {
+		token = cfg.GitHub.Token
+	}
+
+	trimmed := strings.TrimPrefix(repoURL, "https://github.com/")
+	cloneURL := "https://github.com/" + trimmed
+
+	repoName := strings.TrimSuffix(filepath.Base(trimmed), ".git")
+	if !strings.HasSuffix(trimmed, ".git") {
+		cloneURL += ".git"
+	}
+
+	repoFolder, err := scratch.Mkdir(ctx, repoName)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create clone directory: %w", err)
+	}
+
+	// The empty helper clears any configured ones so the token is not
+	// stored in a system keychain.
+	cmd := lifecycle.Command(ctx, "git",
+		"-c", "credential.helper=",
+		"-c", "credential.helper="+gitCredentialHelper,
+		"clone", "--depth", "1", cloneURL, repoFolder)
+	cmd.Env = append(os.Environ(), "ZENITH_GIT_TOKEN="+token, "GIT_TERMINAL_PROMPT=0")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := tracing.Run(ctx, cmd); err != nil {
+		scratch.Remove(repoFolder)
+		err = fmt.Errorf("git clone failed: %w - output: %s", err, strings.TrimSpace(output.String()))
+		return "", "", redact.New(token).Error(redact.Error(err))
+	}
+
+	return repoFolder, repoName, nil
+}
+
+// UploadArchive packages the repository at repoPath with ZipFolder and
+// streams the archive to storage as objectName, without writing it to disk.
+func UploadArchive(ctx context.Context, repoPath, objectName string) (*Packaging, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	if err := store.Check(ctx); err != nil {
+		return nil, apierr.Wrap(fmt.Errorf("Upload failed: %w", err), apierr.CodeStorage, "store")
+	}
+
+	logger.InfoContext(ctx, "uploading archive", "object", objectName, "store", store.Describe())
+	var packaging *Packaging
+	err := storage.Stream(ctx, store, objectName, "application/zip", func(w io.Writer) (err error) {
+		packaging, err = ZipFolder(repoPath, w, limits)
+		return err
+	})
+	var werr *storage.WriteError
+	if errors.As(err, &werr) {
+		code := apierr.CodeInternal
+		if errors.Is(err, ErrFileTooLarge) || errors.Is(err, ErrRepoTooLarge) {
+			code = apierr.CodeTooLarge
+		}
+		return nil, apierr.Wrap(fmt.Errorf("Zipping failed: %w", werr.Err), code, "package")
+	}
+	if err != nil {
+		return nil, apierr.Wrap(fmt.Errorf("Upload failed: %w", err), apierr.CodeStorage, "store")
+	}
+	return packaging, nil
+}
@@ -0,0 +1,107 @@
+package upload
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"zenith/shared/config"
+)
+
+const testToken = "ghp_TESTtoken1234567890"
+
+// fakeGit puts a git on PATH that records its arguments, then fails like a
+// clone of a private repository and echoes the token back the way a
+// misbehaving remote might.
+func fakeGit(t *testing.T) (args string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as git")
+	}
+	dir := t.TempDir()
+	args = filepath.Join(dir, "args")
+	script := `#!/bin/sh
+echo "$@" > ` + args + `
+echo "remote: Invalid username or password for $ZENITH_GIT_TOKEN" >&2
+echo "fatal: Authentication failed" >&2
+exit 128
+`
+	if err := os.WriteFile(filepath.Join(dir, "git"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return args
+}
+
+func TestCredentialHelper(t *testing.T) {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+	cmd := exec.Command(git, "-c", "credential.helper=", "-c", "credential.helper="+gitCredentialHelper, "credential", "fill")
+	cmd.Env = append(os.Environ(), "ZENITH_GIT_TOKEN="+testToken, "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdin = strings.NewReader("protocol=https\nhost=github.com\n\n")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "username=x-access-token\npassword="+testToken+"\n") {
+		t.Errorf("git credential fill = %q", out)
+	}
+}
+
+func TestCloneNeverLeaksToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	argsFile := fakeGit(t)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	c := config.Default()
+	c.GitHub.Token = testToken
+	c.Upload.TmpDir = t.TempDir()
+	// The clone fails before anything is stored.
+	if err := Setup(c, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.POST("/upload", handleDeploy)
+
+	// The second request brings an installation token of its own.
+	const installationToken = "ghs_installation0123456789"
+	for _, tt := range []struct{ body, token string }{
+		{`{"url":"https://github.com/acme/private"}`, testToken},
+		{`{"url":"https://github.com/acme/private","token":"` + installationToken + `"}`, installationToken},
+	} {
+		logs.Reset()
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(tt.body)))
+		if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"code":"clone_failed"`) {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		log.Printf("Error: %s", rec.Body)
+
+		args, _ := os.ReadFile(argsFile)
+		for name, text := range map[string]string{"git arguments": string(args), "response": rec.Body.String(), "logs": logs.String()} {
+			if strings.Contains(text, tt.token) {
+				t.Errorf("%s contain the token: %s", name, text)
+			}
+		}
+		if !strings.Contains(rec.Body.String(), "Authentication failed") {
+			t.Errorf("response lost git's message: %s", rec.Body)
+		}
+		if !strings.Contains(string(args), "https://github.com/acme/private.git") {
+			t.Errorf("git arguments = %q", args)
+		}
+	}
+}